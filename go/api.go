@@ -0,0 +1,26 @@
+package main
+
+import (
+	"net/http"
+
+	genkey "github.com/waterdragen/akl-ws/genkey"
+
+	gin "github.com/gin-gonic/gin"
+)
+
+// genkeyApi answers stateless analysis requests, e.g.
+// POST /go/genkey/analyze {"layout": "qwerty", "weights": {"Score": {"LSB": 2}}}
+func genkeyApi(c *gin.Context) {
+	var req genkey.ApiRequest
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+
+	result, err := genkey.RunApi(c.Param("command"), req)
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+	c.JSON(http.StatusOK, result)
+}
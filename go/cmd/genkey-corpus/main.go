@@ -0,0 +1,44 @@
+// genkey-corpus converts json corpora to the binary corpus format, which
+// genkey loads instead of the json when both are present. Run it from the
+// go directory:
+//
+//	go run ./cmd/genkey-corpus [name...]
+//
+// Without names every json corpus in the corpora directory is converted.
+package main
+
+import (
+	"fmt"
+	"log"
+	"os"
+	"path/filepath"
+	"strings"
+
+	genkey "github.com/waterdragen/akl-ws/genkey"
+)
+
+func main() {
+	var config genkey.UserConfig
+	genkey.ReadWeights(&config)
+
+	names := os.Args[1:]
+	if len(names) == 0 {
+		entries, err := os.ReadDir(filepath.Join("genkey", config.Paths.Corpora))
+		if err != nil {
+			log.Fatal(err)
+		}
+		for _, e := range entries {
+			if name, ok := strings.CutSuffix(e.Name(), ".json"); ok && !e.IsDir() {
+				names = append(names, name)
+			}
+		}
+	}
+
+	for _, name := range names {
+		path, err := genkey.ConvertCorpus(&config, name)
+		if err != nil {
+			log.Fatalf("%s: %v", name, err)
+		}
+		fmt.Printf("%s -> %s\n", name, path)
+	}
+}
@@ -0,0 +1,121 @@
+package genkey
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"strconv"
+	"strings"
+)
+
+// ApiCommands are the commands that can be answered without a websocket
+// session. They all produce a structured result.
+var ApiCommands = []string{"analyze", "rank", "sfbs", "dsfbs", "lsbs", "speed", "bigrams", "ngram", "cmini", "export"}
+
+type ApiRequest struct {
+	Layout   string          `json:"layout"`  // name of a layout in the layouts directory
+	Text     string          `json:"text"`    // or a layout in the layouts directory text format or cmini JSON
+	Weights  json.RawMessage `json:"weights"` // overrides for [Weights] in config.toml
+	Flags    []string        `json:"flags"`   // e.g. ["-stagger", "-dynamic"]
+	Count    int             `json:"count"`
+	Ngram    string          `json:"ngram"`
+	Corpus   string          `json:"corpus"`   // a corpus in the corpora directory, or a blend like "shai-iweb:70 tr:30"
+	Keyboard string          `json:"keyboard"` // a profile in the keyboards directory
+	Format   string          `json:"format"`   // of export, one of ExportFormats
+}
+
+// textCapture collects the plain text output of a command so that it can
+// be returned as the error message when the command produced no result.
+type textCapture struct {
+	sb strings.Builder
+}
+
+func (self *textCapture) WriteMessage(messageType int, data []byte) error {
+	self.sb.Write(data)
+	return nil
+}
+
+// RunApi runs one stateless command against a fresh UserData, so weight
+// overrides never leak into other requests or websocket sessions.
+func RunApi(command string, req ApiRequest) (result any, err error) {
+	found := false
+	for _, c := range ApiCommands {
+		if c == command {
+			found = true
+			break
+		}
+	}
+	if !found {
+		return nil, fmt.Errorf("unknown command [%s]", command)
+	}
+
+	defer func() {
+		if r := recover(); r != nil {
+			err = fmt.Errorf("%v", r)
+		}
+	}()
+
+	capture := &textCapture{}
+	userData := &UserData{}
+	genkeyMain := NewGenkeyMain(capture, userData)
+
+	for _, f := range req.Flags {
+		if !strings.HasPrefix(f, "-") {
+			return nil, fmt.Errorf("invalid flag [%s]", f)
+		}
+	}
+	genkeyMain.parseFlags(req.Flags)
+	if len(req.Weights) != 0 {
+		if err := json.Unmarshal(req.Weights, &userData.Config.Weights); err != nil {
+			return nil, fmt.Errorf("invalid weights: %v", err)
+		}
+	}
+	if req.Corpus != "" {
+		if err := userData.SelectCorpus(req.Corpus); err != nil {
+			return nil, err
+		}
+	}
+	if req.Keyboard != "" {
+		if err := userData.SelectKeyboard(req.Keyboard); err != nil {
+			return nil, err
+		}
+	}
+	genkeyMain.loadData()
+
+	args := []string{command}
+	switch command {
+	case "rank":
+	case "ngram":
+		if req.Ngram == "" {
+			return nil, errors.New("missing ngram")
+		}
+		args = append(args, req.Ngram)
+	default:
+		if command == "export" {
+			if req.Format == "" {
+				return nil, errors.New("missing format")
+			}
+			args = append(args, req.Format)
+		}
+		name := req.Layout
+		if req.Text != "" {
+			l := NewGenkeyLayout(capture, userData).ParseLayout("request", req.Text)
+			name = strings.ToLower(l.Name)
+			userData.Layouts[name] = l
+		}
+		if name == "" {
+			return nil, errors.New("missing layout")
+		}
+		args = append(args, name)
+		if req.Count > 0 {
+			args = append(args, strconv.Itoa(req.Count))
+		}
+	}
+
+	genkeyMain.runCommand(args)
+	result = genkeyMain.GetResult()
+	if result == nil {
+		return nil, errors.New(strings.TrimSpace(capture.sb.String()))
+	}
+	return result, nil
+}
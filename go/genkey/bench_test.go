@@ -0,0 +1,181 @@
+package genkey
+
+import (
+	"math"
+	"os"
+	"testing"
+)
+
+// The map based implementations of the analyzer metrics that the compiled
+// Corpus replaced, kept to compare against.
+
+func legacyFingerSpeed(g *GenkeyLayout, l *Layout) []float64 {
+	speeds := make([]float64, len(l.Fingermap))
+	weight := &g.userData.Config.Weights
+	coords := g.coords(l)
+	sfbweight := weight.FSpeed.SFB
+	dsfbweight := weight.FSpeed.DSFB
+	for f, posits := range l.Fingermap {
+		for i := 0; i < len(posits); i++ {
+			for j := i; j < len(posits); j++ {
+				p1 := &posits[i]
+				p2 := &posits[j]
+				k1 := &l.Keys[p1.Row][p1.Col]
+				k2 := &l.Keys[p2.Row][p2.Col]
+
+				sfb := float64(g.userData.Data.Bigrams[*k1+*k2])
+				dsfb := g.userData.Data.Skipgrams[*k1+*k2]
+				if i != j {
+					sfb += float64(g.userData.Data.Bigrams[*k2+*k1])
+					dsfb += g.userData.Data.Skipgrams[*k2+*k1]
+				}
+
+				dist := g.twoKeyDist(coords, *p1, *p2, true) + (2 * weight.FSpeed.KeyTravel)
+				speeds[f] += ((sfbweight * sfb) + (dsfbweight * dsfb)) * dist
+			}
+		}
+		speeds[f] /= weight.FSpeed.KPS[f]
+		speeds[f] = 800 * speeds[f] / l.Total
+	}
+	return speeds
+}
+
+func legacySFBs(g *GenkeyLayout, l *Layout) float64 {
+	var count float64
+	for _, posits := range l.Fingermap {
+		for i := 0; i < len(posits); i++ {
+			for j := i + 1; j < len(posits); j++ {
+				k1 := l.Keys[posits[i].Row][posits[i].Col]
+				k2 := l.Keys[posits[j].Row][posits[j].Col]
+				count += float64(g.userData.Data.Bigrams[k1+k2] + g.userData.Data.Bigrams[k2+k1])
+			}
+		}
+	}
+	return count
+}
+
+func legacyLSBs(g *GenkeyLayout, l *Layout) int {
+	var count int
+	for _, pair := range g.LSBPairs(l) {
+		k1 := l.Keys[pair[0].Row][pair[0].Col]
+		k2 := l.Keys[pair[1].Row][pair[1].Col]
+		count += g.userData.Data.Bigrams[k1+k2] + g.userData.Data.Bigrams[k2+k1]
+	}
+	return count
+}
+
+func legacyTrigrams(g *GenkeyLayout, l *Layout, precision int) TrigramValues {
+	var tgs TrigramValues
+	top := g.userData.Data.TopTrigrams
+	if precision == 0 {
+		precision = len(top)
+	}
+	for _, tg := range top[:min(len(top), precision)] {
+		runes := []rune(tg.Ngram)
+		if len(runes) != 3 {
+			continue
+		}
+		km1, ok1 := l.Keymap.TryGet(string(runes[0]))
+		km2, ok2 := l.Keymap.TryGet(string(runes[1]))
+		km3, ok3 := l.Keymap.TryGet(string(runes[2]))
+		if !ok1 || !ok2 || !ok3 {
+			continue
+		}
+		f1, _ := l.Finger(km1)
+		f2, _ := l.Finger(km2)
+		f3, _ := l.Finger(km3)
+		tgs.Total += int(tg.Count)
+		tgs.add(classifyTrigram(f1, f2, f3), int(tg.Count))
+	}
+	return tgs
+}
+
+func sum(values []float64) float64 {
+	var total float64
+	for _, v := range values {
+		total += v
+	}
+	return total
+}
+
+// metricCase is a metric computed both ways.
+type metricCase struct {
+	metric string
+	legacy func() float64
+	dense  func() float64
+}
+
+// loadTestSession loads the config, corpus and layouts from the go
+// directory like an API request.
+func loadTestSession(tb testing.TB) *GenkeyMain {
+	tb.Helper()
+	wd, err := os.Getwd()
+	if err != nil {
+		tb.Fatal(err)
+	}
+	if err := os.Chdir(".."); err != nil {
+		tb.Fatal(err)
+	}
+	tb.Cleanup(func() { os.Chdir(wd) })
+
+	genkeyMain := NewGenkeyMain(&textCapture{}, &UserData{})
+	genkeyMain.parseFlags(nil)
+	genkeyMain.loadData()
+	return genkeyMain
+}
+
+// loadMetricCases returns the metrics of qwerty.
+func loadMetricCases(tb testing.TB) []metricCase {
+	genkeyMain := loadTestSession(tb)
+	userData := genkeyMain.userData
+	g := NewGenkeyLayout(genkeyMain.conn, userData)
+	l := userData.Layouts["qwerty"]
+	precision := userData.Config.Weights.Score.Trigrams.Precision
+
+	return []metricCase{
+		{"speed", func() float64 {
+			return sum(legacyFingerSpeed(g, l))
+		}, func() float64 {
+			return sum(g.FingerSpeed(l, true))
+		}},
+		{"sfbs", func() float64 {
+			return legacySFBs(g, l)
+		}, func() float64 {
+			return g.SFBs(l, false)
+		}},
+		{"lsbs", func() float64 {
+			return float64(legacyLSBs(g, l))
+		}, func() float64 {
+			return float64(g.LSBs(l))
+		}},
+		{"trigrams", func() float64 {
+			return float64(legacyTrigrams(g, l, precision).Alternates)
+		}, func() float64 {
+			return float64(g.FastTrigrams(l, precision).Alternates)
+		}},
+	}
+}
+
+func TestDenseMetricsMatchLegacy(t *testing.T) {
+	for _, c := range loadMetricCases(t) {
+		legacy, dense := c.legacy(), c.dense()
+		if math.Abs(legacy-dense) > 1e-9*math.Max(1, math.Abs(legacy)) {
+			t.Errorf("%s: legacy %v, dense %v", c.metric, legacy, dense)
+		}
+	}
+}
+
+func BenchmarkMetrics(b *testing.B) {
+	for _, c := range loadMetricCases(b) {
+		b.Run(c.metric+"/legacy", func(b *testing.B) {
+			for i := 0; i < b.N; i++ {
+				c.legacy()
+			}
+		})
+		b.Run(c.metric+"/dense", func(b *testing.B) {
+			for i := 0; i < b.N; i++ {
+				c.dense()
+			}
+		})
+	}
+}
@@ -0,0 +1,253 @@
+package genkey
+
+import (
+	"fmt"
+	"math"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// BlendPart is one corpus of a blend and its share of every ngram count.
+type BlendPart struct {
+	Name   string
+	Weight float64 // shares of a blend add up to 1
+}
+
+// ParseBlend reads a corpus spec. A plain name is that corpus alone, and
+// "shai-iweb:70 tr:30" (or separated by commas) blends 70% shai-iweb with
+// 30% tr. Weights are normalized, so "a:7 b:3" and "a:0.7,b:0.3" are the
+// same blend.
+func ParseBlend(spec string) ([]BlendPart, error) {
+	fields := strings.FieldsFunc(spec, func(r rune) bool {
+		return r == ',' || r == ' ' || r == '\t'
+	})
+	if len(fields) == 0 {
+		return nil, fmt.Errorf("empty corpus")
+	}
+
+	var parts []BlendPart
+	var total float64
+	for _, field := range fields {
+		name, weight, hasWeight := strings.Cut(field, ":")
+		part := BlendPart{name, 1}
+		if hasWeight {
+			w, err := strconv.ParseFloat(strings.TrimSuffix(weight, "%"), 64)
+			if err != nil || w <= 0 || math.IsInf(w, 0) {
+				return nil, fmt.Errorf("invalid weight [%s] for corpus [%s]", weight, name)
+			}
+			part.Weight = w
+		} else if len(fields) > 1 {
+			return nil, fmt.Errorf("corpus [%s] needs a weight, like %s:50", name, name)
+		}
+		if name == "" {
+			return nil, fmt.Errorf("missing corpus name in [%s]", field)
+		}
+		for _, p := range parts {
+			if p.Name == name {
+				return nil, fmt.Errorf("corpus [%s] is blended twice", name)
+			}
+		}
+		parts = append(parts, part)
+		total += part.Weight
+	}
+	for i := range parts {
+		parts[i].Weight /= total
+	}
+	return parts, nil
+}
+
+// BlendName is the canonical spec of a blend, with weights in percent.
+func BlendName(parts []BlendPart) string {
+	if len(parts) == 1 {
+		return parts[0].Name
+	}
+	names := make([]string, len(parts))
+	for i, p := range parts {
+		names[i] = p.Name + ":" + strconv.FormatFloat(100*p.Weight, 'g', 6, 64)
+	}
+	return strings.Join(names, " ")
+}
+
+// BlendTextData mixes sources by weight. Each kind of ngram is normalized
+// separately, so a source with weight w makes up w of the letters, w of
+// the bigrams, w of the skipgrams and w of the trigrams of the blend,
+// however large it is. The blend keeps the combined size of its sources.
+func BlendTextData(sources []*TextData, parts []BlendPart) TextData {
+	blend := TextData{
+		Letters:   make(map[string]int),
+		Bigrams:   make(map[string]int),
+		Trigrams:  make(map[string]int),
+		Skipgrams: make(map[string]float64),
+	}
+
+	var letters, bigrams, trigrams, skipgrams []float64
+	for _, data := range sources {
+		letters = append(letters, sumCounts(data.Letters))
+		bigrams = append(bigrams, sumCounts(data.Bigrams))
+		trigrams = append(trigrams, sumCounts(data.Trigrams))
+		skipgrams = append(skipgrams, sumCounts(data.Skipgrams))
+	}
+
+	shift := false
+	for _, data := range sources {
+		shift = shift || len(data.ShiftLetters) > 0
+	}
+	if shift {
+		blend.ShiftLetters = make(map[string]int)
+		blend.ShiftBigrams = make(map[string]int)
+		blend.ShiftHeld = make(map[string]int)
+	}
+	mixedShiftLetters := make(map[string]float64)
+	mixedShiftBigrams := make(map[string]float64)
+	mixedShiftHeld := make(map[string]float64)
+
+	var total, totalBigrams float64
+	mixedLetters := make(map[string]float64)
+	mixedBigrams := make(map[string]float64)
+	mixedTrigrams := make(map[string]float64)
+	letterScale := blendScales(letters, parts)
+	bigramScale := blendScales(bigrams, parts)
+	trigramScale := blendScales(trigrams, parts)
+	skipgramScale := blendScales(skipgrams, parts)
+	for i, data := range sources {
+		addScaled(mixedLetters, data.Letters, letterScale[i])
+		addScaled(mixedBigrams, data.Bigrams, bigramScale[i])
+		addScaled(mixedTrigrams, data.Trigrams, trigramScale[i])
+		addScaled(blend.Skipgrams, data.Skipgrams, skipgramScale[i])
+		// Shift counts are shares of the letters and bigrams they shift
+		addScaled(mixedShiftLetters, data.ShiftLetters, letterScale[i])
+		addScaled(mixedShiftBigrams, data.ShiftBigrams, bigramScale[i])
+		addScaled(mixedShiftHeld, data.ShiftHeld, bigramScale[i])
+		total += float64(data.Total) * letterScale[i]
+		totalBigrams += float64(data.TotalBigrams) * bigramScale[i]
+	}
+	roundCounts(blend.Letters, mixedLetters)
+	roundCounts(blend.Bigrams, mixedBigrams)
+	roundCounts(blend.Trigrams, mixedTrigrams)
+	if shift {
+		roundCounts(blend.ShiftLetters, mixedShiftLetters)
+		roundCounts(blend.ShiftBigrams, mixedShiftBigrams)
+		roundCounts(blend.ShiftHeld, mixedShiftHeld)
+	}
+	blend.Ngrams = blendNgrams(sources, parts)
+	blend.Total = int(math.Round(total))
+	blend.TotalBigrams = int(math.Round(totalBigrams))
+
+	for k, v := range blend.Trigrams {
+		blend.TopTrigrams = append(blend.TopTrigrams, FreqPair{k, float64(v)})
+	}
+	// Break ties by ngram so that the same blend always has the same order
+	sort.Slice(blend.TopTrigrams, func(i, j int) bool {
+		a, b := blend.TopTrigrams[i], blend.TopTrigrams[j]
+		if a.Count != b.Count {
+			return a.Count > b.Count
+		}
+		return a.Ngram < b.Ngram
+	})
+	return blend
+}
+
+// blendNgrams mixes the ngrams longer than trigrams, normalizing each
+// length separately. Sources without ngrams of a length leave it to the
+// others.
+func blendNgrams(sources []*TextData, parts []BlendPart) map[int]map[string]int {
+	var blend map[int]map[string]int
+	for n := 4; n <= MaxNgramSize; n++ {
+		var sums []float64
+		var weights []BlendPart
+		var present []*TextData
+		for i, data := range sources {
+			if len(data.Ngrams[n]) > 0 {
+				sums = append(sums, sumCounts(data.Ngrams[n]))
+				weights = append(weights, parts[i])
+				present = append(present, data)
+			}
+		}
+		if len(present) == 0 {
+			continue
+		}
+		// Renormalize the weights of the sources that have this length
+		var weight float64
+		for _, p := range weights {
+			weight += p.Weight
+		}
+		for i := range weights {
+			weights[i].Weight /= weight
+		}
+		mixed := make(map[string]float64)
+		for i, scale := range blendScales(sums, weights) {
+			addScaled(mixed, present[i].Ngrams[n], scale)
+		}
+		if blend == nil {
+			blend = make(map[int]map[string]int)
+		}
+		blend[n] = make(map[string]int)
+		roundCounts(blend[n], mixed)
+	}
+	return blend
+}
+
+// blendScales returns the factor for each source that makes it weigh its
+// share of the combined sum.
+func blendScales(sums []float64, parts []BlendPart) []float64 {
+	var combined float64
+	for _, s := range sums {
+		combined += s
+	}
+	scales := make([]float64, len(sums))
+	for i, s := range sums {
+		if s > 0 {
+			scales[i] = parts[i].Weight * combined / s
+		}
+	}
+	return scales
+}
+
+func sumCounts[T int | float64](m map[string]T) float64 {
+	var sum float64
+	for _, v := range m {
+		sum += float64(v)
+	}
+	return sum
+}
+
+func addScaled[T int | float64](dst map[string]float64, src map[string]T, scale float64) {
+	for k, v := range src {
+		dst[k] += float64(v) * scale
+	}
+}
+
+// roundCounts stores mixed counts as whole counts, dropping those that
+// round to zero.
+func roundCounts(dst map[string]int, src map[string]float64) {
+	for k, v := range src {
+		if n := int(math.Round(v)); n != 0 {
+			dst[k] = n
+		}
+	}
+}
+
+// loadBlend mixes the corpora of a blend, or returns the cached mix.
+func (self *GenkeyMain) loadBlend(parts []BlendPart) (TextData, *Corpus) {
+	key := BlendName(parts)
+	stamps := make([]fileStamp, len(parts))
+	for i, p := range parts {
+		path, wordList := corpusSource(&self.userData.Config, p.Name)
+		stamps[i], _ = stampFile(path)
+		if wordList {
+			// Word lists are built with the config, blend them again
+			// when it changes
+			key = BlendName(parts) + "\n" + wordListKey(&self.userData.Config)
+		}
+	}
+	return blendedCache.get(key, stamps, func() (TextData, *Corpus) {
+		sources := make([]*TextData, len(parts))
+		for i, p := range parts {
+			data := self.readCorpus(p.Name)
+			sources[i] = &data
+		}
+		data := BlendTextData(sources, parts)
+		return data, CompileCorpus(&data)
+	})
+}
@@ -0,0 +1,117 @@
+package genkey
+
+import (
+	"sync"
+	"time"
+)
+
+// fileStamp identifies one version of a file on disk.
+type fileStamp struct {
+	modTime time.Time
+	size    int64
+}
+
+func stampFile(path string) (fileStamp, error) {
+	info, err := GenkeyStat(path)
+	if err != nil {
+		return fileStamp{}, err
+	}
+	return fileStamp{info.ModTime(), info.Size()}, nil
+}
+
+type cacheEntry[T any] struct {
+	stamp fileStamp
+	extra string
+	value T
+}
+
+// fileCache keeps one parsed value per path and reloads it when the file
+// changes. Values are shared by every session and must not be modified.
+type fileCache[T any] struct {
+	mu      sync.Mutex
+	entries map[string]cacheEntry[T]
+}
+
+// get returns the cached value for path, calling load if the file changed
+// since it was cached. extra is part of the key for values that also
+// depend on something other than the file, like layouts on the corpus.
+func (self *fileCache[T]) get(path string, extra string, load func() T) T {
+	stamp, err := stampFile(path)
+	if err != nil {
+		// Let load report the error
+		return load()
+	}
+
+	self.mu.Lock()
+	entry, ok := self.entries[path]
+	self.mu.Unlock()
+	if ok && entry.stamp == stamp && entry.extra == extra {
+		return entry.value
+	}
+
+	value := load()
+
+	self.mu.Lock()
+	defer self.mu.Unlock()
+	if self.entries == nil {
+		self.entries = make(map[string]cacheEntry[T])
+	}
+	self.entries[path] = cacheEntry[T]{stamp, extra, value}
+	return value
+}
+
+// blendEntry is a blend with the versions of the files it was mixed from.
+type blendEntry struct {
+	stamps []fileStamp
+	data   TextData
+	corpus *Corpus
+}
+
+// blendCache keeps mixed blends like fileCache keeps parsed files, and
+// mixes them again when one of their corpora changes.
+type blendCache struct {
+	mu      sync.Mutex
+	entries map[string]blendEntry
+}
+
+func (self *blendCache) get(name string, stamps []fileStamp, load func() (TextData, *Corpus)) (TextData, *Corpus) {
+	self.mu.Lock()
+	entry, ok := self.entries[name]
+	self.mu.Unlock()
+	if ok && sameStamps(entry.stamps, stamps) {
+		return entry.data, entry.corpus
+	}
+
+	data, corpus := load()
+
+	self.mu.Lock()
+	defer self.mu.Unlock()
+	if self.entries == nil {
+		self.entries = make(map[string]blendEntry)
+	}
+	self.entries[name] = blendEntry{stamps, data, corpus}
+	return data, corpus
+}
+
+func sameStamps(a, b []fileStamp) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	for i := range a {
+		if a[i] != b[i] {
+			return false
+		}
+	}
+	return true
+}
+
+// The process wide caches shared by every UserData.
+var (
+	configCache   fileCache[UserConfig]
+	dataCache     fileCache[TextData]
+	corpusCache   fileCache[*Corpus]
+	blendedCache  blendCache
+	hashCache     fileCache[string]
+	layoutCache   fileCache[layoutFile]
+	keyboardCache fileCache[*Keyboard]
+)
@@ -0,0 +1,40 @@
+package genkey
+
+import (
+	"unicode"
+	"unicode/utf8"
+
+	"golang.org/x/text/unicode/norm"
+)
+
+// normalize puts text in NFC, so that a character written as a letter and
+// combining marks matches the same character written precomposed. Corpora,
+// layouts and commands are all normalized before they are compared.
+func normalize(s string) string {
+	return norm.NFC.String(s)
+}
+
+// splitChars splits s into characters: runes together with the combining
+// marks that follow them. After normalize that is one rune for almost every
+// letter, like ü, ş, é or ñ.
+func splitChars(s string) []string {
+	var chars []string
+	for len(s) > 0 {
+		_, n := utf8.DecodeRuneInString(s)
+		for n < len(s) {
+			r, size := utf8.DecodeRuneInString(s[n:])
+			if !unicode.Is(unicode.Mn, r) {
+				break
+			}
+			n += size
+		}
+		chars = append(chars, s[:n])
+		s = s[n:]
+	}
+	return chars
+}
+
+// charWidth is the number of characters in s, for aligning output.
+func charWidth(s string) int {
+	return len(splitChars(s))
+}
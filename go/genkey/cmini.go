@@ -0,0 +1,229 @@
+package genkey
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"sort"
+	"strings"
+	"unicode/utf8"
+)
+
+// cminiFreeKey is how cmini marks a position without a character. Free
+// positions of cmini layouts, and gaps between their keys, become this key.
+const cminiFreeKey = "~"
+
+// CminiLayout is a layout in the JSON format of the cmini app.
+type CminiLayout struct {
+	Name  string     `json:"name"`
+	User  int64      `json:"user"`  // id of the author, 0 for none
+	Board string     `json:"board"` // ortho, stagger, angle or mini
+	Keys  CminiKeys  `json:"keys"`
+	Free  []CminiKey `json:"free"`
+}
+
+// CminiKey is the position of a key and the finger pressing it. Char is
+// the name of the key in the keys object, and empty for free positions.
+type CminiKey struct {
+	Char   string `json:"-"`
+	Row    int    `json:"row"`
+	Col    int    `json:"col"`
+	Finger string `json:"finger"`
+}
+
+// CminiKeys are the keys of a cmini layout by row and column. In JSON they
+// are an object keyed by character.
+type CminiKeys []CminiKey
+
+func (self CminiKeys) MarshalJSON() ([]byte, error) {
+	var b bytes.Buffer
+	b.WriteByte('{')
+	for i, k := range self {
+		if i > 0 {
+			b.WriteByte(',')
+		}
+		char, err := json.Marshal(k.Char)
+		if err != nil {
+			return nil, err
+		}
+		pos, err := json.Marshal(k)
+		if err != nil {
+			return nil, err
+		}
+		b.Write(char)
+		b.WriteByte(':')
+		b.Write(pos)
+	}
+	b.WriteByte('}')
+	return b.Bytes(), nil
+}
+
+func (self *CminiKeys) UnmarshalJSON(b []byte) error {
+	var keys map[string]CminiKey
+	if err := json.Unmarshal(b, &keys); err != nil {
+		return err
+	}
+	*self = make(CminiKeys, 0, len(keys))
+	for char, k := range keys {
+		k.Char = char
+		*self = append(*self, k)
+	}
+	sort.Slice(*self, func(i, j int) bool {
+		a, b := (*self)[i], (*self)[j]
+		if a.Row != b.Row {
+			return a.Row < b.Row
+		}
+		return a.Col < b.Col
+	})
+	return nil
+}
+
+// cminiFinger reads a finger name of cmini. TB, a thumb key either thumb
+// can press, is the right thumb like in the analysis of cmini.
+func cminiFinger(name string) (Finger, error) {
+	if name == "TB" {
+		return RT, nil
+	}
+	for i, n := range FingerNames {
+		if name == n {
+			return Finger(i), nil
+		}
+	}
+	return 0, fmt.Errorf("[%s] is not a finger, expected one of %s TB", name, strings.Join(FingerNames[:], " "))
+}
+
+// cminiBoards are the cmini boards closest to the keyboard profiles.
+var cminiBoards = map[string]string{
+	"matrix":    "ortho",
+	"split":     "ortho",
+	"ansi":      "stagger",
+	"iso":       "stagger",
+	"angle-mod": "angle",
+}
+
+// ReadCminiLayout returns the keys of c and the fingers pressing them, by
+// row and column. Free positions and gaps are cminiFreeKey, gaps pressed
+// by the finger of the nearest key of their row.
+func ReadCminiLayout(c *CminiLayout) ([][]string, [][]Finger, error) {
+	var keys [][]string
+	var fingermatrix [][]Finger
+	place := func(k CminiKey, key string) error {
+		if k.Row < 0 || k.Col < 0 {
+			return fmt.Errorf("[%s] is at row %d column %d", key, k.Row, k.Col)
+		}
+		f, err := cminiFinger(k.Finger)
+		if err != nil {
+			return err
+		}
+		for len(keys) <= k.Row {
+			keys = append(keys, nil)
+			fingermatrix = append(fingermatrix, nil)
+		}
+		for len(keys[k.Row]) <= k.Col {
+			keys[k.Row] = append(keys[k.Row], "")
+			fingermatrix[k.Row] = append(fingermatrix[k.Row], 0)
+		}
+		if keys[k.Row][k.Col] != "" {
+			return fmt.Errorf("[%s] and [%s] are both at row %d column %d", keys[k.Row][k.Col], key, k.Row, k.Col)
+		}
+		keys[k.Row][k.Col] = key
+		fingermatrix[k.Row][k.Col] = f
+		return nil
+	}
+
+	for _, k := range c.Keys {
+		if utf8.RuneCountInString(k.Char) != 1 {
+			return nil, nil, fmt.Errorf("key [%s] is not one character", k.Char)
+		}
+		if err := place(k, strings.ToLower(normalize(k.Char))); err != nil {
+			return nil, nil, err
+		}
+	}
+	for _, k := range c.Free {
+		if err := place(k, cminiFreeKey); err != nil {
+			return nil, nil, err
+		}
+	}
+	if len(keys) == 0 {
+		return nil, nil, fmt.Errorf("it has no keys")
+	}
+
+	for y, row := range keys {
+		if len(row) == 0 {
+			return nil, nil, fmt.Errorf("row %d has no keys", y)
+		}
+		// Found before filling any, so that gaps only take real fingers
+		gaps := make(map[int]Finger)
+		for x, key := range row {
+			if key != "" {
+				continue
+			}
+			for d := 1; ; d++ {
+				if x-d >= 0 && row[x-d] != "" {
+					gaps[x] = fingermatrix[y][x-d]
+					break
+				}
+				if x+d < len(row) && row[x+d] != "" {
+					gaps[x] = fingermatrix[y][x+d]
+					break
+				}
+			}
+		}
+		for x, f := range gaps {
+			row[x] = cminiFreeKey
+			fingermatrix[y][x] = f
+		}
+	}
+	return keys, fingermatrix, nil
+}
+
+// ParseCminiLayout reads a layout in the JSON format of cmini like
+// ReadLayout. f only names the source in error messages.
+func (self *GenkeyLayout) ParseCminiLayout(f string, b []byte) (*Layout, LayoutErrors) {
+	var c CminiLayout
+	if err := json.Unmarshal(b, &c); err != nil {
+		line, column := jsonErrorAt(b, err)
+		return nil, LayoutErrors{{f, line, column, fmt.Sprintf("not a valid cmini layout, %v", err), false}}
+	}
+	keys, fingermatrix, err := ReadCminiLayout(&c)
+	if err != nil {
+		return nil, LayoutErrors{{f, 0, 0, fmt.Sprintf("not a valid cmini layout, %v", err), false}}
+	}
+	name := normalize(strings.TrimSpace(c.Name))
+	if name == "" {
+		return nil, LayoutErrors{{f, 0, 0, "the cmini layout has no name", false}}
+	}
+	return NewLayout(name, keys, NewGeometry(fingermatrix), self.LayoutTotal(keys)), self.checkKeys(f, keys, nil)
+}
+
+// ExportCmini converts l to the JSON format of cmini, on the board closest
+// to the session keyboard. cminiFreeKey keys become free positions and
+// keys that no finger presses are left out.
+func (self *GenkeyLayout) ExportCmini(l *Layout) (CminiLayout, error) {
+	board, ok := cminiBoards[self.userData.Keyboard.id]
+	if !ok {
+		board = "ortho"
+	}
+	c := CminiLayout{Name: l.Name, Board: board, Keys: CminiKeys{}, Free: []CminiKey{}}
+	seen := make(map[string]bool)
+	for y, row := range l.Keys {
+		for x, key := range row {
+			f, ok := l.Finger(Pos{x, y})
+			if !ok {
+				continue
+			}
+			k := CminiKey{Char: key, Row: y, Col: x, Finger: FingerNames[f]}
+			if key == cminiFreeKey {
+				k.Char = ""
+				c.Free = append(c.Free, k)
+				continue
+			}
+			if seen[key] {
+				return c, fmt.Errorf("[%s] is on the layout twice, cmini has one position per character", keyLabel(key))
+			}
+			seen[key] = true
+			c.Keys = append(c.Keys, k)
+		}
+	}
+	return c, nil
+}
@@ -0,0 +1,137 @@
+package genkey
+
+import (
+	"encoding/json"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+// apt26 is the cmini layout of python/apps/cmini/layouts/apt26.json
+// without its stats, with a thumb key (TB) and free positions.
+const apt26 = `{"name": "apt26", "user": 169285177481101312, "board": "ortho", "keys": {
+"w": {"row": 0, "col": 0, "finger": "LP"}, "f": {"row": 0, "col": 1, "finger": "LR"},
+"g": {"row": 0, "col": 2, "finger": "LM"}, "d": {"row": 0, "col": 3, "finger": "LI"},
+"b": {"row": 0, "col": 4, "finger": "LI"}, "j": {"row": 0, "col": 5, "finger": "RI"},
+"l": {"row": 0, "col": 6, "finger": "RI"}, "u": {"row": 0, "col": 7, "finger": "RM"},
+"o": {"row": 0, "col": 8, "finger": "RR"}, "y": {"row": 0, "col": 9, "finger": "RP"},
+"r": {"row": 1, "col": 0, "finger": "LP"}, "s": {"row": 1, "col": 1, "finger": "LR"},
+"t": {"row": 1, "col": 2, "finger": "LM"}, "h": {"row": 1, "col": 3, "finger": "LI"},
+"k": {"row": 1, "col": 4, "finger": "LI"}, "x": {"row": 1, "col": 5, "finger": "RI"},
+"n": {"row": 1, "col": 6, "finger": "RI"}, "e": {"row": 1, "col": 7, "finger": "RM"},
+"a": {"row": 1, "col": 8, "finger": "RR"}, "i": {"row": 1, "col": 9, "finger": "RP"},
+"c": {"row": 2, "col": 1, "finger": "LR"}, "m": {"row": 2, "col": 2, "finger": "LM"},
+"p": {"row": 2, "col": 3, "finger": "LI"}, "v": {"row": 2, "col": 6, "finger": "RI"},
+",": {"row": 2, "col": 7, "finger": "RM"}, ".": {"row": 2, "col": 8, "finger": "RR"},
+"'": {"row": 3, "col": 0, "finger": "TB"}},
+"free": [{"row": 2, "col": 0, "finger": "LP"}, {"row": 2, "col": 4, "finger": "LI"},
+{"row": 2, "col": 5, "finger": "RI"}, {"row": 2, "col": 9, "finger": "RP"}]}`
+
+func TestCminiRoundTrip(t *testing.T) {
+	userData := &UserData{Data: testCorpus(), Keyboard: &Keyboard{id: "matrix"}}
+	g := NewGenkeyLayout(&textCapture{}, userData)
+
+	l, errs := g.ParseCminiLayout("apt26.json", []byte(apt26))
+	if errs.Fatal() || len(errs) > 0 {
+		t.Fatalf("apt26: %v", errs)
+	}
+	wantKeys := [][]string{
+		{"w", "f", "g", "d", "b", "j", "l", "u", "o", "y"},
+		{"r", "s", "t", "h", "k", "x", "n", "e", "a", "i"},
+		{"~", "c", "m", "p", "~", "~", "v", ",", ".", "~"},
+		{"'"},
+	}
+	hand := []Finger{0, 1, 2, 3, 3, 4, 4, 5, 6, 7}
+	// The thumb key either thumb presses is the right thumb
+	wantFingers := [][]Finger{hand, hand, hand, {RT}}
+	if l.Name != "apt26" || !reflect.DeepEqual(l.Keys, wantKeys) || !reflect.DeepEqual(l.Fingermatrix, wantFingers) {
+		t.Errorf("apt26 read as %s %v %v", l.Name, l.Keys, l.Fingermatrix)
+	}
+
+	c, err := g.ExportCmini(l)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if c.Name != "apt26" || c.Board != "ortho" || c.User != 0 {
+		t.Errorf("exported as %s on %s by %d", c.Name, c.Board, c.User)
+	}
+	var orig CminiLayout
+	if err := json.Unmarshal([]byte(apt26), &orig); err != nil {
+		t.Fatal(err)
+	}
+	for i := range orig.Keys {
+		if orig.Keys[i].Finger == "TB" {
+			orig.Keys[i].Finger = "RT"
+		}
+	}
+	if !reflect.DeepEqual(c.Keys, orig.Keys) || !reflect.DeepEqual(c.Free, orig.Free) {
+		t.Errorf("exported keys %v free %v, want %v %v", c.Keys, c.Free, orig.Keys, orig.Free)
+	}
+
+	// And back again through JSON
+	b, err := json.Marshal(c)
+	if err != nil {
+		t.Fatal(err)
+	}
+	again, errs := g.ParseCminiLayout("apt26.json", b)
+	if errs.Fatal() {
+		t.Fatalf("exported apt26: %v", errs)
+	}
+	if !reflect.DeepEqual(again.Keys, l.Keys) || !reflect.DeepEqual(again.Fingermatrix, l.Fingermatrix) {
+		t.Errorf("exported apt26 read as %v %v", again.Keys, again.Fingermatrix)
+	}
+}
+
+func TestReadCminiLayoutGaps(t *testing.T) {
+	// apt26 with only its last free position, the other gaps take the
+	// finger of the nearest key, the one to the left when both are as near
+	var c CminiLayout
+	if err := json.Unmarshal([]byte(apt26), &c); err != nil {
+		t.Fatal(err)
+	}
+	c.Free = c.Free[3:]
+	keys, fingers, err := ReadCminiLayout(&c)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := []string{"~", "c", "m", "p", "~", "~", "v", ",", ".", "~"}; !reflect.DeepEqual(keys[2], want) {
+		t.Errorf("row 2 is %v, want %v", keys[2], want)
+	}
+	if want := []Finger{1, 1, 2, 3, 3, 4, 4, 5, 6, 7}; !reflect.DeepEqual(fingers[2], want) {
+		t.Errorf("row 2 fingers are %v, want %v", fingers[2], want)
+	}
+}
+
+func TestBadCminiLayouts(t *testing.T) {
+	tests := []struct {
+		name string
+		json string
+		want string
+	}{
+		{"duplicate position", `{"name": "x", "keys": {"a": {"row": 0, "col": 0, "finger": "LP"},
+			"b": {"row": 0, "col": 0, "finger": "LP"}}}`, "are both at row 0 column 0"},
+		{"free on a key", `{"name": "x", "keys": {"a": {"row": 0, "col": 1, "finger": "LP"}},
+			"free": [{"row": 0, "col": 1, "finger": "LR"}]}`, "[a] and [~] are both at row 0 column 1"},
+		{"unknown finger", `{"name": "x", "keys": {"a": {"row": 0, "col": 0, "finger": "LX"}}}`, "[LX] is not a finger"},
+		{"negative position", `{"name": "x", "keys": {"a": {"row": -1, "col": 0, "finger": "LP"}}}`, "is at row -1"},
+		{"empty row", `{"name": "x", "keys": {"a": {"row": 1, "col": 0, "finger": "LP"}}}`, "row 0 has no keys"},
+		{"no keys", `{"name": "x", "keys": {}}`, "it has no keys"},
+		{"no name", `{"name": " ", "keys": {"a": {"row": 0, "col": 0, "finger": "LP"}}}`, "has no name"},
+	}
+	g := NewGenkeyLayout(&textCapture{}, &UserData{})
+	for _, tt := range tests {
+		_, errs := g.ParseCminiLayout(tt.name, []byte(tt.json))
+		if !errs.Fatal() || !strings.Contains(errs.Error(), tt.want) {
+			t.Errorf("%s: got %v, want an error containing %q", tt.name, errs, tt.want)
+		}
+	}
+}
+
+func TestExportCminiDuplicateKey(t *testing.T) {
+	userData := &UserData{Keyboard: &Keyboard{id: "ansi"}}
+	g := NewGenkeyLayout(&textCapture{}, userData)
+	l := NewLayout("twice", [][]string{{"a", "b", "a"}}, NewGeometry([][]Finger{{0, 1, 2}}), 0)
+	if _, err := g.ExportCmini(l); err == nil || !strings.Contains(err.Error(), "[a] is on the layout twice") {
+		t.Errorf("got error %v, want one for [a] on the layout twice", err)
+	}
+}
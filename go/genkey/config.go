@@ -2,32 +2,37 @@ package genkey
 
 import (
 	"fmt"
-	"os"
-	"path/filepath"
 
 	"github.com/BurntSushi/toml"
 )
 
-func fileExists(path string) bool {
-	if _, err := os.Stat(path); err == nil {
-		return true
-	}
-	return false
-}
-
 func ReadWeights(config *UserConfig) {
-	b, err := GenkeyReadFile("config.toml")
-	if err != nil {
-		panic(fmt.Sprintf("There was an issue reading the config file.\n%v", err))
+	*config = configCache.get("config.toml", "", func() UserConfig {
+		var config UserConfig
+		b, err := GenkeyReadFile("config.toml")
+		if err != nil {
+			panic(fmt.Sprintf("There was an issue reading the config file.\n%v", err))
+		}
+
+		_, err = toml.Decode(string(b), &config)
+		if err != nil {
+			panic("Toml decoding error")
+		}
+		return config
+	})
+
+	switch config.Weights.Shift.Side {
+	case "opposite", "left", "right":
+	default:
+		panic(fmt.Sprintf("Invalid config: Weights.Shift.Side [%s] must be opposite, left or right.", config.Weights.Shift.Side))
 	}
 
-	_, err = toml.Decode(string(b), config)
-	if err != nil {
-		panic("Toml decoding error")
+	if n := config.CorpusProcessing.MaxNgramSize; n > MaxNgramSize {
+		panic(fmt.Sprintf("Invalid config: CorpusProcessing.MaxNgramSize cannot be greater than %d.", MaxNgramSize))
 	}
 
-	if !fileExists(filepath.Join("./genkey", config.Paths.Corpora, config.Corpus) + ".json") {
-		panic(fmt.Sprintf("Invalid config: Corpus [%s] does not exist.\n", config.Corpus))
+	if config.WordLists.SpanWords && !config.WordLists.Spaces {
+		panic("Invalid config: WordLists.SpanWords needs WordLists.Spaces.")
 	}
 
 	if config.Generation.Selection > config.Generation.InitialPopulation {
@@ -0,0 +1,193 @@
+package genkey
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"slices"
+	"sort"
+	"strings"
+)
+
+// charsetSummary is how many characters of a corpus the catalog shows.
+const charsetSummary = 40
+
+type CorpusInfo struct {
+	Name    string `json:"name"`
+	Size    int64  `json:"size,omitempty"` // bytes on disk, 0 for uploads
+	Total   int    `json:"total"`          // characters
+	Letters int    `json:"letters"`        // distinct characters
+	Charset string `json:"charset"`        // most frequent characters first
+	Active  bool   `json:"active"`
+	Upload  bool   `json:"upload,omitempty"`
+	Blend   bool   `json:"blend,omitempty"`
+	Words   bool   `json:"words,omitempty"` // built from a word list
+}
+
+// CorpusNames lists the corpora in the corpora directory, binary or json,
+// and the word lists that no corpus shadows.
+func (self *UserData) CorpusNames() []string {
+	entries, err := os.ReadDir(filepath.Join(importerToGenkey, self.Config.Paths.Corpora))
+	if err != nil {
+		panic(err)
+	}
+	var names []string
+	for _, e := range entries {
+		name, ok := strings.CutSuffix(e.Name(), ".json")
+		if !ok {
+			name, ok = strings.CutSuffix(e.Name(), BinaryCorpusExt)
+		}
+		if ok && !e.IsDir() && !slices.Contains(names, name) {
+			names = append(names, name)
+		}
+	}
+	for _, name := range self.WordListNames() {
+		if !slices.Contains(names, name) {
+			names = append(names, name)
+		}
+	}
+	sort.Strings(names)
+	return names
+}
+
+// HasCorpus reports whether name is one of CorpusNames. Only those can be
+// selected, so a client never names a path.
+func (self *UserData) HasCorpus(name string) bool {
+	for _, n := range self.CorpusNames() {
+		if n == name {
+			return true
+		}
+	}
+	return false
+}
+
+// SelectCorpus switches the session to a corpus, or a blend of corpora,
+// from the corpora directory. See ParseBlend for the spec.
+func (self *UserData) SelectCorpus(spec string) error {
+	parts, err := ParseBlend(spec)
+	if err != nil {
+		return err
+	}
+	for _, p := range parts {
+		if !self.HasCorpus(p.Name) {
+			return fmt.Errorf("corpus [%s] was not found", p.Name)
+		}
+	}
+	self.SelectedCorpus = BlendName(parts)
+	self.SessionCorpus = nil
+	return nil
+}
+
+// corpus handles the corpus command:
+//
+//	corpus                 lists the available corpora
+//	corpus name            switches this session to another corpus
+//	corpus name:70 tr:30   switches this session to a blend
+func (self *GenkeyMain) corpus(args []string) {
+	if len(args) < 2 {
+		self.listCorpora()
+		return
+	}
+
+	userData := self.userData
+	if err := userData.SelectCorpus(strings.Join(args[1:], " ")); err != nil {
+		self.SendMessage(err.Error() + "\n")
+		return
+	}
+	self.loadData()
+	name := userData.CorpusName()
+	self.SendMessage(fmt.Sprintf("using [%s] for this session\n", name))
+	info := self.corpusInfo(name, &userData.Data, true)
+	info.Blend = strings.Contains(name, ":")
+	self.result = info
+}
+
+func (self *GenkeyMain) listCorpora() {
+	userData := self.userData
+	var active []BlendPart
+	if userData.SessionCorpus == nil {
+		active = userData.corpusParts()
+	}
+
+	var infos []CorpusInfo
+	for _, name := range userData.CorpusNames() {
+		data := self.readCorpus(name)
+		infos = append(infos, self.corpusInfo(name, &data, len(active) == 1 && active[0].Name == name))
+	}
+	if len(active) > 1 {
+		data, _ := self.loadBlend(active)
+		info := self.corpusInfo(BlendName(active), &data, true)
+		info.Blend = true
+		infos = append(infos, info)
+	}
+	if session := userData.SessionCorpus; session != nil {
+		info := self.corpusInfo(session.Name, &session.Data, true)
+		info.Size, info.Upload = 0, true
+		infos = append(infos, info)
+	}
+
+	width := 0
+	for _, info := range infos {
+		width = max(width, len(info.Name))
+	}
+	for _, info := range infos {
+		mark := " "
+		if info.Active {
+			mark = "*"
+		}
+		size := formatBytes(info.Size)
+		if info.Upload {
+			size = "upload"
+		} else if info.Blend {
+			size = "blend"
+		} else if info.Words {
+			size = "words"
+		}
+		self.SendMessage(fmt.Sprintf("%s %-*s %8s %10d chars %4d distinct  %s\n",
+			mark, width, info.Name, size, info.Total, info.Letters, info.Charset))
+	}
+	self.result = infos
+}
+
+func (self *GenkeyMain) corpusInfo(name string, data *TextData, active bool) CorpusInfo {
+	info := CorpusInfo{
+		Name:    name,
+		Total:   data.Total,
+		Letters: len(data.Letters),
+		Active:  active,
+	}
+	path, wordList := corpusSource(&self.userData.Config, name)
+	if stat, err := GenkeyStat(path); err == nil {
+		info.Size = stat.Size()
+		info.Words = wordList
+	}
+
+	chars := make([]string, 0, len(data.Letters))
+	for ch := range data.Letters {
+		if strings.TrimSpace(ch) != "" {
+			chars = append(chars, ch)
+		}
+	}
+	sort.Slice(chars, func(i, j int) bool {
+		a, b := data.Letters[chars[i]], data.Letters[chars[j]]
+		if a != b {
+			return a > b
+		}
+		return chars[i] < chars[j]
+	})
+	info.Charset = strings.Join(chars[:min(len(chars), charsetSummary)], "")
+	if len(chars) > charsetSummary {
+		info.Charset += "…"
+	}
+	return info
+}
+
+func formatBytes(n int64) string {
+	switch {
+	case n >= 1<<20:
+		return fmt.Sprintf("%.1f MB", float64(n)/(1<<20))
+	case n >= 1<<10:
+		return fmt.Sprintf("%.0f KB", float64(n)/(1<<10))
+	}
+	return fmt.Sprintf("%d B", n)
+}
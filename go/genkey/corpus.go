@@ -0,0 +1,202 @@
+package genkey
+
+import (
+	"sort"
+)
+
+// Corpus is TextData compiled for the analyzer. Every character of the
+// corpus gets a small integer id and ngram counts are stored in flat
+// arrays indexed by those ids, so metrics never build ngram strings.
+type Corpus struct {
+	Chars []string       // characters by id
+	ids   map[string]int // ids by character
+
+	Letters      []int     // by id
+	Bigrams      []int     // by first*Size+second
+	Skipgrams    []float64 // by first*Size+second
+	Trigrams     []Trigram // most frequent first, in TopTrigrams order
+	TotalBigrams int
+	Total        int
+
+	// Shift state, only for corpora processed with RecordShift
+	ShiftLetters []int // by id
+	ShiftBigrams []int // by first*Size+second, only the second shifted
+	ShiftHeld    []int // by first*Size+second, both shifted
+	HasShift     bool
+
+	// Size is len(Chars)+1, the last id being a character the corpus never
+	// contains. Its counts are all zero.
+	Size int
+}
+
+type Trigram struct {
+	Chars [3]int
+	Count int
+}
+
+// CompileCorpus builds the dense form of data.
+func CompileCorpus(data *TextData) *Corpus {
+	c := &Corpus{ids: make(map[string]int)}
+
+	// Assign ids in a stable order so that compiling the same data twice
+	// gives the same corpus
+	seen := make(map[string]bool)
+	add := func(ngram string) {
+		for _, r := range ngram {
+			seen[string(r)] = true
+		}
+	}
+	for k := range data.Letters {
+		add(k)
+	}
+	for k := range data.Bigrams {
+		add(k)
+	}
+	for k := range data.Skipgrams {
+		add(k)
+	}
+	for _, tg := range data.TopTrigrams {
+		add(tg.Ngram)
+	}
+	for k := range data.ShiftLetters {
+		add(k)
+	}
+	for ch := range seen {
+		c.Chars = append(c.Chars, ch)
+	}
+	sort.Strings(c.Chars)
+	for i, ch := range c.Chars {
+		c.ids[ch] = i
+	}
+
+	c.Size = len(c.Chars) + 1
+	c.Letters = make([]int, c.Size)
+	c.Bigrams = make([]int, c.Size*c.Size)
+	c.Skipgrams = make([]float64, c.Size*c.Size)
+	c.TotalBigrams = data.TotalBigrams
+	c.Total = data.Total
+
+	for k, v := range data.Letters {
+		if id, ok := c.single(k); ok {
+			c.Letters[id] = v
+		}
+	}
+	for k, v := range data.Bigrams {
+		if a, b, ok := c.pair(k); ok {
+			c.Bigrams[a*c.Size+b] = v
+		}
+	}
+	for k, v := range data.Skipgrams {
+		if a, b, ok := c.pair(k); ok {
+			c.Skipgrams[a*c.Size+b] = v
+		}
+	}
+	if len(data.ShiftLetters) > 0 {
+		c.HasShift = true
+		c.ShiftLetters = make([]int, c.Size)
+		c.ShiftBigrams = make([]int, c.Size*c.Size)
+		c.ShiftHeld = make([]int, c.Size*c.Size)
+		for k, v := range data.ShiftLetters {
+			if id, ok := c.single(k); ok {
+				c.ShiftLetters[id] = v
+			}
+		}
+		for k, v := range data.ShiftBigrams {
+			if a, b, ok := c.pair(k); ok {
+				c.ShiftBigrams[a*c.Size+b] = v
+			}
+		}
+		for k, v := range data.ShiftHeld {
+			if a, b, ok := c.pair(k); ok {
+				c.ShiftHeld[a*c.Size+b] = v
+			}
+		}
+	}
+
+	empty := c.Size - 1
+	for _, tg := range data.TopTrigrams {
+		// Trigrams that are not three characters are kept with empty ids
+		// so that precision still counts them, but never match a key.
+		chars := [3]int{empty, empty, empty}
+		if runes := []rune(tg.Ngram); len(runes) == 3 {
+			chars = [3]int{c.ID(string(runes[0])), c.ID(string(runes[1])), c.ID(string(runes[2]))}
+		}
+		c.Trigrams = append(c.Trigrams, Trigram{chars, int(tg.Count)})
+	}
+
+	return c
+}
+
+// ID returns the id of a character, or the empty id if the corpus does not
+// contain it.
+func (self *Corpus) ID(ch string) int {
+	if id, ok := self.ids[ch]; ok {
+		return id
+	}
+	return self.Size - 1
+}
+
+func (self *Corpus) single(s string) (int, bool) {
+	id, ok := self.ids[s]
+	return id, ok
+}
+
+func (self *Corpus) pair(s string) (int, int, bool) {
+	runes := []rune(s)
+	if len(runes) != 2 {
+		return 0, 0, false
+	}
+	a, ok1 := self.ids[string(runes[0])]
+	b, ok2 := self.ids[string(runes[1])]
+	return a, b, ok1 && ok2
+}
+
+func (self *Corpus) Bigram(a, b int) int {
+	return self.Bigrams[a*self.Size+b]
+}
+
+func (self *Corpus) Skipgram(a, b int) float64 {
+	return self.Skipgrams[a*self.Size+b]
+}
+
+// KeyIDs returns the corpus id of every key of l, shaped like l.Keys.
+func (self *Corpus) KeyIDs(l *Layout) [][]int {
+	ids := make([][]int, len(l.Keys))
+	for row, keys := range l.Keys {
+		ids[row] = make([]int, len(keys))
+		for col, k := range keys {
+			ids[row][col] = self.ID(k)
+		}
+	}
+	return ids
+}
+
+// FingerIDs returns the corpus ids of the keys pressed by each finger, in
+// the order of l.Fingermap.
+func (self *Corpus) FingerIDs(l *Layout) [][]int {
+	ids := make([][]int, len(l.Fingermap))
+	for f, posits := range l.Fingermap {
+		ids[f] = make([]int, len(posits))
+		for i, p := range posits {
+			ids[f][i] = self.ID(l.Keys[p.Row][p.Col])
+		}
+	}
+	return ids
+}
+
+// KeyFingers returns the finger pressing each character id, or -1 for
+// characters that are not on l. Keys without a finger count as finger 0.
+func (self *Corpus) KeyFingers(l *Layout) []Finger {
+	fingers := make([]Finger, self.Size)
+	for i := range fingers {
+		fingers[i] = -1
+	}
+	for row, keys := range l.Keys {
+		for col, k := range keys {
+			if id, ok := self.ids[k]; ok {
+				fingers[id], _ = l.Finger(Pos{col, row})
+			}
+		}
+	}
+	return fingers
+}
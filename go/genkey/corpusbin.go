@@ -0,0 +1,352 @@
+package genkey
+
+import (
+	"bytes"
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"hash/crc32"
+	"math"
+	"os"
+	"path/filepath"
+	"sort"
+)
+
+// A binary corpus is a fixed header, a JSON metadata block and the body,
+// all little endian:
+//
+//	magic     8 bytes  "GKCORPUS"
+//	version   uint16
+//	flags     uint16   0, reserved
+//	metaLen   uint32
+//	bodyLen   uint64
+//	checksum  uint32   CRC-32C of metadata and body
+//	metadata  metaLen bytes of CorpusMeta as JSON
+//	body      bodyLen bytes of sections
+//
+// Every section is a kind byte, an ngram length byte (0 but for
+// sectionNgrams), an entry count and the entries. An entry is a key, as a
+// length and its bytes, and a value, a zigzag varint for counts or the 8
+// bytes of a float64. Keys are sorted, except in sectionTopTrigrams which
+// keeps the order of TopTrigrams.
+const (
+	corpusMagic      = "GKCORPUS"
+	corpusVersion    = 1
+	corpusHeaderSize = 28
+
+	// BinaryCorpusExt is the extension of binary corpora, which are
+	// preferred over the json corpus of the same name unless it is newer.
+	BinaryCorpusExt = ".corpus"
+)
+
+const (
+	sectionTotals byte = iota + 1
+	sectionLetters
+	sectionBigrams
+	sectionTrigrams
+	sectionTopTrigrams
+	sectionSkipgrams
+	sectionNgrams
+	sectionShiftLetters
+	sectionShiftBigrams
+	sectionShiftHeld
+)
+
+var castagnoli = crc32.MakeTable(crc32.Castagnoli)
+
+// CorpusMeta describes a binary corpus and can be read without decoding
+// the body.
+type CorpusMeta struct {
+	Name    string `json:"name"`
+	Source  string `json:"source,omitempty"` // the file it was converted from
+	Total   int    `json:"total"`
+	Letters int    `json:"letters"`         // distinct characters
+	Shift   bool   `json:"shift,omitempty"` // recorded with RecordShift
+	Ngrams  int    `json:"ngrams,omitempty"`
+}
+
+// isBinaryCorpus reports whether b starts like a binary corpus.
+func isBinaryCorpus(b []byte) bool {
+	return bytes.HasPrefix(b, []byte(corpusMagic))
+}
+
+// EncodeCorpus writes data as a binary corpus. The same data always
+// encodes to the same bytes.
+func EncodeCorpus(data *TextData, meta CorpusMeta) ([]byte, error) {
+	meta.Total = data.Total
+	meta.Letters = len(data.Letters)
+	meta.Shift = data.ShiftLetters != nil
+	meta.Ngrams = 0
+	for n := range data.Ngrams {
+		meta.Ngrams = max(meta.Ngrams, n)
+	}
+	metaJSON, err := json.Marshal(meta)
+	if err != nil {
+		return nil, err
+	}
+
+	var body []byte
+	body = append(body, sectionTotals, 0)
+	body = binary.AppendUvarint(body, 2)
+	body = binary.AppendVarint(body, int64(data.Total))
+	body = binary.AppendVarint(body, int64(data.TotalBigrams))
+
+	body = appendCounts(body, sectionLetters, 0, data.Letters)
+	body = appendCounts(body, sectionBigrams, 0, data.Bigrams)
+	body = appendCounts(body, sectionTrigrams, 0, data.Trigrams)
+	if data.TopTrigrams != nil {
+		body = append(body, sectionTopTrigrams, 0)
+		body = binary.AppendUvarint(body, uint64(len(data.TopTrigrams)))
+		for _, f := range data.TopTrigrams {
+			body = appendKey(body, f.Ngram)
+			body = binary.LittleEndian.AppendUint64(body, math.Float64bits(f.Count))
+		}
+	}
+	if data.Skipgrams != nil {
+		body = append(body, sectionSkipgrams, 0)
+		body = binary.AppendUvarint(body, uint64(len(data.Skipgrams)))
+		for _, k := range sortedKeys(data.Skipgrams) {
+			body = appendKey(body, k)
+			body = binary.LittleEndian.AppendUint64(body, math.Float64bits(data.Skipgrams[k]))
+		}
+	}
+	lengths := make([]int, 0, len(data.Ngrams))
+	for n := range data.Ngrams {
+		lengths = append(lengths, n)
+	}
+	sort.Ints(lengths)
+	for _, n := range lengths {
+		if n > math.MaxUint8 {
+			return nil, fmt.Errorf("ngram length %d is too long", n)
+		}
+		body = appendCounts(body, sectionNgrams, byte(n), data.Ngrams[n])
+	}
+	body = appendCounts(body, sectionShiftLetters, 0, data.ShiftLetters)
+	body = appendCounts(body, sectionShiftBigrams, 0, data.ShiftBigrams)
+	body = appendCounts(body, sectionShiftHeld, 0, data.ShiftHeld)
+
+	b := make([]byte, 0, corpusHeaderSize+len(metaJSON)+len(body))
+	b = append(b, corpusMagic...)
+	b = binary.LittleEndian.AppendUint16(b, corpusVersion)
+	b = binary.LittleEndian.AppendUint16(b, 0)
+	b = binary.LittleEndian.AppendUint32(b, uint32(len(metaJSON)))
+	b = binary.LittleEndian.AppendUint64(b, uint64(len(body)))
+	checksum := crc32.Update(crc32.Checksum(metaJSON, castagnoli), castagnoli, body)
+	b = binary.LittleEndian.AppendUint32(b, checksum)
+	b = append(b, metaJSON...)
+	b = append(b, body...)
+	return b, nil
+}
+
+// appendCounts appends a section of counts, or nothing for a nil map.
+func appendCounts(b []byte, kind byte, n byte, counts map[string]int) []byte {
+	if counts == nil {
+		return b
+	}
+	b = append(b, kind, n)
+	b = binary.AppendUvarint(b, uint64(len(counts)))
+	for _, k := range sortedKeys(counts) {
+		b = appendKey(b, k)
+		b = binary.AppendVarint(b, int64(counts[k]))
+	}
+	return b
+}
+
+func appendKey(b []byte, k string) []byte {
+	b = binary.AppendUvarint(b, uint64(len(k)))
+	return append(b, k...)
+}
+
+func sortedKeys[T int | float64](m map[string]T) []string {
+	keys := make([]string, 0, len(m))
+	for k := range m {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	return keys
+}
+
+// DecodeCorpus reads a binary corpus, checking its version and checksum.
+func DecodeCorpus(b []byte) (TextData, CorpusMeta, error) {
+	var data TextData
+	var meta CorpusMeta
+	if len(b) < corpusHeaderSize || !isBinaryCorpus(b) {
+		return data, meta, errors.New("not a binary corpus")
+	}
+	version := binary.LittleEndian.Uint16(b[8:])
+	if version > corpusVersion {
+		return data, meta, fmt.Errorf("version %d is newer than the supported version %d", version, corpusVersion)
+	}
+	metaLen := uint64(binary.LittleEndian.Uint32(b[12:]))
+	bodyLen := binary.LittleEndian.Uint64(b[16:])
+	checksum := binary.LittleEndian.Uint32(b[24:])
+	rest := b[corpusHeaderSize:]
+	if uint64(len(rest)) != metaLen+bodyLen {
+		return data, meta, fmt.Errorf("expected %d bytes after the header, found %d", metaLen+bodyLen, len(rest))
+	}
+	if crc32.Checksum(rest, castagnoli) != checksum {
+		return data, meta, errors.New("checksum mismatch")
+	}
+	if err := json.Unmarshal(rest[:metaLen], &meta); err != nil {
+		return data, meta, fmt.Errorf("metadata: %v", err)
+	}
+
+	r := corpusReader{b: rest[metaLen:]}
+	for len(r.b) > 0 && r.err == nil {
+		kind, n := r.readByte(), r.readByte()
+		count := r.uvarint()
+		if count > uint64(len(r.b)) {
+			// Every entry takes at least a byte
+			return data, meta, fmt.Errorf("section %d claims %d entries", kind, count)
+		}
+		switch kind {
+		case sectionTotals:
+			if count != 2 {
+				return data, meta, fmt.Errorf("expected 2 totals, found %d", count)
+			}
+			data.Total = int(r.varint())
+			data.TotalBigrams = int(r.varint())
+		case sectionLetters:
+			data.Letters = r.counts(count)
+		case sectionBigrams:
+			data.Bigrams = r.counts(count)
+		case sectionTrigrams:
+			data.Trigrams = r.counts(count)
+		case sectionTopTrigrams:
+			data.TopTrigrams = make([]FreqPair, count)
+			for i := range data.TopTrigrams {
+				data.TopTrigrams[i] = FreqPair{r.key(), r.float()}
+			}
+		case sectionSkipgrams:
+			data.Skipgrams = make(map[string]float64, count)
+			for i := uint64(0); i < count; i++ {
+				k := r.key()
+				data.Skipgrams[k] = r.float()
+			}
+		case sectionNgrams:
+			if data.Ngrams == nil {
+				data.Ngrams = make(map[int]map[string]int)
+			}
+			data.Ngrams[int(n)] = r.counts(count)
+		case sectionShiftLetters:
+			data.ShiftLetters = r.counts(count)
+		case sectionShiftBigrams:
+			data.ShiftBigrams = r.counts(count)
+		case sectionShiftHeld:
+			data.ShiftHeld = r.counts(count)
+		default:
+			return data, meta, fmt.Errorf("unknown section %d", kind)
+		}
+	}
+	if r.err != nil {
+		return data, meta, r.err
+	}
+	return data, meta, nil
+}
+
+// corpusReader decodes the body of a binary corpus. The first error stops
+// it and every read after returns zero values.
+type corpusReader struct {
+	b   []byte
+	err error
+}
+
+var errTruncated = errors.New("truncated corpus")
+
+func (self *corpusReader) readByte() byte {
+	if self.err != nil || len(self.b) == 0 {
+		self.err = errTruncated
+		return 0
+	}
+	c := self.b[0]
+	self.b = self.b[1:]
+	return c
+}
+
+func (self *corpusReader) uvarint() uint64 {
+	if self.err != nil {
+		return 0
+	}
+	v, n := binary.Uvarint(self.b)
+	if n <= 0 {
+		self.err = errTruncated
+		return 0
+	}
+	self.b = self.b[n:]
+	return v
+}
+
+func (self *corpusReader) varint() int64 {
+	if self.err != nil {
+		return 0
+	}
+	v, n := binary.Varint(self.b)
+	if n <= 0 {
+		self.err = errTruncated
+		return 0
+	}
+	self.b = self.b[n:]
+	return v
+}
+
+func (self *corpusReader) key() string {
+	n := self.uvarint()
+	if self.err != nil || n > uint64(len(self.b)) {
+		self.err = errTruncated
+		return ""
+	}
+	k := string(self.b[:n])
+	self.b = self.b[n:]
+	return k
+}
+
+func (self *corpusReader) float() float64 {
+	if self.err != nil || len(self.b) < 8 {
+		self.err = errTruncated
+		return 0
+	}
+	v := math.Float64frombits(binary.LittleEndian.Uint64(self.b))
+	self.b = self.b[8:]
+	return v
+}
+
+func (self *corpusReader) counts(count uint64) map[string]int {
+	m := make(map[string]int, count)
+	for i := uint64(0); i < count && self.err == nil; i++ {
+		k := self.key()
+		m[k] = int(self.varint())
+	}
+	return m
+}
+
+// ConvertCorpus writes the binary form of the json corpus called name next
+// to it in the corpora directory, returning its path. Loading prefers the
+// binary form from then on.
+func ConvertCorpus(config *UserConfig, name string) (string, error) {
+	source := filepath.Join(config.Paths.Corpora, name) + ".json"
+	b, err := GenkeyReadFile(source)
+	if err != nil {
+		return "", err
+	}
+	var data TextData
+	if err := json.Unmarshal(b, &data); err != nil {
+		return "", fmt.Errorf("%s: %v", source, err)
+	}
+	encoded, err := EncodeCorpus(&data, CorpusMeta{Name: name, Source: filepath.Base(source)})
+	if err != nil {
+		return "", err
+	}
+
+	// Written aside and renamed so that no session reads half a file
+	path := filepath.Join(config.Paths.Corpora, name) + BinaryCorpusExt
+	tmp := filepath.Join(importerToGenkey, path+".tmp")
+	if err := os.WriteFile(tmp, encoded, 0644); err != nil {
+		return "", err
+	}
+	if err := os.Rename(tmp, filepath.Join(importerToGenkey, path)); err != nil {
+		os.Remove(tmp)
+		return "", err
+	}
+	return path, nil
+}
@@ -0,0 +1,96 @@
+package genkey
+
+import (
+	"bytes"
+	"encoding/json"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func testCorpus() TextData {
+	return TextData{
+		Letters:      map[string]int{"a": 5, "b": 3, "é": 2, " ": 7},
+		Bigrams:      map[string]int{"ab": 2, "ba": 1, "aé": 1},
+		Trigrams:     map[string]int{"aba": 1, "bab": 1},
+		TopTrigrams:  []FreqPair{{"bab", 1}, {"aba", 1}},
+		Skipgrams:    map[string]float64{"aa": 0.5, "bé": 0.125},
+		TotalBigrams: 4,
+		Total:        17,
+		Ngrams:       map[int]map[string]int{4: {"abab": 1}, 5: {"ababa": 1}},
+		ShiftLetters: map[string]int{"a": 1},
+		ShiftBigrams: map[string]int{"ab": 1},
+		ShiftHeld:    map[string]int{"ba": 1},
+	}
+}
+
+func TestCorpusRoundTrip(t *testing.T) {
+	data := testCorpus()
+	b, err := EncodeCorpus(&data, CorpusMeta{Name: "test", Source: "test.json"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	again, err := EncodeCorpus(&data, CorpusMeta{Name: "test", Source: "test.json"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(b, again) {
+		t.Error("encoding the same corpus twice gave different bytes")
+	}
+
+	decoded, meta, err := DecodeCorpus(b)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(decoded, data) {
+		t.Errorf("decoded %+v, want %+v", decoded, data)
+	}
+	want := CorpusMeta{Name: "test", Source: "test.json", Total: 17, Letters: 4, Shift: true, Ngrams: 5}
+	if meta != want {
+		t.Errorf("meta %+v, want %+v", meta, want)
+	}
+}
+
+func TestCorpusCorruption(t *testing.T) {
+	data := testCorpus()
+	b, err := EncodeCorpus(&data, CorpusMeta{Name: "test"})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	flipped := bytes.Clone(b)
+	flipped[len(flipped)-1] ^= 1
+	tests := []struct {
+		name string
+		b    []byte
+		want string
+	}{
+		{"flipped bit", flipped, "checksum mismatch"},
+		{"truncated", b[:len(b)-3], "bytes after the header"},
+		{"header only", b[:corpusHeaderSize-1], "not a binary corpus"},
+		{"json", []byte(`{"letters": {}}`), "not a binary corpus"},
+	}
+	for _, tt := range tests {
+		if _, _, err := DecodeCorpus(tt.b); err == nil || !strings.Contains(err.Error(), tt.want) {
+			t.Errorf("%s: got error %v, want one containing %q", tt.name, err, tt.want)
+		}
+	}
+}
+
+func TestCorpusJSONFieldNames(t *testing.T) {
+	data := testCorpus()
+	b, err := json.Marshal(data)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Contains(b, []byte(`"toptrigrams":[{"Ngram":"bab","Count":1}`)) {
+		t.Errorf("top trigrams not stored as Ngram and Count: %s", b)
+	}
+	var decoded TextData
+	if err := json.Unmarshal(b, &decoded); err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(decoded, data) {
+		t.Errorf("decoded %+v, want %+v", decoded, data)
+	}
+}
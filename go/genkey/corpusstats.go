@@ -0,0 +1,142 @@
+package genkey
+
+import (
+	"fmt"
+	"math"
+	"sort"
+	"strings"
+)
+
+type CorpusStats struct {
+	Corpus    string      `json:"corpus"`
+	Total     int         `json:"total"`     // characters read
+	Valid     int         `json:"valid"`     // characters kept by ValidChars
+	Dropped   float64     `json:"dropped"`   // percent of total
+	Distinct  int         `json:"distinct"`  // distinct valid characters
+	Entropy   float64     `json:"entropy"`   // bits per valid character
+	Coverage  float64     `json:"coverage"`  // percent of valid characters in GeneratedLayoutChars
+	Uncovered []NgramFreq `json:"uncovered"` // most frequent characters outside it
+	Letters   []NgramFreq `json:"letters"`
+	Bigrams   []NgramFreq `json:"bigrams"`
+	Skipgrams []NgramFreq `json:"skipgrams"`
+	Trigrams  []NgramFreq `json:"trigrams"`
+	// Ngrams longer than trigrams by length, when the corpus stores them
+	Ngrams map[int][]NgramFreq `json:"ngrams,omitempty"`
+}
+
+// CorpusStats summarizes the corpus of the session. Ngram lists hold the
+// count most frequent ngrams in percent of all ngrams of their kind.
+func (self *GenkeyMain) CorpusStats(count int) CorpusStats {
+	data := &self.userData.Data
+	stats := CorpusStats{
+		Corpus:    self.userData.CorpusName(),
+		Total:     data.Total,
+		Distinct:  len(data.Letters),
+		Letters:   topNgrams(data.Letters, count),
+		Bigrams:   topNgrams(data.Bigrams, count),
+		Skipgrams: topNgrams(data.Skipgrams, count),
+		Trigrams:  topNgrams(data.Trigrams, count),
+		Uncovered: []NgramFreq{},
+	}
+	for n, ngrams := range data.Ngrams {
+		if len(ngrams) == 0 {
+			continue
+		}
+		if stats.Ngrams == nil {
+			stats.Ngrams = make(map[int][]NgramFreq)
+		}
+		stats.Ngrams[n] = topNgrams(ngrams, count)
+	}
+
+	generated := make(map[string]bool)
+	for _, c := range splitChars(normalize(self.userData.Config.Generation.GeneratedLayoutChars)) {
+		generated[c] = true
+	}
+	var covered int
+	uncovered := make(map[string]int)
+	for c, n := range data.Letters {
+		stats.Valid += n
+		if generated[c] {
+			covered += n
+		} else {
+			uncovered[c] = n
+		}
+	}
+	if stats.Valid == 0 {
+		return stats
+	}
+
+	for _, n := range data.Letters {
+		p := float64(n) / float64(stats.Valid)
+		if p > 0 {
+			stats.Entropy -= p * math.Log2(p)
+		}
+	}
+	if stats.Total > 0 {
+		stats.Dropped = 100 * float64(stats.Total-stats.Valid) / float64(stats.Total)
+	}
+	stats.Coverage = 100 * float64(covered) / float64(stats.Valid)
+	// topNgrams gives shares of the uncovered characters, rescale them to
+	// shares of all valid characters
+	for _, f := range topNgrams(uncovered, count) {
+		f.Count *= float64(stats.Valid-covered) / float64(stats.Valid)
+		stats.Uncovered = append(stats.Uncovered, f)
+	}
+	return stats
+}
+
+// topNgrams returns the count most frequent ngrams of m in percent of the
+// total of m. Ties are broken by ngram so the list is stable.
+func topNgrams[T int | float64](m map[string]T, count int) []NgramFreq {
+	var total float64
+	list := make([]NgramFreq, 0, len(m))
+	for k, v := range m {
+		total += float64(v)
+		list = append(list, NgramFreq{k, float64(v)})
+	}
+	sort.Slice(list, func(i, j int) bool {
+		if list[i].Count != list[j].Count {
+			return list[i].Count > list[j].Count
+		}
+		return list[i].Ngram < list[j].Ngram
+	})
+	list = list[:min(count, len(list))]
+	for i := range list {
+		list[i].Count = 100 * list[i].Count / total
+	}
+	return list
+}
+
+func (self *GenkeyMain) printCorpusStats(stats *CorpusStats) {
+	self.SendMessage(fmt.Sprintf("Characters: %d (%d kept, %.2f%% dropped by ValidChars)\n", stats.Total, stats.Valid, stats.Dropped))
+	self.SendMessage(fmt.Sprintf("Distinct: %d, entropy %.3f bits per character\n", stats.Distinct, stats.Entropy))
+	self.SendMessage(fmt.Sprintf("GeneratedLayoutChars coverage: %.2f%%\n", stats.Coverage))
+
+	type titledList struct {
+		title string
+		pairs []NgramFreq
+	}
+	lists := []titledList{
+		{"Not in GeneratedLayoutChars", stats.Uncovered},
+		{"Top Letters", stats.Letters},
+		{"Top Bigrams", stats.Bigrams},
+		{"Top Skipgrams", stats.Skipgrams},
+		{"Top Trigrams", stats.Trigrams},
+	}
+	for n := 4; n <= MaxNgramSize; n++ {
+		lists = append(lists, titledList{fmt.Sprintf("Top %d-grams", n), stats.Ngrams[n]})
+	}
+
+	genkeyOutput := NewGenkeyOutput(self.conn, self.userData)
+	for _, list := range lists {
+		if len(list.pairs) == 0 {
+			continue
+		}
+		self.SendMessage(list.title + ":\n")
+		shown := make([]NgramFreq, len(list.pairs))
+		for i, f := range list.pairs {
+			shown[i] = NgramFreq{strings.ReplaceAll(f.Ngram, " ", "␣"), f.Count}
+		}
+		genkeyOutput.printPercentList(shown, true)
+	}
+}
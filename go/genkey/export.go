@@ -0,0 +1,444 @@
+package genkey
+
+import (
+	"fmt"
+	"strings"
+	"unicode"
+	"unicode/utf8"
+
+	websocket "github.com/gorilla/websocket"
+)
+
+// ExportFormats are the formats of the export command.
+var ExportFormats = []string{"qmk", "zmk", "xkb", "klc"}
+
+type GenkeyExport struct {
+	conn     Conn
+	userData *UserData
+}
+
+func NewGenkeyExport(conn Conn, userData *UserData) *GenkeyExport {
+	return &GenkeyExport{conn, userData}
+}
+
+func (self *GenkeyExport) SendMessage(s string) {
+	self.conn.WriteMessage(websocket.TextMessage, []byte(s))
+}
+
+// ExportMap places the keys of a layout on the keyboard an export is for.
+// Rows are matched to the layout rows by their distance from the home
+// row, and thumb keys in order to the thumb keys of each hand, like
+// keyboard profiles.
+type ExportMap[T any] struct {
+	HomeRow    int
+	Rows       [][]T
+	LeftThumb  []T
+	RightThumb []T
+}
+
+type ExportResult struct {
+	Format  string   `json:"format"`
+	Layout  string   `json:"layout"`
+	Text    string   `json:"text"`
+	Skipped []string `json:"skipped,omitempty"` // keys left out of the export
+}
+
+// exportKey is a key of the layout and where it goes.
+type exportKey[T any] struct {
+	key   string
+	place T
+}
+
+// place returns the keys of l that m has a place for, by row and column,
+// and the keys left out. Keys after the first on the same place are left
+// out too.
+func place[T comparable](m *ExportMap[T], l *Layout) ([]exportKey[T], []string) {
+	var placed []exportKey[T]
+	var skipped []string
+	taken := make(map[T]bool)
+	add := func(key string, places []T, i int) {
+		if i < 0 || i >= len(places) || taken[places[i]] {
+			skipped = append(skipped, keyLabel(key))
+			return
+		}
+		taken[places[i]] = true
+		placed = append(placed, exportKey[T]{key, places[i]})
+	}
+
+	var thumbs [2]int // thumb keys placed so far by each hand
+	for y, row := range l.Keys {
+		thumbRow := l.ThumbRow(y)
+		var places []T
+		if i := y - l.HomeRow + m.HomeRow; !thumbRow && i >= 0 && i < len(m.Rows) {
+			places = m.Rows[i]
+		}
+		for x, key := range row {
+			if !thumbRow {
+				add(key, places, x)
+				continue
+			}
+			f, ok := l.Finger(Pos{x, y})
+			if !ok {
+				skipped = append(skipped, keyLabel(key))
+				continue
+			}
+			places = m.LeftThumb
+			if f == RT {
+				places = m.RightThumb
+			}
+			add(key, places, thumbs[f-LT])
+			thumbs[f-LT]++
+		}
+	}
+	return placed, skipped
+}
+
+// usShift pairs every character of a US keyboard with its shifted one.
+const usShift = "`~1!2@3#4$5%6^7&8*9(0)-_=+[{]}\\|;:'\",<.>/?"
+
+// shiftOf is the character typed with shift on the key of c: upper case
+// for letters, or the other character of the same key on a US keyboard.
+func shiftOf(c string) string {
+	r, _ := utf8.DecodeRuneInString(c)
+	if upper := unicode.ToUpper(r); upper != r {
+		return string(upper)
+	}
+	if i := strings.Index(usShift, c); i >= 0 && len(c) == 1 {
+		return string(usShift[i^1])
+	}
+	return c
+}
+
+// usNames names the characters of usShift, in its order.
+func usNames(names ...string) map[string]string {
+	m := make(map[string]string)
+	for i, name := range names {
+		m[usShift[i:i+1]] = name
+	}
+	return m
+}
+
+var qmkKeycodes = usNames(
+	"KC_GRV", "KC_TILD", "KC_1", "KC_EXLM", "KC_2", "KC_AT", "KC_3", "KC_HASH",
+	"KC_4", "KC_DLR", "KC_5", "KC_PERC", "KC_6", "KC_CIRC", "KC_7", "KC_AMPR",
+	"KC_8", "KC_ASTR", "KC_9", "KC_LPRN", "KC_0", "KC_RPRN", "KC_MINS", "KC_UNDS",
+	"KC_EQL", "KC_PLUS", "KC_LBRC", "KC_LCBR", "KC_RBRC", "KC_RCBR", "KC_BSLS", "KC_PIPE",
+	"KC_SCLN", "KC_COLN", "KC_QUOT", "KC_DQUO", "KC_COMM", "KC_LT", "KC_DOT", "KC_GT",
+	"KC_SLSH", "KC_QUES",
+)
+
+var zmkKeycodes = usNames(
+	"GRAVE", "TILDE", "N1", "EXCL", "N2", "AT", "N3", "HASH",
+	"N4", "DOLLAR", "N5", "PERCENT", "N6", "CARET", "N7", "AMPS",
+	"N8", "STAR", "N9", "LPAR", "N0", "RPAR", "MINUS", "UNDER",
+	"EQUAL", "PLUS", "LBKT", "LBRC", "RBKT", "RBRC", "BSLH", "PIPE",
+	"SEMI", "COLON", "SQT", "DQT", "COMMA", "LT", "DOT", "GT",
+	"FSLH", "QMARK",
+)
+
+var xkbKeysyms = usNames(
+	"grave", "asciitilde", "1", "exclam", "2", "at", "3", "numbersign",
+	"4", "dollar", "5", "percent", "6", "asciicircum", "7", "ampersand",
+	"8", "asterisk", "9", "parenleft", "0", "parenright", "minus", "underscore",
+	"equal", "plus", "bracketleft", "braceleft", "bracketright", "braceright", "backslash", "bar",
+	"semicolon", "colon", "apostrophe", "quotedbl", "comma", "less", "period", "greater",
+	"slash", "question",
+)
+
+// klcKeys are the virtual keys of the characters of usShift.
+var klcKeys = usNames(
+	"OEM_3", "OEM_3", "1", "1", "2", "2", "3", "3",
+	"4", "4", "5", "5", "6", "6", "7", "7",
+	"8", "8", "9", "9", "0", "0", "OEM_MINUS", "OEM_MINUS",
+	"OEM_PLUS", "OEM_PLUS", "OEM_4", "OEM_4", "OEM_6", "OEM_6", "OEM_5", "OEM_5",
+	"OEM_1", "OEM_1", "OEM_7", "OEM_7", "OEM_COMMA", "OEM_COMMA", "OEM_PERIOD", "OEM_PERIOD",
+	"OEM_2", "OEM_2",
+)
+
+// klcScanKeys are the virtual keys of the scan codes of a US keyboard, for
+// characters with no virtual key of their own.
+var klcScanKeys = func() map[string]string {
+	m := map[string]string{
+		"0c": "OEM_MINUS", "0d": "OEM_PLUS", "1a": "OEM_4", "1b": "OEM_6", "27": "OEM_1",
+		"28": "OEM_7", "29": "OEM_3", "2b": "OEM_5", "33": "OEM_COMMA", "34": "OEM_PERIOD",
+		"35": "OEM_2", "39": "SPACE", "56": "OEM_102",
+	}
+	for start, keys := range map[int]string{0x02: "1234567890", 0x10: "QWERTYUIOP", 0x1e: "ASDFGHJKL", 0x2c: "ZXCVBNM"} {
+		for i, k := range keys {
+			m[fmt.Sprintf("%02x", start+i)] = string(k)
+		}
+	}
+	return m
+}()
+
+// klcSpareKeys are given to characters whose virtual key is taken.
+var klcSpareKeys = []string{
+	"OEM_8", "OEM_102", "OEM_1", "OEM_2", "OEM_3", "OEM_4", "OEM_5", "OEM_6", "OEM_7",
+	"OEM_MINUS", "OEM_PLUS", "OEM_COMMA", "OEM_PERIOD",
+}
+
+// klcKey is the virtual key the key at scan code sc would like: its own
+// for letters and digits, that of the US key of its character, or else
+// that of its scan code.
+func klcKey(key string, sc string) string {
+	if asciiLetter(key) || asciiDigit(key) {
+		return strings.ToUpper(key)
+	}
+	if key == " " {
+		return "SPACE"
+	}
+	if vk, ok := klcKeys[key]; ok {
+		return vk
+	}
+	return klcScanKeys[strings.ToLower(sc)]
+}
+
+func asciiLetter(c string) bool {
+	return len(c) == 1 && c[0] >= 'a' && c[0] <= 'z'
+}
+
+func asciiDigit(c string) bool {
+	return len(c) == 1 && c[0] >= '0' && c[0] <= '9'
+}
+
+// identifier turns name into lower case letters, digits and underscores.
+func identifier(name string, fallback string) string {
+	var sb strings.Builder
+	for _, r := range strings.ToLower(name) {
+		if (r >= 'a' && r <= 'z') || (r >= '0' && r <= '9') {
+			sb.WriteRune(r)
+		} else if sb.Len() > 0 && !strings.HasSuffix(sb.String(), "_") {
+			sb.WriteByte('_')
+		}
+	}
+	if id := strings.Trim(sb.String(), "_"); id != "" {
+		return id
+	}
+	return fallback
+}
+
+// writeArray writes codes in lines of columns, each padded to the widest.
+func writeArray(sb *strings.Builder, codes []string, columns int, indent string, sep string) {
+	width := 0
+	for _, c := range codes {
+		width = max(width, len(c)+len(sep))
+	}
+	columns = max(columns, 1)
+	for i, c := range codes {
+		if i%columns == 0 {
+			sb.WriteString(indent)
+		}
+		if i < len(codes)-1 {
+			c += sep
+		}
+		if i%columns == columns-1 || i == len(codes)-1 {
+			sb.WriteString(c + "\n")
+		} else {
+			sb.WriteString(fmt.Sprintf("%-*s ", width, c))
+		}
+	}
+}
+
+// QMK writes l as the base layer of a QMK keymap.c. Non-ASCII characters
+// need the unicode feature of QMK.
+func (self *GenkeyExport) QMK(l *Layout) (string, []string) {
+	config := &self.userData.Config.Export.QMK
+	codes := make([]string, config.Keys)
+	for i := range codes {
+		codes[i] = "KC_NO"
+	}
+	placed, skipped := place(&config.ExportMap, l)
+	for _, p := range placed {
+		code, ok := qmkKeycodes[p.key]
+		if asciiLetter(p.key) {
+			code, ok = "KC_"+strings.ToUpper(p.key), true
+		} else if p.key == " " {
+			code, ok = "KC_SPC", true
+		} else if r, _ := utf8.DecodeRuneInString(p.key); !ok && r > unicode.MaxASCII {
+			code, ok = fmt.Sprintf("UC(0x%04X)", r), true
+		}
+		if !ok || p.place < 0 || p.place >= len(codes) {
+			skipped = append(skipped, keyLabel(p.key))
+			continue
+		}
+		codes[p.place] = code
+	}
+
+	var sb strings.Builder
+	sb.WriteString(fmt.Sprintf("// %s, exported by genkey\n", l.Name))
+	sb.WriteString("const uint16_t PROGMEM keymaps[][MATRIX_ROWS][MATRIX_COLS] = {\n")
+	sb.WriteString(fmt.Sprintf("    [0] = %s(\n", config.Layout))
+	writeArray(&sb, codes, config.Columns, "        ", ",")
+	sb.WriteString("    )\n};\n")
+	return sb.String(), skipped
+}
+
+// ZMK writes l as the default layer of a ZMK keymap.
+func (self *GenkeyExport) ZMK(l *Layout) (string, []string) {
+	config := &self.userData.Config.Export.ZMK
+	codes := make([]string, config.Keys)
+	for i := range codes {
+		codes[i] = "&none"
+	}
+	placed, skipped := place(&config.ExportMap, l)
+	for _, p := range placed {
+		code, ok := zmkKeycodes[p.key]
+		if asciiLetter(p.key) {
+			code, ok = strings.ToUpper(p.key), true
+		} else if p.key == " " {
+			code, ok = "SPACE", true
+		}
+		if !ok || p.place < 0 || p.place >= len(codes) {
+			skipped = append(skipped, keyLabel(p.key))
+			continue
+		}
+		codes[p.place] = "&kp " + code
+	}
+
+	var sb strings.Builder
+	sb.WriteString(fmt.Sprintf("// %s, exported by genkey\n", l.Name))
+	sb.WriteString("/ {\n    keymap {\n        compatible = \"zmk,keymap\";\n\n")
+	sb.WriteString("        default_layer {\n            bindings = <\n")
+	writeArray(&sb, codes, config.Columns, "                ", "")
+	sb.WriteString("            >;\n        };\n    };\n};\n")
+	return sb.String(), skipped
+}
+
+func xkbKeysym(c string) string {
+	if name, ok := xkbKeysyms[c]; ok {
+		return name
+	}
+	if c == " " {
+		return "space"
+	}
+	r, _ := utf8.DecodeRuneInString(c)
+	if r <= unicode.MaxASCII {
+		return c
+	}
+	return fmt.Sprintf("U%04X", r)
+}
+
+// XKB writes l as an XKB symbols file on top of the US layout, with the
+// shifted characters of the US keys that are not letters.
+func (self *GenkeyExport) XKB(l *Layout) (string, []string) {
+	placed, skipped := place(&self.userData.Config.Export.XKB, l)
+
+	var sb strings.Builder
+	sb.WriteString(fmt.Sprintf("// %s, exported by genkey\n", l.Name))
+	sb.WriteString("default partial alphanumeric_keys\n")
+	sb.WriteString(fmt.Sprintf("xkb_symbols \"%s\" {\n", identifier(l.Name, "genkey")))
+	sb.WriteString("    include \"us(basic)\"\n")
+	sb.WriteString(fmt.Sprintf("    name[Group1] = \"%s\";\n\n", strings.ReplaceAll(l.Name, "\"", "'")))
+	for _, p := range placed {
+		sb.WriteString(fmt.Sprintf("    key <%s> { [ %s, %s ] };\n", p.place, xkbKeysym(p.key), xkbKeysym(shiftOf(p.key))))
+	}
+	sb.WriteString("};\n")
+	return sb.String(), skipped
+}
+
+func klcChar(c string) string {
+	if asciiLetter(c) || asciiDigit(c) || (len(c) == 1 && c[0] >= 'A' && c[0] <= 'Z') {
+		return c
+	}
+	r, _ := utf8.DecodeRuneInString(c)
+	return fmt.Sprintf("%04x", r)
+}
+
+// KLC writes l as a Microsoft Keyboard Layout Creator source file, keyed
+// by scan code. Letters and digits keep their virtual keys so shortcuts
+// follow them, and every key gets a different one.
+func (self *GenkeyExport) KLC(l *Layout) (string, []string) {
+	placed, skipped := place(&self.userData.Config.Export.KLC, l)
+	id := strings.ReplaceAll(identifier(l.Name, "genkey"), "_", "")
+	id = id[:min(len(id), 8)]
+
+	vks := make([]string, len(placed))
+	used := make(map[string]bool)
+	// Letters and digits first, so that nothing takes their keys
+	for _, own := range []bool{true, false} {
+		for i, p := range placed {
+			if own != (asciiLetter(p.key) || asciiDigit(p.key)) {
+				continue
+			}
+			vk := klcKey(p.key, p.place)
+			for _, spare := range klcSpareKeys {
+				if vk != "" && !used[vk] {
+					break
+				}
+				vk = spare
+			}
+			if vk != "" && !used[vk] {
+				vks[i] = vk
+				used[vk] = true
+			}
+		}
+	}
+
+	var sb strings.Builder
+	sb.WriteString(fmt.Sprintf("KBD\t%s\t\"%s\"\n\n", id, strings.ReplaceAll(l.Name, "\"", "'")))
+	sb.WriteString("COPYRIGHT\t\"\"\n\nCOMPANY\t\"genkey\"\n\nLOCALENAME\t\"en-US\"\n\nLOCALEID\t\"00000409\"\n\nVERSION\t1.0\n\n")
+	sb.WriteString("SHIFTSTATE\n\n0\t//Column 4\n1\t//Column 5 : Shft\n\n")
+	sb.WriteString("LAYOUT\t\t;an extra '@' at the end is a dead key\n\n")
+	sb.WriteString("//SC\tVK_\t\tCap\t0\t1\n//--\t----\t\t----\t----\t----\n\n")
+	for i, p := range placed {
+		if vks[i] == "" {
+			skipped = append(skipped, keyLabel(p.key))
+			continue
+		}
+		cap := 0
+		if shiftOf(p.key) != p.key && !strings.Contains(usShift, p.key) {
+			cap = 1
+		}
+		sb.WriteString(fmt.Sprintf("%s\t%s\t\t%d\t%s\t%s\n", strings.ToLower(p.place), vks[i], cap, klcChar(p.key), klcChar(shiftOf(p.key))))
+	}
+	sb.WriteString("\n\nDESCRIPTIONS\n\n0409\t" + l.Name + "\n\n")
+	sb.WriteString("LANGUAGENAMES\n\n0409\tEnglish (United States)\n\nENDKBD\n")
+	return sb.String(), skipped
+}
+
+// Export converts l to one of ExportFormats.
+func (self *GenkeyExport) Export(format string, l *Layout) ExportResult {
+	var text string
+	var skipped []string
+	switch format {
+	case "qmk":
+		text, skipped = self.QMK(l)
+	case "zmk":
+		text, skipped = self.ZMK(l)
+	case "xkb":
+		text, skipped = self.XKB(l)
+	case "klc":
+		text, skipped = self.KLC(l)
+	default:
+		panic(fmt.Sprintf("unknown export format [%s]", format))
+	}
+	return ExportResult{format, l.Name, text, skipped}
+}
+
+// export handles the export command: export format layout.
+func (self *GenkeyMain) export(args []string) {
+	if len(args) < 3 {
+		self.SendMessage(fmt.Sprintf("usage: export (%s) layout\n", strings.Join(ExportFormats, " | ")))
+		return
+	}
+	format := strings.ToLower(args[1])
+	found := false
+	for _, f := range ExportFormats {
+		found = found || f == format
+	}
+	if !found {
+		self.SendMessage(fmt.Sprintf("unknown format [%s], expected one of %s\n", args[1], strings.Join(ExportFormats, " ")))
+		return
+	}
+	layout := self.getLayout(args[2])
+	if layout == nil {
+		return
+	}
+
+	result := NewGenkeyExport(self.conn, self.userData).Export(format, layout)
+	self.SendMessage(result.Text)
+	if len(result.Skipped) > 0 {
+		self.SendMessage(fmt.Sprintf("left out, with no place or code in %s: %s\n", format, strings.Join(result.Skipped, " ")))
+	}
+	self.result = result
+}
@@ -18,20 +18,19 @@ import (
 	"fmt"
 	"math"
 	"math/rand"
+	"slices"
 	"sort"
-
-	"strings"
 	"time"
 
 	websocket "github.com/gorilla/websocket"
 )
 
 type GenkeyGenerate struct {
-	conn     *websocket.Conn
+	conn     Conn
 	userData *UserData
 }
 
-func NewGenkeyGenerate(conn *websocket.Conn, userData *UserData) *GenkeyGenerate {
+func NewGenkeyGenerate(conn Conn, userData *UserData) *GenkeyGenerate {
 	return &GenkeyGenerate{conn, userData}
 }
 
@@ -64,46 +63,76 @@ func (self *GenkeyGenerate) Score(l *Layout) float64 {
 	}
 	if s.Trigrams.Enabled {
 		tri := genkeyLayout.FastTrigrams(l, s.Trigrams.Precision)
-		score += s.Trigrams.LeftInwardRoll * (100 - (100 * float64(tri.LeftInwardRolls) / float64(tri.Total)))
-		score += s.Trigrams.RightInwardRoll * (100 - (100 * float64(tri.RightInwardRolls) / float64(tri.Total)))
-		score += s.Trigrams.LeftOutwardRoll * (100 - (100 * float64(tri.LeftOutwardRolls) / float64(tri.Total)))
-		score += s.Trigrams.RightOutwardRoll * (100 - (100 * float64(tri.RightOutwardRolls) / float64(tri.Total)))
-		score += s.Trigrams.Alternate * (100 - (100 * float64(tri.Alternates) / float64(tri.Total)))
-		score += s.Trigrams.Onehand * (100 - (100 * float64(tri.Onehands) / float64(tri.Total)))
-		score += s.Trigrams.Redirect * (100 * float64(tri.Redirects) / float64(tri.Total))
+		score = self.addTrigramScore(score, &tri)
 	}
 
 	if s.IndexBalance != 0 {
 		left, right := genkeyLayout.IndexUsage(l)
 		score += s.IndexBalance * math.Abs(right-left)
 	}
+	if self.userData.Corpus.HasShift {
+		shifts := genkeyLayout.Shifts(l)
+		score = self.addShiftScore(score, &shifts, l.Total)
+	}
 
 	self.userData.Analyzed++
 
 	return score
 }
 
-func (self *GenkeyGenerate) randomLayout() *Layout {
-	chars := self.userData.Config.Generation.GeneratedLayoutChars
+// addShiftScore adds the shift terms of Score to score.
+func (self *GenkeyGenerate) addShiftScore(score float64, shifts *ShiftStats, total float64) float64 {
+	s := &self.userData.Config.Weights.Score
+	score += s.ShiftSFB * 100 * float64(shifts.SFBs) / total
+	score += s.ShiftSameHand * 100 * float64(shifts.SameHand) / total
+	return score
+}
+
+// addTrigramScore adds the trigram terms of Score to score one by one, so
+// the result is the same as summing them inline.
+func (self *GenkeyGenerate) addTrigramScore(score float64, tri *TrigramValues) float64 {
+	s := &self.userData.Config.Weights.Score
+	score += s.Trigrams.LeftInwardRoll * (100 - (100 * float64(tri.LeftInwardRolls) / float64(tri.Total)))
+	score += s.Trigrams.RightInwardRoll * (100 - (100 * float64(tri.RightInwardRolls) / float64(tri.Total)))
+	score += s.Trigrams.LeftOutwardRoll * (100 - (100 * float64(tri.LeftOutwardRolls) / float64(tri.Total)))
+	score += s.Trigrams.RightOutwardRoll * (100 - (100 * float64(tri.RightOutwardRolls) / float64(tri.Total)))
+	score += s.Trigrams.Alternate * (100 - (100 * float64(tri.Alternates) / float64(tri.Total)))
+	score += s.Trigrams.Onehand * (100 - (100 * float64(tri.Onehands) / float64(tri.Total)))
+	score += s.Trigrams.Redirect * (100 * float64(tri.Redirects) / float64(tri.Total))
+	return score
+}
+
+// generatedKey reports whether a key of layouts/_generate is placed by
+// the generator, which keeps every other key where it is. The X marker is
+// upper case, a lower case x is the letter.
+func generatedKey(k string) bool {
+	return k == "*" || k == "X"
+}
+
+func (self *GenkeyGenerate) randomLayout(rng *rand.Rand) *Layout {
+	chars := splitChars(normalize(self.userData.Config.Generation.GeneratedLayoutChars))
+	if n := len(self.userData.GeneratedPositions); n > len(chars) {
+		panic(fmt.Sprintf("Generation.GeneratedLayoutChars has %d characters, but layouts/_generate has %d keys to generate.\n", len(chars), n))
+	}
+	template := self.userData.GeneratedKeys
 	var k [][]string
-	k = make([][]string, 3)
-	var l Layout
-	for row := 0; row < 3; row++ {
-		k[row] = make([]string, 10)
-		for col := 0; col < 10; col++ {
-			char := string([]rune(chars)[rand.Intn(len(chars))])
+	k = make([][]string, len(template))
+	var total float64
+	for row := range template {
+		k[row] = make([]string, len(template[row]))
+		for col, key := range template[row] {
+			char := key
+			if generatedKey(key) {
+				char = chars[rng.Intn(len(chars))]
+				i := slices.Index(chars, char)
+				chars = slices.Delete(chars, i, i+1)
+			}
 			k[row][col] += char
-			l.Total += float64(self.userData.Data.Letters[char])
-			chars = strings.Replace(chars, char, "", 1)
+			total += float64(self.userData.Data.Letters[char])
 		}
 	}
 
-	l.Keys = k
-	l.Keymap.Update(NewGenkeyLayout(self.conn, self.userData).GenKeymap(k))
-	l.Fingermap = self.userData.GeneratedFingermap
-	l.Fingermatrix = self.userData.GeneratedFingermatrix
-
-	return &l
+	return NewLayout("", k, self.userData.GeneratedGeometry, total)
 }
 
 type layoutScore struct {
@@ -132,46 +161,33 @@ func (self *GenkeyGenerate) sortLayouts(layouts []layoutScore) {
 	})
 }
 
-func (self *GenkeyGenerate) Populate(n int) *Layout {
+// Populate improves n layouts and returns the best one. Runs with the same
+// seed, corpus and config return the same layout unless cancelled.
+func (self *GenkeyGenerate) Populate(n int, seed int64) *Layout {
 	layouts := []layoutScore{}
+	rng := NewStream(seed, streamRandom, 0)
 	for i := 0; i < n; i++ {
 		if !self.userData.ImproveFlag {
-			layout := self.randomLayout()
+			layout := self.randomLayout(rng)
 			layouts = append(layouts, layoutScore{layout, 0})
 		} else {
 			layouts = append(layouts, layoutScore{NewGenkeyInteractive(self.conn, self.userData).CopyLayout(self.userData.ImproveLayout), 0})
 		}
 
 	}
-	self.SendMessage(fmt.Sprintf("%d random created...\r\n", n))
+	sendProgress(self.conn, Progress{Stage: "random", Total: n}, fmt.Sprintf("%d random created...\r\n", n))
 
-	analyzed := 0
+	self.userData.DeltaMismatches.Reset()
 	goroCounter := &self.userData.GoroutineCounter
 
 	goroCounter.SetCount(len(layouts))
 
-	for i := range layouts {
-		go func(_i int, _layouts []layoutScore) {
-			_layouts[_i].score = 0
-			self.greedyImprove(_layouts[_i].l)
-		}(i, layouts)
-	}
-
-	done := make(chan bool)
-
-	go func() {
-		defer func() {
-			done <- true
-		}()
-
-		for goroCounter.GetCount() > 1 {
-			self.SendMessage(fmt.Sprintf("%d greedy improving at %d analyzed/s       \n", goroCounter.GetCount()-1, self.userData.Analyzed-analyzed))
-			analyzed = self.userData.Analyzed
-			time.Sleep(time.Second)
-		}
-	}()
+	Jobs.Spawn(self.userData.Context(), len(layouts), func(i int) {
+		layouts[i].score = 0
+		self.greedyImprove(layouts[i].l, NewStream(seed, streamGreedy, i))
+	})
 
-	<-done
+	self.waitImprovers("greedy", "%d greedy improving at %d analyzed/s       \n")
 
 	self.SendMessage("\n")
 
@@ -188,41 +204,31 @@ func (self *GenkeyGenerate) Populate(n int) *Layout {
 
 	layouts = layouts[0:self.userData.Config.Generation.Selection]
 
-	goroCounter.SetCount(len(layouts))
+	if !self.userData.Cancelled() {
+		goroCounter.SetCount(len(layouts))
 
-	for i := range layouts {
-		go func(_i int, _layouts []layoutScore) {
-			_layouts[_i].score = 0
-			self.fullImprove(_layouts[_i].l)
-		}(i, layouts)
-	}
+		Jobs.Spawn(self.userData.Context(), len(layouts), func(i int) {
+			layouts[i].score = 0
+			self.fullImprove(layouts[i].l, NewStream(seed, streamFull, i))
+		})
 
-	go func() {
-		defer func() {
-			done <- true
-		}()
-		for goroCounter.GetCount() > 1 {
-			self.SendMessage(fmt.Sprintf("%d fully improving at %d analyzed/s      \n", goroCounter.GetCount()-1, self.userData.Analyzed-analyzed))
-			analyzed = self.userData.Analyzed
-			time.Sleep(time.Second)
-		}
-	}()
+		self.waitImprovers("full", "%d fully improving at %d analyzed/s      \n")
 
-	<-done
+		self.sortLayouts(layouts)
+	}
 
-	self.sortLayouts(layouts)
+	if self.userData.Cancelled() {
+		self.SendMessage("\nCancelled, best layout found so far:\n")
+	}
+
+	if self.userData.DeltaCheckFlag {
+		self.SendMessage(fmt.Sprintf("\ndelta check: %d mismatched scores\n", self.userData.DeltaMismatches.GetCount()))
+	}
 
 	self.SendMessage("\n")
 	best := layouts[0]
 
-	for col := 0; col < 10; col++ {
-		if col >= 3 && col <= 6 {
-			continue
-		}
-		if self.userData.Data.Letters[best.l.Keys[0][col]] < self.userData.Data.Letters[best.l.Keys[2][col]] {
-			self.Swap(best.l, Pos{col, 0}, Pos{col, 2})
-		}
-	}
+	self.raiseCommonKeys(best.l)
 
 	genkeyOutput.PrintAnalysis(best.l)
 	if self.userData.Config.Output.Generation.Heatmap {
@@ -236,37 +242,109 @@ func (self *GenkeyGenerate) Populate(n int) *Layout {
 	return layouts[0].l
 }
 
-func (self *GenkeyGenerate) RandPos() Pos {
+// raiseCommonKeys swaps the keys above and below the home row where the
+// one below is more common, except under the index fingers.
+func (self *GenkeyGenerate) raiseCommonKeys(l *Layout) {
+	top, bottom := l.HomeRow-1, l.HomeRow+1
+	if top < 0 || bottom >= len(l.Keys) || l.ThumbRow(top) || l.ThumbRow(bottom) {
+		return
+	}
+	movable := func(p Pos) bool {
+		f, _ := l.Finger(p)
+		if f == 3 || f == 4 {
+			return false
+		}
+		return self.userData.ImproveFlag || generatedKey(self.userData.GeneratedKeys[p.Row][p.Col])
+	}
+	for col := 0; col < min(len(l.Keys[top]), len(l.Keys[bottom])); col++ {
+		a, b := Pos{col, top}, Pos{col, bottom}
+		if !movable(a) || !movable(b) {
+			continue
+		}
+		if self.userData.Data.Letters[l.Keys[top][col]] < self.userData.Data.Letters[l.Keys[bottom][col]] {
+			self.Swap(l, a, b)
+		}
+	}
+}
+
+// waitImprovers reports progress until the improving goroutines are done.
+// Once the job is cancelled it waits for every goroutine to return, so
+// that the layouts are no longer being swapped when they are read.
+func (self *GenkeyGenerate) waitImprovers(stage string, format string) {
+	goroCounter := &self.userData.GoroutineCounter
+	analyzed := self.userData.Analyzed
+
+	for goroCounter.GetCount() > 0 && !self.userData.Cancelled() {
+		remaining := goroCounter.GetCount()
+		rate := self.userData.Analyzed - analyzed
+		sendProgress(self.conn, Progress{Stage: stage, Remaining: remaining, Rate: rate}, fmt.Sprintf(format, remaining, rate))
+		analyzed = self.userData.Analyzed
+		self.sleep(time.Second)
+	}
+
+	for self.userData.Cancelled() && goroCounter.GetCount() > 0 {
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+// sleep waits for d unless the job is cancelled first.
+func (self *GenkeyGenerate) sleep(d time.Duration) {
+	select {
+	case <-self.userData.Context().Done():
+	case <-time.After(d):
+	}
+}
+
+func (self *GenkeyGenerate) RandPos(rng *rand.Rand) Pos {
 	var p Pos
 	if self.userData.ImproveFlag {
 		n := len(self.userData.SwapPossibilities)
-		p = self.userData.SwapPossibilities[rand.Intn(n)]
-	} else {
-		col := rand.Intn(10)
-		row := rand.Intn(3)
+		p = self.userData.SwapPossibilities[rng.Intn(n)]
+	} else if cols, ok := self.generatedGrid(); ok {
+		col := rng.Intn(cols)
+		row := rng.Intn(len(self.userData.GeneratedKeys))
 		p = Pos{col, row}
+	} else {
+		positions := self.userData.GeneratedPositions
+		p = positions[rng.Intn(len(positions))]
 	}
 	return p
 }
 
-func (self *GenkeyGenerate) greedyImprove(layout *Layout) {
+// generatedGrid returns the width of layouts/_generate when every key of
+// it is generated and its rows are equally long. Positions on such a grid
+// are drawn by column and row, so that seeds replay as they always did.
+func (self *GenkeyGenerate) generatedGrid() (int, bool) {
+	keys := self.userData.GeneratedKeys
+	cols := len(keys[0])
+	for _, row := range keys {
+		if len(row) != cols {
+			return 0, false
+		}
+	}
+	return cols, len(self.userData.GeneratedPositions) == cols*len(keys)
+}
+
+func (self *GenkeyGenerate) greedyImprove(layout *Layout, rng *rand.Rand) {
 	defer self.userData.GoroutineCounter.Decrement()
 
+	ctx := self.userData.Context()
+	scorer := self.NewScorer(layout)
 	stuck := 0
-	for {
-		first := self.Score(layout)
+	for ctx.Err() == nil {
+		first := scorer.Score()
 
-		a := self.RandPos()
-		b := self.RandPos()
-		self.Swap(layout, a, b)
+		a := self.RandPos(rng)
+		b := self.RandPos(rng)
+		scorer.Swap(a, b)
 
-		second := self.Score(layout)
+		second := scorer.Score()
 
 		if second < first {
 			// accept
 			stuck = 0
 		} else {
-			self.Swap(layout, a, b)
+			scorer.Swap(a, b)
 			stuck++
 		}
 
@@ -277,7 +355,7 @@ func (self *GenkeyGenerate) greedyImprove(layout *Layout) {
 	}
 }
 
-func (self *GenkeyGenerate) fullImprove(layout *Layout) {
+func (self *GenkeyGenerate) fullImprove(layout *Layout, rng *rand.Rand) {
 	defer self.userData.GoroutineCounter.Decrement()
 
 	i := 0
@@ -287,18 +365,20 @@ func (self *GenkeyGenerate) fullImprove(layout *Layout) {
 	rejected := 0
 	max := 600
 	Swaps := make([]Pair, 7)
-	for {
+	ctx := self.userData.Context()
+	scorer := self.NewScorer(layout)
+	for ctx.Err() == nil {
 		i += 1
-		first := self.Score(layout)
+		first := scorer.Score()
 
 		for j := tier - 1; j >= 0; j-- {
-			a := self.RandPos()
-			b := self.RandPos()
-			self.Swap(layout, a, b)
+			a := self.RandPos(rng)
+			b := self.RandPos(rng)
+			scorer.Swap(a, b)
 			Swaps[j] = Pair{a, b}
 		}
 
-		second := self.Score(layout)
+		second := scorer.Score()
 
 		if second < first {
 			i = 0
@@ -307,7 +387,7 @@ func (self *GenkeyGenerate) fullImprove(layout *Layout) {
 			continue
 		} else {
 			for j := 0; j < tier; j++ {
-				self.Swap(layout, Swaps[j][0], Swaps[j][1])
+				scorer.Swap(Swaps[j][0], Swaps[j][1])
 			}
 
 			rejected++
@@ -336,10 +416,5 @@ func (self *GenkeyGenerate) fullImprove(layout *Layout) {
 }
 
 func (self *GenkeyGenerate) Swap(l *Layout, a, b Pos) {
-	k := l.Keys
-	k[a.Row][a.Col], k[b.Row][b.Col] = k[b.Row][b.Col], k[a.Row][a.Col]
-	l.Keymap.Store(k[a.Row][a.Col], a)
-	l.Keymap.Store(k[b.Row][b.Col], b)
-
-	l.Keys = k
+	l.Swap(a, b)
 }
@@ -15,6 +15,8 @@
 package genkey
 
 import (
+	"fmt"
+	"math/rand"
 	"os"
 	"path/filepath"
 	"sync"
@@ -22,11 +24,12 @@ import (
 	util "github.com/waterdragen/akl-ws/util"
 )
 
-var FingerNames = [8]string{"LP", "LR", "LM", "LI", "RI", "RM", "RR", "RP"}
+var FingerNames = [10]string{"LP", "LR", "LM", "LI", "RI", "RM", "RR", "RP", "LT", "RT"}
 
 type UserConfig struct {
-	Corpus string
-	Output struct {
+	Corpus   string
+	Keyboard string
+	Output   struct {
 		Generation struct {
 			Heatmap bool
 		}
@@ -41,27 +44,33 @@ type UserConfig struct {
 		}
 	}
 	Paths struct {
-		Layouts string
-		Corpora string
-		Heatmap string
+		Layouts   string
+		Corpora   string
+		Keyboards string
+		WordLists []string
+		Heatmap   string
 	}
 	Weights struct {
-		Stagger     bool
-		ColStagger  bool
-		ColStaggers [10]float64
-		FSpeed      struct {
+		FSpeed struct {
 			SFB       float64
 			DSFB      float64
 			KeyTravel float64
-			KPS       [8]float64
+			KPS       [len(FingerNames)]float64
 		}
 		Dist struct {
 			Lateral float64
 		}
+		Shift struct {
+			Side    string
+			Fingers [2]Finger
+			OneShot bool
+		}
 		Score struct {
-			FSpeed       float64
-			IndexBalance float64
-			LSB          float64
+			FSpeed        float64
+			IndexBalance  float64
+			LSB           float64
+			ShiftSFB      float64
+			ShiftSameHand float64
 
 			Trigrams struct {
 				Enabled          bool
@@ -86,6 +95,28 @@ type UserConfig struct {
 		CharSubstitutions           [][2]string
 		MaxSkipgramSize             int8
 		SkipgramsMustSpanValidChars bool
+		MaxNgramSize                int
+		NgramLimit                  int
+		RecordShift                 bool
+	}
+	WordLists struct {
+		Spaces    bool
+		SpanWords bool
+	}
+	Export struct {
+		QMK struct {
+			Layout  string // the LAYOUT macro of the keyboard
+			Keys    int
+			Columns int // keys per line of the output
+			ExportMap[int]
+		}
+		ZMK struct {
+			Keys    int
+			Columns int
+			ExportMap[int]
+		}
+		XKB ExportMap[string] // key names like AD01
+		KLC ExportMap[string] // scan codes like 1e
 	}
 }
 
@@ -98,37 +129,63 @@ type UserInteractive struct {
 	InInteractive bool
 	Layout        *Layout
 	LayoutWidth   int
+	Message       []string
+	Rand          *rand.Rand // for worsen
 }
 
 type UserData struct {
 	mu sync.RWMutex
 
 	// From globals.go
-	StaggerFlag    bool
-	ColStaggerFlag bool
-	ColStaggers    [10]float64
+	KeyboardFlag   string
 	SlideFlag      bool
 	DynamicFlag    bool
+	DeltaCheckFlag bool
+	SeedFlag       int64
 	ImproveFlag    bool
 	ImproveLayout  *Layout
+	LastLayout     *Layout // of the latest generate, improve or interactive session
 
-	Layouts               map[string]*Layout
-	GeneratedFingermap    map[Finger][]Pos
-	GeneratedFingermatrix map[Pos]Finger
-	LongestLayoutName     int
+	Layouts            map[string]*Layout
+	GeneratedGeometry  *Geometry
+	GeneratedKeys      [][]string // of layouts/_generate, see generatedKey
+	GeneratedPositions []Pos      // where GeneratedKeys are generated
+	LongestLayoutName  int
 
 	SwapPossibilities []Pos
 	Analyzed          int
 
 	// From main.go
-	Data TextData
+	Data   TextData
+	Corpus *Corpus // Data compiled by CompileCorpus
+
+	// From corpora.go
+	SelectedCorpus string // overrides Config.Corpus for this session, may be a blend
+
+	// From layout.go
+	reportedLayouts map[string]string // problems sent by file, see reportLayoutErrors
+
+	// From keyboard.go
+	Keyboard         *Keyboard // the profile of KeyboardName
+	SelectedKeyboard string    // overrides Config.Keyboard for this session
+
+	// From upload.go
+	SessionCorpus *SessionCorpus
+	upload        *corpusUpload
 
 	// From generate.go
 	GoroutineCounter util.AtomicCounter
 
+	// From scorer.go
+	DeltaMismatches util.AtomicCounter
+
+	// From job.go
+	job jobControl
+
 	// other
 	Config      UserConfig
 	Interactive UserInteractive // interactive.go
+	Protocol    Protocol        // protocol.go
 }
 
 const importerToGenkey = "./genkey"
@@ -140,3 +197,55 @@ func GenkeyOpen(path string) (*os.File, error) {
 func GenkeyReadFile(path string) ([]byte, error) {
 	return os.ReadFile(filepath.Join(importerToGenkey, path))
 }
+
+func GenkeyStat(path string) (os.FileInfo, error) {
+	return os.Stat(filepath.Join(importerToGenkey, path))
+}
+
+// CorpusName is the name of the corpus the session analyzes against, the
+// canonical spec for blends.
+func (self *UserData) CorpusName() string {
+	if self.SessionCorpus != nil {
+		return self.SessionCorpus.Name
+	}
+	return BlendName(self.corpusParts())
+}
+
+// corpusParts returns the corpora selected by the session, or by the
+// config if the session did not select any.
+func (self *UserData) corpusParts() []BlendPart {
+	spec := self.Config.Corpus
+	if self.SelectedCorpus != "" {
+		spec = self.SelectedCorpus
+	}
+	parts, err := ParseBlend(spec)
+	if err != nil {
+		panic(fmt.Sprintf("Invalid corpus [%s]: %v\n", spec, err))
+	}
+	return parts
+}
+
+// corpusPath is the file of a corpus, see corpusSource.
+func corpusPath(config *UserConfig, name string) string {
+	path, _ := corpusSource(config, name)
+	return path
+}
+
+// corpusSource finds the file of a corpus: the binary corpus called name
+// in the corpora directory unless its json corpus is newer, or else the
+// json corpus, or else the word list.
+func corpusSource(config *UserConfig, name string) (path string, wordList bool) {
+	binary := filepath.Join(config.Paths.Corpora, name) + BinaryCorpusExt
+	path = filepath.Join(config.Paths.Corpora, name) + ".json"
+	binInfo, binErr := GenkeyStat(binary)
+	jsonInfo, err := GenkeyStat(path)
+	if binErr == nil && (err != nil || !jsonInfo.ModTime().After(binInfo.ModTime())) {
+		return binary, false
+	}
+	if err != nil {
+		if list, ok := wordListPath(config, name); ok {
+			return list, true
+		}
+	}
+	return path, false
+}
@@ -3,7 +3,6 @@ package genkey
 import (
 	"fmt"
 	"math"
-	"math/rand"
 	"strconv"
 	"strings"
 	"sync"
@@ -15,12 +14,12 @@ import (
 )
 
 type GenkeyInteractive struct {
-	conn     *websocket.Conn
+	conn     Conn
 	userData *UserData
 	sp       *util.StringPrinter
 }
 
-func NewGenkeyInteractive(conn *websocket.Conn, userData *UserData) *GenkeyInteractive {
+func NewGenkeyInteractive(conn Conn, userData *UserData) *GenkeyInteractive {
 	return &GenkeyInteractive{
 		conn:     conn,
 		userData: userData,
@@ -38,28 +37,7 @@ func (self *GenkeyInteractive) FlushSp() {
 }
 
 func (self *GenkeyInteractive) CopyLayout(src *Layout) *Layout {
-	var l Layout
-	n := len(src.Keys)
-	l.Keys = make([][]string, n)
-	for i := range src.Keys {
-		l.Keys[i] = make([]string, len(src.Keys[i]))
-		copy(l.Keys[i], src.Keys[i])
-	}
-	l.Name = src.Name
-	l.Total = src.Total
-
-	srcKeymap := src.Keymap.CopyMap()
-	l.Keymap.Update(srcKeymap)
-
-	l.Fingermap = make(map[Finger][]Pos)
-	for k, v := range src.Fingermap {
-		l.Fingermap[k] = v
-	}
-	l.Fingermatrix = make(map[Pos]Finger)
-	for k, v := range src.Fingermatrix {
-		l.Fingermatrix[k] = v
-	}
-	return &l
+	return src.Copy()
 }
 
 func (self *GenkeyInteractive) printlayout(l *Layout, px, py int) {
@@ -71,8 +49,13 @@ func (self *GenkeyInteractive) printlayout(l *Layout, px, py int) {
 			base := math.Round(0.3 * 255)
 			c := color.Color(uint8(0.6*base+log), uint8(base+log), uint8(base+log))
 
+			// The printer writes bytes, so the space bar is not spaceKey
+			label := k
+			if k == " " {
+				label = "_"
+			}
 			self.sp.MoveCursor(px+(2*x), py+y)
-			self.sp.PrintColor(c, k)
+			self.sp.PrintColor(c, label)
 		}
 	}
 }
@@ -119,9 +102,9 @@ func (self *GenkeyInteractive) printtrigrams(l *Layout) {
 	total += float64(tg.RightInwardRolls)
 	total += float64(tg.RightOutwardRolls)
 	total += float64(tg.Redirects)
-	self.sp.MoveCursor(1, 7)
+	self.sp.MoveCursor(1, 4+len(l.Keys))
 	self.sp.Print("Trigrams")
-	self.sp.MoveCursor(1, 8)
+	self.sp.MoveCursor(1, 5+len(l.Keys))
 	x := 0
 	y := 0
 	for i, v := range []float64{float64(tg.LeftInwardRolls + tg.LeftOutwardRolls + tg.RightOutwardRolls + tg.RightInwardRolls), float64(tg.Alternates), float64(tg.Onehands), float64(tg.Redirects)} {
@@ -160,66 +143,26 @@ type psbl struct {
 	potential float64
 }
 
-func (self *GenkeyInteractive) worsen(l *Layout, is33 bool) {
+func (self *GenkeyInteractive) worsen(l *Layout) {
 	n := 1000
 	i := 0
-	var klen int
-	if is33 {
-		klen = 33
-	} else {
-		klen = 30
-	}
+	positions := l.Positions()
 	for i < n {
-		x := rand.Intn(klen)
-		y := rand.Intn(klen)
+		x := self.userData.Interactive.Rand.Intn(len(positions))
+		y := self.userData.Interactive.Rand.Intn(len(positions))
 		if x == y {
 			continue
 		}
-		var xrow int
-		var xcol int
-		var yrow int
-		var ycol int
-		if is33 {
-			if x < 12 {
-				xrow = 0
-				xcol = x
-			} else if x < 12+11 {
-				xrow = 1
-				xcol = x - 12
-			} else {
-				xrow = 2
-				xcol = x - 12 - 11
-			}
-			if y < 12 {
-				yrow = 0
-				ycol = y
-			} else if y < 12+11 {
-				yrow = 1
-				ycol = y - 12
-			} else {
-				yrow = 2
-				ycol = y - 12 - 11
-			}
-		} else {
-			if x < 10 {
-				xrow = 0
-				xcol = x
-			} else if x < 20 {
-				xrow = 1
-				xcol = x - 10
-			} else {
-				xrow = 2
-				xcol = x - 20
-			}
-		}
-		px := self.userData.Interactive.Pins[xrow][xcol]
-		py := self.userData.Interactive.Pins[yrow][ycol]
-		if px == "#" || py == "#" {
+		px := positions[x]
+		py := positions[y]
+		pinX := self.userData.Interactive.Pins[px.Row][px.Col]
+		pinY := self.userData.Interactive.Pins[py.Row][py.Col]
+		if pinX == "#" || pinY == "#" {
 			continue
 		}
-		kx := l.Keys[xrow][xcol]
-		ky := l.Keys[yrow][ycol]
-		if px == kx || px == ky || py == kx || py == ky {
+		kx := l.Keys[px.Row][px.Col]
+		ky := l.Keys[py.Row][py.Col]
+		if pinX == kx || pinX == ky || pinY == kx || pinY == ky {
 			continue
 		}
 		p1 := l.Keymap.Get(kx)
@@ -230,12 +173,13 @@ func (self *GenkeyInteractive) worsen(l *Layout, is33 bool) {
 }
 
 func (self *GenkeyInteractive) SuggestSwaps(l *Layout, depth int, maxdepth int, p *psbl, wg *sync.WaitGroup) psbl {
-	genkeyGenerate := NewGenkeyGenerate(self.conn, self.userData)
-	s1 := genkeyGenerate.Score(l)
+	scorer := NewGenkeyGenerate(self.conn, self.userData).NewScorer(l)
+	s1 := scorer.Score()
 
-	var possibilities []psbl
-	for r1 := 0; r1 < 3; r1++ {
-		for r2 := 0; r2 < 3; r2++ {
+	ctx := self.userData.Context()
+	var possibilities []*psbl
+	for r1 := 0; r1 < len(l.Keys) && ctx.Err() == nil; r1++ {
+		for r2 := 0; r2 < len(l.Keys); r2++ {
 			for c1 := 0; c1 < len(l.Keys[r1]); c1++ {
 				for c2 := 0; c2 < len(l.Keys[r2]); c2++ {
 					if c1 == c2 && r1 == r2 {
@@ -244,26 +188,28 @@ func (self *GenkeyInteractive) SuggestSwaps(l *Layout, depth int, maxdepth int,
 					p1 := Pos{c1, r1}
 					p2 := Pos{c2, r2}
 
-					genkeyGenerate.Swap(l, p1, p2)
-					s2 := genkeyGenerate.Score(l)
+					scorer.Swap(p1, p2)
+					s2 := scorer.Score()
 					diff := s1 - s2
 					if depth < maxdepth && diff > self.userData.Interactive.Threshold {
+						c := self.CopyLayout(l)
+						wg.Add(1)
 						if depth == 0 {
-							possibilities = append(possibilities, psbl{Pair{p1, p2}, s2, s2})
-							go self.SuggestSwaps(self.CopyLayout(l), depth+1, maxdepth, &possibilities[len(possibilities)-1], wg)
+							next := &psbl{Pair{p1, p2}, s2, s2}
+							possibilities = append(possibilities, next)
+							Jobs.Go(ctx, func() { self.SuggestSwaps(c, depth+1, maxdepth, next, wg) })
 						} else {
-							go self.SuggestSwaps(self.CopyLayout(l), depth+1, maxdepth, p, wg)
+							Jobs.Go(ctx, func() { self.SuggestSwaps(c, depth+1, maxdepth, p, wg) })
 							if s2 < *&p.potential {
 								*&p.potential = s2
 							}
 						}
-						wg.Add(1)
 					} else if depth == maxdepth {
 						if s2 < *&p.potential {
 							*&p.potential = s2
 						}
 					}
-					genkeyGenerate.Swap(l, p1, p2)
+					scorer.Swap(p1, p2)
 				}
 			}
 		}
@@ -284,11 +230,33 @@ func (self *GenkeyInteractive) SuggestSwaps(l *Layout, depth int, maxdepth int,
 				topindex = i
 			}
 		}
-		return possibilities[topindex]
+		return *possibilities[topindex]
+	}
+}
+
+type InteractiveState struct {
+	Name    string     `json:"name"`
+	Keys    [][]string `json:"keys"`
+	Score   float64    `json:"score"`
+	Message []string   `json:"message,omitempty"`
+	Active  bool       `json:"active"`
+}
+
+// State is the structured result of an interactive command.
+func (self *GenkeyInteractive) State() InteractiveState {
+	interactive := &self.userData.Interactive
+	l := interactive.Layout
+	return InteractiveState{
+		Name:    l.Name,
+		Keys:    l.Keys,
+		Score:   NewGenkeyGenerate(self.conn, self.userData).Score(l),
+		Message: interactive.Message,
+		Active:  interactive.InInteractive,
 	}
 }
 
 func (self *GenkeyInteractive) message(s ...string) {
+	self.userData.Interactive.Message = s
 	var base int = self.sp.Height - 2
 	var offset int
 	for i, v := range s {
@@ -302,12 +270,12 @@ func (self *GenkeyInteractive) InteractiveSubsequent(input string) {
 	defer self.FlushSp()
 
 	self.sp.Clear()
-	self.SendMessage("[CLEAR]")
+	sendClear(self.conn)
 
 	interactive := &self.userData.Interactive
+	interactive.Message = nil
 	l := interactive.Layout
-	args := strings.Fields(input)
-	is33 := false
+	args := strings.Fields(normalize(input))
 	noCross := true
 
 	self.sp.MoveCursor(0, self.sp.Height-2)
@@ -353,14 +321,18 @@ func (self *GenkeyInteractive) InteractiveSubsequent(input string) {
 		} else {
 			c2 = l.Keymap.Get(args[2]).Col
 		}
-		for r := 0; r < 3; r++ {
+		interactive.Swapnum = 0
+		for r, row := range l.Keys {
+			if c1 < 0 || c2 < 0 || c1 >= len(row) || c2 >= len(row) {
+				continue
+			}
 			p1 := Pos{c1, r}
 			p2 := Pos{c2, r}
 			NewGenkeyGenerate(self.conn, self.userData).Swap(l, p1, p2)
-			interactive.Aswaps[r] = p1
-			interactive.Bswaps[r] = p2
+			interactive.Aswaps[interactive.Swapnum] = p1
+			interactive.Bswaps[interactive.Swapnum] = p2
+			interactive.Swapnum++
 		}
-		interactive.Swapnum = 3
 		self.message(fmt.Sprintf("swapped c%d with c%d", c1, c2))
 	case "r":
 		for i := 0; i < interactive.Swapnum; i++ {
@@ -368,6 +340,11 @@ func (self *GenkeyInteractive) InteractiveSubsequent(input string) {
 		}
 		self.message("reverted last swap")
 	case "g":
+		release, ok := acquireJob(self.conn, self.userData)
+		if !ok {
+			break
+		}
+		defer release()
 		var max int
 		if len(args) < 2 {
 			max = 1
@@ -386,11 +363,16 @@ func (self *GenkeyInteractive) InteractiveSubsequent(input string) {
 			self.message(fmt.Sprintf("try %s (%.1f immediate, %.1f potential)", k1+k2, swaps.score, swaps.potential))
 		}
 	case "w":
-		self.worsen(l, is33)
+		self.worsen(l)
 	case "m2":
-		NewGenkeyLayout(self.conn, self.userData).MinimizeLayout(l, interactive.Pins, 1, true, is33, noCross)
+		release, ok := acquireJob(self.conn, self.userData)
+		if !ok {
+			break
+		}
+		defer release()
+		NewGenkeyLayout(self.conn, self.userData).MinimizeLayout(l, interactive.Pins, 1, true, noCross)
 	case "m":
-		NewGenkeyLayout(self.conn, self.userData).MinimizeLayout(l, interactive.Pins, 0, true, is33, noCross)
+		NewGenkeyLayout(self.conn, self.userData).MinimizeLayout(l, interactive.Pins, 0, true, noCross)
 	case "q":
 		interactive.InInteractive = false
 	case "save":
@@ -406,7 +388,9 @@ func (self *GenkeyInteractive) InteractiveInitial(l *Layout) {
 
 	interactive := &self.userData.Interactive
 	interactive.InInteractive = true
-	interactive.Layout = l
+	interactive.Layout = self.CopyLayout(l)
+	interactive.Message = nil
+	interactive.Rand = NewStream(self.userData.runSeed(), streamWorsen, 0)
 
 	for _, row := range l.Keys {
 		for x := range row {
@@ -417,26 +401,45 @@ func (self *GenkeyInteractive) InteractiveInitial(l *Layout) {
 	}
 	self.sp.Clear()
 
-	interactive.Aswaps = make([]Pos, 3)
-	interactive.Bswaps = make([]Pos, 3)
+	interactive.Aswaps = make([]Pos, len(l.Keys))
+	interactive.Bswaps = make([]Pos, len(l.Keys))
 	interactive.Swapnum = 0
-	interactive.Pins = [][]string{
-		{"@", "#", "#", "#", "@", "@", "#", "#", "#", "@", "#", "#"},
-		{"#", "#", "#", "#", "@", "@", "#", "#", "#", "#", "#", "@"},
-		{"@", "@", "@", "@", "@", "@", "@", "@", "@", "@", "@", "@"},
-	}
+	interactive.Pins = interactivePins(l)
 
 	self.printUpdatedLayout(time.Now())
 	self.sp.Print(":")
 }
 
+// homePins pin the keys of the rows above, on and below the home row that
+// m and w leave alone. Keys of other rows are free to move.
+var homePins = [3][]string{
+	{"@", "#", "#", "#", "@", "@", "#", "#", "#", "@", "#", "#"},
+	{"#", "#", "#", "#", "@", "@", "#", "#", "#", "#", "#", "@"},
+	{"@", "@", "@", "@", "@", "@", "@", "@", "@", "@", "@", "@"},
+}
+
+// interactivePins lays homePins out on the rows of l.
+func interactivePins(l *Layout) [][]string {
+	pins := make([][]string, len(l.Keys))
+	for y, row := range l.Keys {
+		pins[y] = make([]string, len(row))
+		for x := range row {
+			pins[y][x] = "@"
+			if r := y - l.HomeRow + 1; r >= 0 && r < len(homePins) && x < len(homePins[r]) {
+				pins[y][x] = homePins[r][x]
+			}
+		}
+	}
+	return pins
+}
+
 func (self *GenkeyInteractive) printUpdatedLayout(start time.Time) {
 	l := self.userData.Interactive.Layout
 
 	self.sp.MoveCursor(0, 0)
 	self.sp.Print(l.Name)
 	self.printlayout(l, 1, 2)
-	self.sp.MoveCursor(1, 5)
+	self.sp.MoveCursor(1, 2+len(l.Keys))
 	self.sp.Print(fmt.Sprintf("Score: %.2f", NewGenkeyGenerate(self.conn, self.userData).Score(l)))
 	self.printsfbs(l)
 	self.printworst(l)
@@ -0,0 +1,64 @@
+package genkey
+
+import (
+	"context"
+	"sync"
+)
+
+// jobControl holds the context of the command currently running for a
+// session. It has its own lock because cancel requests arrive while
+// UserData.mu is held by the running command.
+type jobControl struct {
+	mu     sync.Mutex
+	ctx    context.Context
+	cancel context.CancelFunc
+}
+
+// StartJob derives a cancellable context for the next command from
+// parent, which is usually the lifetime of the connection.
+func (self *UserData) StartJob(parent context.Context) context.Context {
+	self.job.mu.Lock()
+	defer self.job.mu.Unlock()
+
+	self.job.ctx, self.job.cancel = context.WithCancel(parent)
+	return self.job.ctx
+}
+
+func (self *UserData) FinishJob() {
+	self.job.mu.Lock()
+	defer self.job.mu.Unlock()
+
+	if self.job.cancel != nil {
+		self.job.cancel()
+	}
+	self.job.ctx = nil
+	self.job.cancel = nil
+}
+
+// CancelJob aborts the running command and reports whether there was one.
+func (self *UserData) CancelJob() bool {
+	self.job.mu.Lock()
+	defer self.job.mu.Unlock()
+
+	if self.job.cancel == nil {
+		return false
+	}
+	self.job.cancel()
+	return true
+}
+
+// Context returns the context of the running command. Commands run
+// outside of a job, like HTTP API requests, are never cancelled.
+func (self *UserData) Context() context.Context {
+	self.job.mu.Lock()
+	defer self.job.mu.Unlock()
+
+	if self.job.ctx == nil {
+		return context.Background()
+	}
+	return self.job.ctx
+}
+
+func (self *UserData) Cancelled() bool {
+	return self.Context().Err() != nil
+}
@@ -0,0 +1,243 @@
+package genkey
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+
+	"github.com/BurntSushi/toml"
+)
+
+// Keyboard is a physical keyboard profile from the keyboards directory,
+// the position of every key in key widths. Distances are measured on it.
+type Keyboard struct {
+	Name        string
+	Description string
+	HomeRow     int            // index in Rows of the row the fingers rest on
+	Rows        [][][2]float64 // x and y of the keys of every row, y growing downwards
+	LeftThumb   [][2]float64   // thumb keys of each hand, the resting key first
+	RightThumb  [][2]float64
+
+	id    string    // file name without .toml
+	stamp fileStamp // of the file it was read from
+}
+
+type KeyboardInfo struct {
+	Name        string `json:"name"`
+	Title       string `json:"title"`
+	Description string `json:"description"`
+	Active      bool   `json:"active"`
+}
+
+// readKeyboard parses the keyboard profile at path.
+func readKeyboard(path string) (*Keyboard, error) {
+	stamp, err := stampFile(path)
+	if err != nil {
+		return nil, err
+	}
+	b, err := GenkeyReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	k := Keyboard{stamp: stamp}
+	if _, err := toml.Decode(string(b), &k); err != nil {
+		return nil, err
+	}
+	if len(k.Rows) == 0 {
+		return nil, errors.New("it needs at least one row")
+	}
+	for y, row := range k.Rows {
+		if len(row) == 0 {
+			return nil, fmt.Errorf("row %d has no keys", y+1)
+		}
+	}
+	if k.HomeRow < 0 || k.HomeRow >= len(k.Rows) {
+		return nil, fmt.Errorf("HomeRow %d is not one of its %d rows", k.HomeRow, len(k.Rows))
+	}
+	if len(k.LeftThumb) == 0 || len(k.RightThumb) == 0 {
+		return nil, errors.New("it needs LeftThumb and RightThumb keys")
+	}
+	k.id = strings.TrimSuffix(filepath.Base(path), ".toml")
+	if k.Name == "" {
+		k.Name = k.id
+	}
+	return &k, nil
+}
+
+// row returns row i of the keyboard, or for rows above or below it the
+// nearest one and how far down to move it.
+func (k *Keyboard) row(i int) ([][2]float64, float64) {
+	nearest := min(max(i, 0), len(k.Rows)-1)
+	return k.Rows[nearest], float64(i - nearest)
+}
+
+// extendRow returns key i of keys, continuing them dx apart past the last.
+func extendRow(keys [][2]float64, i int, dx float64) [2]float64 {
+	if i < len(keys) {
+		return keys[i]
+	}
+	last := keys[len(keys)-1]
+	return [2]float64{last[0] + dx*float64(i-len(keys)+1), last[1]}
+}
+
+// keyboardCoords are the key positions of Coords on a version of a keyboard
+// profile. Only the last version read is kept.
+type keyboardCoords struct {
+	stamp  fileStamp
+	coords [][][2]float64
+}
+
+// Coords returns where every key of g is on k, by row and column. Rows are
+// matched by their distance from the home row and thumb keys in order to
+// the thumb keys of each hand. Keys past what k describes continue its
+// rows one key apart.
+func (g *Geometry) Coords(k *Keyboard) [][][2]float64 {
+	if c, ok := g.coords.Load(k.id); ok && c.(keyboardCoords).stamp == k.stamp {
+		return c.(keyboardCoords).coords
+	}
+	coords := make([][][2]float64, len(g.Fingermatrix))
+	var thumbs [2]int // thumb keys placed so far by each hand
+	for y, row := range g.Fingermatrix {
+		coords[y] = make([][2]float64, len(row))
+		if g.ThumbRow(y) {
+			for x, f := range row {
+				keys, dx := k.LeftThumb, -1.0
+				if f == RT {
+					keys, dx = k.RightThumb, 1
+				}
+				coords[y][x] = extendRow(keys, thumbs[f-LT], dx)
+				thumbs[f-LT]++
+			}
+			continue
+		}
+		keys, dy := k.row(y - g.HomeRow + k.HomeRow)
+		for x := range row {
+			c := extendRow(keys, x, 1)
+			coords[y][x] = [2]float64{c[0], c[1] + dy}
+		}
+	}
+	g.coords.Store(k.id, keyboardCoords{k.stamp, coords})
+	return coords
+}
+
+// KeyboardNames lists the profiles in the keyboards directory.
+func (self *UserData) KeyboardNames() []string {
+	entries, err := os.ReadDir(filepath.Join(importerToGenkey, self.Config.Paths.Keyboards))
+	if err != nil {
+		panic(err)
+	}
+	var names []string
+	for _, e := range entries {
+		if name, ok := strings.CutSuffix(e.Name(), ".toml"); ok && !e.IsDir() {
+			names = append(names, name)
+		}
+	}
+	sort.Strings(names)
+	return names
+}
+
+// HasKeyboard reports whether name is one of KeyboardNames.
+func (self *UserData) HasKeyboard(name string) bool {
+	for _, n := range self.KeyboardNames() {
+		if n == name {
+			return true
+		}
+	}
+	return false
+}
+
+// SelectKeyboard switches the session to a profile from the keyboards
+// directory.
+func (self *UserData) SelectKeyboard(name string) error {
+	name = strings.ToLower(name)
+	if !self.HasKeyboard(name) {
+		return fmt.Errorf("keyboard [%s] was not found", name)
+	}
+	self.SelectedKeyboard = name
+	return nil
+}
+
+// KeyboardName is the profile distances are measured on: the -keyboard
+// flag, else the one selected by the session, else the config one.
+func (self *UserData) KeyboardName() string {
+	if self.KeyboardFlag != "" {
+		return self.KeyboardFlag
+	}
+	if self.SelectedKeyboard != "" {
+		return self.SelectedKeyboard
+	}
+	return self.Config.Keyboard
+}
+
+// loadKeyboard sets the session keyboard from KeyboardName.
+func (self *GenkeyMain) loadKeyboard() {
+	userData := self.userData
+	name := strings.ToLower(userData.KeyboardName())
+	if !userData.HasKeyboard(name) {
+		panic(fmt.Sprintf("Keyboard [%s] does not exist, pick another one with keyboard.\n", name))
+	}
+	path := filepath.Join(userData.Config.Paths.Keyboards, name) + ".toml"
+	userData.Keyboard = keyboardCache.get(path, "", func() *Keyboard {
+		k, err := readKeyboard(path)
+		if err != nil {
+			panic(fmt.Sprintf("Invalid keyboard [%s]: %v\n", path, err))
+		}
+		return k
+	})
+}
+
+// keyboard handles the keyboard command:
+//
+//	keyboard        lists the keyboard profiles
+//	keyboard name   measures distances on another profile for this session
+func (self *GenkeyMain) keyboard(args []string) {
+	if len(args) < 2 {
+		self.listKeyboards()
+		return
+	}
+
+	userData := self.userData
+	if err := userData.SelectKeyboard(args[1]); err != nil {
+		self.SendMessage(err.Error() + "\n")
+		return
+	}
+	userData.KeyboardFlag = ""
+	self.loadKeyboard()
+	k := userData.Keyboard
+	self.SendMessage(fmt.Sprintf("using [%s] for this session\n", k.id))
+	self.result = KeyboardInfo{k.id, k.Name, k.Description, true}
+}
+
+func (self *GenkeyMain) listKeyboards() {
+	userData := self.userData
+	active := strings.ToLower(userData.KeyboardName())
+
+	var infos []KeyboardInfo
+	width := 0
+	for _, name := range userData.KeyboardNames() {
+		path := filepath.Join(userData.Config.Paths.Keyboards, name) + ".toml"
+		info := KeyboardInfo{Name: name, Active: name == active}
+		if k, err := readKeyboard(path); err != nil {
+			info.Description = fmt.Sprintf("invalid: %v", err)
+		} else {
+			info.Title, info.Description = k.Name, k.Description
+		}
+		infos = append(infos, info)
+		width = max(width, len(name))
+	}
+	for _, info := range infos {
+		mark := " "
+		if info.Active {
+			mark = "*"
+		}
+		title := ""
+		if info.Title != "" {
+			title = info.Title + ": "
+		}
+		self.SendMessage(fmt.Sprintf("%s %-*s  %s%s\n", mark, width, info.Name, title, info.Description))
+	}
+	self.result = infos
+}
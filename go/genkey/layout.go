@@ -22,16 +22,18 @@ import (
 	"strconv"
 	"strings"
 	"sync"
+	"sync/atomic"
+	"unicode"
 
 	websocket "github.com/gorilla/websocket"
 )
 
 type GenkeyLayout struct {
-	conn     *websocket.Conn
+	conn     Conn
 	userData *UserData
 }
 
-func NewGenkeyLayout(conn *websocket.Conn, userData *UserData) *GenkeyLayout {
+func NewGenkeyLayout(conn Conn, userData *UserData) *GenkeyLayout {
 	return &GenkeyLayout{conn, userData}
 }
 
@@ -47,144 +49,259 @@ type Pos struct {
 type Pair [2]Pos
 type Finger int
 
-type KeymapMutexMap struct {
-	mu   sync.RWMutex
-	mmap map[string]Pos
+// Fingers 0 to 7 go from the left pinky to the right pinky, the thumbs
+// come after them.
+const (
+	LT Finger = 8
+	RT Finger = 9
+)
+
+// Right reports whether f is a finger of the right hand.
+func (f Finger) Right() bool {
+	return f == RT || (f >= 4 && f < LT)
 }
 
-func (km *KeymapMutexMap) Get(key string) Pos {
-	km.mu.Lock()
-	defer km.mu.Unlock()
-	return km.mmap[key]
+// rollOrder places f along its hand, from the pinky to the thumb on the
+// left and from the thumb to the pinky on the right, so that inward rolls
+// go up the order on the left hand and down it on the right.
+func (f Finger) rollOrder() int {
+	if f >= LT {
+		return 7
+	}
+	return 2 * int(f)
 }
 
-func (km *KeymapMutexMap) TryGet(key string) (Pos, bool) {
-	km.mu.Lock()
-	defer km.mu.Unlock()
-	value, ok := km.mmap[key]
-	return value, ok
+// ParseFinger reads a finger of a layout file, either its number or its
+// name in FingerNames.
+func ParseFinger(s string) (Finger, error) {
+	if n, err := strconv.Atoi(s); err == nil && n >= 0 && n < len(FingerNames) {
+		return Finger(n), nil
+	}
+	for i, name := range FingerNames {
+		if strings.EqualFold(s, name) {
+			return Finger(i), nil
+		}
+	}
+	return 0, fmt.Errorf("[%s] is not a finger, expected 0 to %d or one of %s", s, len(FingerNames)-1, strings.Join(FingerNames[:], " "))
 }
 
-func (km *KeymapMutexMap) Store(key string, pos Pos) {
-	km.mu.Lock()
-	defer km.mu.Unlock()
-	km.mmap[key] = pos
+// KeyID is the id of a key on a layout and its copies, see Keymap.
+type KeyID int32
+
+// Keymap finds keys on a layout. Keys are numbered in the order they first
+// appear on it, so the tables are only as large as the layout. Swapping
+// keys never changes which keys there are, so index is shared by every
+// copy of a layout and the other tables until one of them swaps keys.
+type Keymap struct {
+	index map[string]KeyID // id by key
+	ids   [][]KeyID        // key by row and column
+	pos   []Pos            // position by key
 }
 
-func (km *KeymapMutexMap) Pop(key string) {
-	km.mu.Lock()
-	defer km.mu.Unlock()
-	delete(km.mmap, key)
+func newKeymap(keys [][]string) Keymap {
+	km := Keymap{index: make(map[string]KeyID)}
+	km.ids = make([][]KeyID, len(keys))
+	for y, row := range keys {
+		km.ids[y] = make([]KeyID, len(row))
+		for x, k := range row {
+			id, ok := km.index[k]
+			if !ok {
+				id = KeyID(len(km.pos))
+				km.index[k] = id
+				km.pos = append(km.pos, Pos{})
+			}
+			km.ids[y][x] = id
+			km.pos[id] = Pos{x, y}
+		}
+	}
+	return km
 }
 
-func (km *KeymapMutexMap) Update(newMap map[string]Pos) {
-	km.mu.Lock()
-	defer km.mu.Unlock()
-	km.mmap = newMap
+// Get returns the position of key, or the zero Pos if it is not on the
+// layout.
+func (km *Keymap) Get(key string) Pos {
+	p, _ := km.TryGet(key)
+	return p
 }
 
-func (km *KeymapMutexMap) CopyMap() map[string]Pos {
-	km.mu.Lock()
-	defer km.mu.Unlock()
+func (km *Keymap) TryGet(key string) (Pos, bool) {
+	id, ok := km.index[key]
+	if !ok {
+		return Pos{}, false
+	}
+	return km.pos[id], true
+}
+
+func (km *Keymap) clone() Keymap {
+	c := Keymap{km.index, make([][]KeyID, len(km.ids)), make([]Pos, len(km.pos))}
+	for y, row := range km.ids {
+		c.ids[y] = append([]KeyID(nil), row...)
+	}
+	copy(c.pos, km.pos)
+	return c
+}
 
-	newMap := make(map[string]Pos)
+// Geometry is the part of a layout that swapping keys never changes. It is
+// shared by every copy of a layout and must not be modified.
+type Geometry struct {
+	Fingermatrix [][]Finger // finger by row and column
+	Fingermap    [][]Pos    // positions by finger, up to the thumbs if any are used
+	HomeRow      int        // the row the fingers rest on
 
-	for k, v := range km.mmap {
-		newMap[k] = v
+	coords sync.Map // keyboard id to the keyboardCoords of its last version
+}
+
+// NewGeometry indexes the fingers of every key. Rows pressed only by
+// thumbs are thumb rows, and the home row is the second to last of the
+// others, so that rows above it are number rows.
+func NewGeometry(fingermatrix [][]Finger) *Geometry {
+	g := &Geometry{
+		Fingermatrix: fingermatrix,
+		Fingermap:    make([][]Pos, LT),
+	}
+	var rows []int
+	for y, row := range fingermatrix {
+		for x, f := range row {
+			for int(f) >= len(g.Fingermap) {
+				g.Fingermap = append(g.Fingermap, nil)
+			}
+			g.Fingermap[f] = append(g.Fingermap[f], Pos{x, y})
+		}
+		if !g.ThumbRow(y) {
+			rows = append(rows, y)
+		}
+	}
+	if len(rows) > 0 {
+		g.HomeRow = rows[max(len(rows)-2, 0)]
 	}
+	return g
+}
 
-	return newMap
+// ThumbRow reports whether every key of row y is pressed by a thumb.
+func (g *Geometry) ThumbRow(y int) bool {
+	for _, f := range g.Fingermatrix[y] {
+		if f < LT {
+			return false
+		}
+	}
+	return len(g.Fingermatrix[y]) > 0
+}
+
+// Positions lists every key position by row and then column.
+func (g *Geometry) Positions() []Pos {
+	var positions []Pos
+	for y, row := range g.Fingermatrix {
+		for x := range row {
+			positions = append(positions, Pos{x, y})
+		}
+	}
+	return positions
+}
+
+// Finger returns the finger pressing p. Positions without a finger report
+// finger 0, like the zero value of the map this replaced.
+func (g *Geometry) Finger(p Pos) (Finger, bool) {
+	if p.Row < 0 || p.Row >= len(g.Fingermatrix) || p.Col < 0 || p.Col >= len(g.Fingermatrix[p.Row]) {
+		return 0, false
+	}
+	return g.Fingermatrix[p.Row][p.Col], true
 }
 
 type Layout struct {
-	Name         string
-	Keys         [][]string
-	Keymap       KeymapMutexMap
-	Fingermatrix map[Pos]Finger
-	Fingermap    map[Finger][]Pos
-	Total        float64
+	Name   string
+	Keys   [][]string // read only, use Swap to change keys
+	Keymap Keymap
+	*Geometry
+	Total float64
+
+	// shared is set once Keys and Keymap are also used by a copy. The
+	// first Swap after that works on its own copy of them.
+	shared *atomic.Bool
+}
+
+func NewLayout(name string, keys [][]string, geometry *Geometry, total float64) *Layout {
+	return &Layout{
+		Name:     name,
+		Keys:     keys,
+		Keymap:   newKeymap(keys),
+		Geometry: geometry,
+		Total:    total,
+		shared:   new(atomic.Bool),
+	}
+}
+
+// Copy returns a layout that can be swapped independently of l. Nothing
+// is copied until either of them swaps keys.
+func (l *Layout) Copy() *Layout {
+	l.shared.Store(true)
+	c := *l
+	return &c
 }
 
-func (self *GenkeyLayout) MinimizeLayout(init *Layout, pins [][]string, count int, top bool, is33 bool, noCross bool) {
+func (l *Layout) Swap(a, b Pos) {
+	if l.shared.Load() {
+		keys := make([][]string, len(l.Keys))
+		for y, row := range l.Keys {
+			keys[y] = append([]string(nil), row...)
+		}
+		l.Keys = keys
+		l.Keymap = l.Keymap.clone()
+		l.shared = new(atomic.Bool)
+	}
+
+	k := l.Keys
+	k[a.Row][a.Col], k[b.Row][b.Col] = k[b.Row][b.Col], k[a.Row][a.Col]
+	ids := l.Keymap.ids
+	ids[a.Row][a.Col], ids[b.Row][b.Col] = ids[b.Row][b.Col], ids[a.Row][a.Col]
+	l.Keymap.pos[ids[a.Row][a.Col]] = a
+	l.Keymap.pos[ids[b.Row][b.Col]] = b
+}
+
+// MinimizeLayout swaps keys of init until no swap improves its score.
+// Keys pinned with # never move and noCross keeps keys on their hand.
+func (self *GenkeyLayout) MinimizeLayout(init *Layout, pins [][]string, count int, top bool, noCross bool) {
 	genkeyGenerate := NewGenkeyGenerate(self.conn, self.userData)
 	genkeyInteractive := NewGenkeyInteractive(self.conn, self.userData)
 
 	bestScore := genkeyGenerate.Score(init)
 	bestLayout := genkeyInteractive.CopyLayout(init)
-	var tot int
-	var r1len int
-	var r2len int
-	if is33 {
-		tot = 33
-		r1len = 12
-		r2len = 11
-	} else {
-		tot = 30
-		r1len = 10
-		r2len = 10
-	}
+	positions := init.Positions()
 	var foundBetter bool
 	for {
 		foundBetter = false
 		bestSoFarScore := bestScore
 		bestSoFarLayout := bestLayout
 
-		for i := 0; i < tot-1; i++ {
-			for j := i + 1; j < tot; j++ {
-				var irow int
-				var icol int
-				if i < r1len {
-					irow = 0
-				} else if i < (r1len + r2len) {
-					irow = 1
-				} else {
-					irow = 2
-				}
-				if i < r1len {
-					icol = i
-				} else if i < (r1len + r2len) {
-					icol = i - r1len
-				} else {
-					icol = i - (r1len + r2len)
-				}
-				var jrow int
-				var jcol int
-				if j < r1len {
-					jrow = 0
-				} else if j < (r1len + r2len) {
-					jrow = 1
-				} else {
-					jrow = 2
-				}
-				if j < r1len {
-					jcol = j
-				} else if j < (r1len + r2len) {
-					jcol = j - r1len
-				} else {
-					jcol = j - (r1len + r2len)
-				}
+		for i := 0; i < len(positions)-1; i++ {
+			if self.userData.Cancelled() {
+				break
+			}
+			for j := i + 1; j < len(positions); j++ {
+				pi, pj := positions[i], positions[j]
 				if noCross {
-					if !((icol <= 4 && jcol <= 4) || (icol >= 5 && jcol >= 5)) {
+					fi, _ := init.Finger(pi)
+					fj, _ := init.Finger(pj)
+					if fi.Right() != fj.Right() {
 						continue
 					}
 				}
-				pi := pins[irow][icol]
-				pj := pins[jrow][jcol]
-				if pi == "#" || pj == "#" {
+				pinI := pins[pi.Row][pi.Col]
+				pinJ := pins[pj.Row][pj.Col]
+				if pinI == "#" || pinJ == "#" {
 					continue
 				}
 				swapped := genkeyInteractive.CopyLayout(bestLayout)
-				ki := swapped.Keys[irow][icol]
-				kj := swapped.Keys[jrow][jcol]
-				if pi == ki || pi == kj || pj == ki || pj == kj {
+				ki := swapped.Keys[pi.Row][pi.Col]
+				kj := swapped.Keys[pj.Row][pj.Col]
+				if pinI == ki || pinI == kj || pinJ == ki || pinJ == kj {
 					continue
 				}
 
-				genkeyGenerate.Swap(swapped, swapped.Keymap.Get(ki), swapped.Keymap.Get(kj))
+				swapped.Swap(swapped.Keymap.Get(ki), swapped.Keymap.Get(kj))
 
 				var swappedScore float64
 				if count != 0 {
-					self.MinimizeLayout(swapped, pins, count-1, false, is33, noCross)
+					self.MinimizeLayout(swapped, pins, count-1, false, noCross)
 					recBestScore := genkeyGenerate.Score(swapped)
 					if recBestScore < bestSoFarScore {
 						bestSoFarScore = recBestScore
@@ -212,131 +329,159 @@ func (self *GenkeyLayout) MinimizeLayout(init *Layout, pins [][]string, count in
 }
 
 func (self *GenkeyLayout) LoadLayout(f string) *Layout {
-	var l Layout
 	b, err := GenkeyReadFile(f)
 	if err != nil {
 		panic(err)
 	}
 
-	s := string(b)
-	lines := strings.Split(s, "\n")
-	if len(lines) < 7 {
-		panic(fmt.Sprintf("WARNING: Layout in file %s is formatted incorrectly, ignoring\n", f))
-	}
-	l.Name = strings.TrimSpace(lines[0])
-	l.Keys = make([][]string, 3)
-	keys := lines[1:4]
-	for line := range keys {
-		separated := true
-		for _, rune := range keys[line] {
-			c := string(rune)
-			c = strings.ToLower(c)
-			if c == " " {
-				separated = true
-				continue
-			} else if !separated {
-				continue
-			} else {
-				separated = false
-				l.Keys[line] = append(l.Keys[line], c)
-				l.Total += float64(self.userData.Data.Letters[c])
-			}
-		}
+	return self.ParseLayout(f, string(b))
+}
+
+// layoutFile is a layout file as read by ReadLayout.
+type layoutFile struct {
+	layout *Layout
+	errs   LayoutErrors
+}
+
+// readLayoutFile reads the layout file at f, never panicking.
+func (self *GenkeyLayout) readLayoutFile(f string) layoutFile {
+	b, err := GenkeyReadFile(f)
+	if err != nil {
+		return layoutFile{nil, LayoutErrors{{File: f, Msg: err.Error()}}}
 	}
-	l.Fingermatrix = make(map[Pos]Finger, 3)
-	l.Fingermap = make(map[Finger][]Pos)
-	for y, row := range lines[4:7] {
-		separated := true
+	l, errs := self.ReadLayout(f, string(b))
+	return layoutFile{l, errs}
+}
 
-		tx := 0
-		for _, c := range strings.Split(strings.TrimSpace(row), "") {
-			if c == " " {
-				separated = true
-				continue
-			} else if !separated {
-				continue
-			}
-			n, err := strconv.Atoi(c)
-			if err != nil {
-				panic(fmt.Sprintf("%s layout fingermatrix is badly formatted!\n%v", f, err))
-			}
-			separated = false
-			fg := Finger(n)
-			l.Fingermatrix[Pos{tx, y}] = fg
-			l.Fingermap[fg] = append(l.Fingermap[fg], Pos{tx, y})
-			tx++
+// LayoutTotal is the number of characters of the corpus typed on keys.
+func (self *GenkeyLayout) LayoutTotal(keys [][]string) float64 {
+	var total float64
+	for _, row := range keys {
+		for _, c := range row {
+			total += float64(self.userData.Data.Letters[c])
 		}
 	}
+	return total
+}
 
-	l.Keymap.Update(self.GenKeymap(l.Keys))
+// spaceKey stands for the space bar in layout files, where keys are
+// separated by spaces.
+const spaceKey = "␣"
 
-	return &l
+// keyLabel is how key is written in layout files and printed.
+func keyLabel(key string) string {
+	if key == " " {
+		return spaceKey
+	}
+	return key
 }
 
+// ParseLayout reads a layout in the text format of the layouts directory:
+// a name, rows of keys and as many rows of the fingers pressing them.
+// Keys past the end of their finger row are not pressed by any finger.
+// Blank lines and any lines after the finger rows are ignored. Layouts
+// starting with { are cmini JSON, see ParseCminiLayout. f only names the
+// source in error messages, and ReadLayout returns them instead.
+func (self *GenkeyLayout) ParseLayout(f string, s string) *Layout {
+	l, errs := self.ReadLayout(f, s)
+	if errs.Fatal() {
+		panic(errs.Error() + "\n")
+	}
+	return l
+}
+
+// LoadLayoutDir fills UserData.Layouts from the layouts directory. Parsed
+// layouts are shared by every session, each session gets copies with the
+// Total of its own corpus. Files with fatal problems are reported and left
+// out, and so are layouts with the name of one before them.
 func (self *GenkeyLayout) LoadLayoutDir() {
 	dir, err := GenkeyOpen(self.userData.Config.Paths.Layouts)
 	if err != nil {
 		panic(fmt.Sprintf("Layouts directory could not be opened at %s\n%v", self.userData.Config.Paths.Layouts, err))
 	}
+	defer dir.Close()
 	files, _ := dir.Readdirnames(0)
+	sort.Strings(files)
+	self.userData.SwapPossibilities = nil
+	// The warnings of checkKeys depend on the generated characters
+	extra := self.userData.Config.Generation.GeneratedLayoutChars
+	names := make(map[string]string) // lower case layout names to their files
 	for _, f := range files {
-		l := self.LoadLayout(filepath.Join(self.userData.Config.Paths.Layouts, f))
-		if l.Name == "" {
+		path := filepath.Join(self.userData.Config.Paths.Layouts, f)
+		file := layoutCache.get(path, extra, func() layoutFile {
+			return self.readLayoutFile(path)
+		})
+		errs, l := file.errs, file.layout
+		if l != nil && !strings.HasPrefix(f, "_") {
+			if other, ok := names[strings.ToLower(l.Name)]; ok {
+				// Not appending to the cached errors
+				errs = append(errs[:len(errs):len(errs)], &LayoutError{path, 1, 0, fmt.Sprintf("[%s] is also the name of %s", l.Name, other), false})
+				l = nil
+			} else {
+				names[strings.ToLower(l.Name)] = path
+			}
+		}
+		self.reportLayoutErrors(path, errs)
+		if l == nil {
 			continue
 		}
+		l = l.Copy()
+		l.Total = self.LayoutTotal(l.Keys)
 		if !strings.HasPrefix(f, "_") {
 			self.userData.Layouts[strings.ToLower(l.Name)] = l
 		} else {
-			self.userData.GeneratedFingermap = l.Fingermap
-			self.userData.GeneratedFingermatrix = l.Fingermatrix
+			self.userData.GeneratedGeometry = l.Geometry
+			self.userData.GeneratedKeys = l.Keys
+			self.userData.GeneratedPositions = nil
 			for y, row := range l.Keys {
 				for x, k := range row {
 					if k == "*" {
 						self.userData.SwapPossibilities = append(self.userData.SwapPossibilities, Pos{x, y})
 					}
+					if generatedKey(k) {
+						self.userData.GeneratedPositions = append(self.userData.GeneratedPositions, Pos{x, y})
+					}
 				}
 			}
 		}
 	}
 }
 
+// reportLayoutErrors sends the problems of the layout file at path, once
+// per session until they change.
+func (self *GenkeyLayout) reportLayoutErrors(path string, errs LayoutErrors) {
+	reported := &self.userData.reportedLayouts
+	text := errs.Error()
+	if (*reported)[path] == text {
+		return
+	}
+	if *reported == nil {
+		*reported = make(map[string]string)
+	}
+	(*reported)[path] = text
+	if len(errs) == 0 {
+		return
+	}
+	self.SendMessage(text + "\n")
+	if errs.Fatal() {
+		self.SendMessage(fmt.Sprintf("ignoring %s\n", path))
+	}
+}
+
 // func NewLayout(name string, keys string) Layout {
 // 	s := strings.Split(keys, "")
 // 	return Layout{name, s, GenKeymap(s), FingerMap}
 // }
 
-func (self *GenkeyLayout) GenKeymap(keys [][]string) map[string]Pos {
-	keymap := make(map[string]Pos)
-	for y, row := range keys {
-		for x, v := range row {
-			keymap[v] = Pos{x, y}
-		}
-	}
-	return keymap
-}
-
 func (self *GenkeyLayout) FingerSpeed(l *Layout, weighted bool) []float64 {
-	speeds := []float64{0, 0, 0, 0, 0, 0, 0, 0}
+	speeds := make([]float64, len(l.Fingermap))
 	weight := &self.userData.Config.Weights
-	sfbweight := weight.FSpeed.SFB
-	dsfbweight := weight.FSpeed.DSFB
+	ids := self.userData.Corpus.FingerIDs(l)
+	coords := self.coords(l)
 	for f, posits := range l.Fingermap {
 		for i := 0; i < len(posits); i++ {
 			for j := i; j < len(posits); j++ {
-				p1 := &posits[i]
-				p2 := &posits[j]
-				k1 := &l.Keys[p1.Row][p1.Col]
-				k2 := &l.Keys[p2.Row][p2.Col]
-
-				sfb := float64(self.userData.Data.Bigrams[*k1+*k2])
-				dsfb := self.userData.Data.Skipgrams[*k1+*k2]
-				if i != j {
-					sfb += float64(self.userData.Data.Bigrams[*k2+*k1])
-					dsfb += self.userData.Data.Skipgrams[*k2+*k1]
-				}
-
-				dist := self.twoKeyDist(*p1, *p2, true) + (2 * weight.FSpeed.KeyTravel)
-				speeds[f] += ((sfbweight * sfb) + (dsfbweight * dsfb)) * dist
+				speeds[f] += self.pairSpeed(coords, posits[i], posits[j], ids[f][i], ids[f][j])
 			}
 		}
 		if weighted {
@@ -347,11 +492,32 @@ func (self *GenkeyLayout) FingerSpeed(l *Layout, weighted bool) []float64 {
 	return speeds
 }
 
+// pairSpeed is the unweighted finger speed cost of two keys pressed by
+// the same finger, in both orders. k1 and k2 are the corpus ids of the
+// keys at p1 and p2, and coords where the keys of the layout are.
+func (self *GenkeyLayout) pairSpeed(coords [][][2]float64, p1, p2 Pos, k1, k2 int) float64 {
+	weight := &self.userData.Config.Weights
+	corpus := self.userData.Corpus
+
+	sfb := float64(corpus.Bigram(k1, k2))
+	dsfb := corpus.Skipgram(k1, k2)
+	if p1 != p2 {
+		sfb += float64(corpus.Bigram(k2, k1))
+		dsfb += corpus.Skipgram(k2, k1)
+	}
+
+	dist := self.twoKeyDist(coords, p1, p2, true) + (2 * weight.FSpeed.KeyTravel)
+	return ((weight.FSpeed.SFB * sfb) + (weight.FSpeed.DSFB * dsfb)) * dist
+}
+
 func (self *GenkeyLayout) DynamicFingerSpeed(l *Layout, weighted bool) []float64 {
-	speeds := []float64{0, 0, 0, 0, 0, 0, 0, 0}
+	speeds := make([]float64, len(l.Fingermap))
 	weight := &self.userData.Config.Weights
 	sfbweight := weight.FSpeed.SFB
 	dsfbweight := weight.FSpeed.DSFB
+	corpus := self.userData.Corpus
+	ids := corpus.FingerIDs(l)
+	coords := self.coords(l)
 	for f, posits := range l.Fingermap {
 		for i := 0; i < len(posits); i++ {
 			var highestsfb float64
@@ -361,13 +527,13 @@ func (self *GenkeyLayout) DynamicFingerSpeed(l *Layout, weighted bool) []float64
 			for j := 0; j < len(posits); j++ {
 				p1 := &posits[i]
 				p2 := &posits[j]
-				k1 := &l.Keys[p1.Row][p1.Col]
-				k2 := &l.Keys[p2.Row][p2.Col]
+				k1 := ids[f][i]
+				k2 := ids[f][j]
 
-				sfb := float64(self.userData.Data.Bigrams[*k1+*k2])
-				dsfb := self.userData.Data.Skipgrams[*k1+*k2]
+				sfb := float64(corpus.Bigram(k1, k2))
+				dsfb := corpus.Skipgram(k1, k2)
 
-				dist := self.twoKeyDist(*p1, *p2, true) + (2 * weight.FSpeed.KeyTravel)
+				dist := self.twoKeyDist(coords, *p1, *p2, true) + (2 * weight.FSpeed.KeyTravel)
 				speed := ((sfbweight * sfb) + (dsfbweight * dsfb)) * dist
 				if sfb > highestsfb {
 					highestsfb = sfb
@@ -391,20 +557,20 @@ func (self *GenkeyLayout) DynamicFingerSpeed(l *Layout, weighted bool) []float64
 
 func (self *GenkeyLayout) SFBs(l *Layout, skipgrams bool) float64 {
 	var count float64
-	for _, posits := range l.Fingermap {
+	corpus := self.userData.Corpus
+	ids := corpus.FingerIDs(l)
+	for f, posits := range l.Fingermap {
 		for i := 0; i < len(posits); i++ {
 			for j := i; j < len(posits); j++ {
 				if i == j {
 					continue
 				}
-				p1 := &posits[i]
-				p2 := &posits[j]
-				k1 := &l.Keys[p1.Row][p1.Col]
-				k2 := &l.Keys[p2.Row][p2.Col]
+				k1 := ids[f][i]
+				k2 := ids[f][j]
 				if !skipgrams {
-					count += float64(self.userData.Data.Bigrams[*k1+*k2] + self.userData.Data.Bigrams[*k2+*k1])
+					count += float64(corpus.Bigram(k1, k2) + corpus.Bigram(k2, k1))
 				} else {
-					count += self.userData.Data.Skipgrams[*k1+*k2] + self.userData.Data.Skipgrams[*k2+*k1]
+					count += corpus.Skipgram(k1, k2) + corpus.Skipgram(k2, k1)
 				}
 			}
 		}
@@ -414,18 +580,16 @@ func (self *GenkeyLayout) SFBs(l *Layout, skipgrams bool) float64 {
 
 func (self *GenkeyLayout) DynamicSFBs(l *Layout) float64 {
 	var count float64
-	for _, posits := range l.Fingermap {
+	corpus := self.userData.Corpus
+	ids := corpus.FingerIDs(l)
+	for f, posits := range l.Fingermap {
 		for i := 0; i < len(posits); i++ {
 			var highest float64
 			for j := 0; j < len(posits); j++ {
 				if i == j {
 					continue
 				}
-				p1 := &posits[i]
-				p2 := &posits[j]
-				k1 := &l.Keys[p1.Row][p1.Col]
-				k2 := &l.Keys[p2.Row][p2.Col]
-				sfb := float64(self.userData.Data.Bigrams[*k1+*k2])
+				sfb := float64(corpus.Bigram(ids[f][i], ids[f][j]))
 				if sfb > highest {
 					highest = sfb
 				}
@@ -450,7 +614,9 @@ func (self *GenkeyLayout) SortFreqList(pairs []FreqPair) {
 
 func (self *GenkeyLayout) ListSFBs(l *Layout, skipgrams bool) []FreqPair {
 	var list []FreqPair
-	for _, posits := range l.Fingermap {
+	corpus := self.userData.Corpus
+	ids := corpus.FingerIDs(l)
+	for f, posits := range l.Fingermap {
 		for i := 0; i < len(posits); i++ {
 			// since this is output, reversed sfbs cannot
 			// be shortcut, so we iterate through all
@@ -467,9 +633,9 @@ func (self *GenkeyLayout) ListSFBs(l *Layout, skipgrams bool) []FreqPair {
 				var count float64
 				ngram := *k1 + *k2
 				if !skipgrams {
-					count = float64(self.userData.Data.Bigrams[ngram])
+					count = float64(corpus.Bigram(ids[f][i], ids[f][j]))
 				} else {
-					count = self.userData.Data.Skipgrams[ngram]
+					count = corpus.Skipgram(ids[f][i], ids[f][j])
 				}
 				list = append(list, FreqPair{ngram, count})
 			}
@@ -486,7 +652,7 @@ func (self *GenkeyLayout) ListDynamic(l *Layout) ([]FreqPair, []FreqPair) {
 	var real []FreqPair
 	highestfound := make(map[Pos]bool)
 	for _, bg := range sfbs {
-		prefix := l.Keymap.Get(string(bg.Ngram[0]))
+		prefix := l.Keymap.Get(string([]rune(bg.Ngram)[0]))
 		if highestfound[prefix] {
 			real = append(real, bg)
 		} else {
@@ -503,6 +669,9 @@ func (self *GenkeyLayout) ListWorstBigrams(l *Layout) []FreqPair {
 	weight := self.userData.Config.Weights
 	sfbweight := weight.FSpeed.SFB
 	dsfbweight := weight.FSpeed.DSFB
+	corpus := self.userData.Corpus
+	ids := corpus.FingerIDs(l)
+	coords := self.coords(l)
 	for f, posits := range l.Fingermap {
 		for i := 0; i < len(posits); i++ {
 			for j := i; j < len(posits); j++ {
@@ -510,14 +679,16 @@ func (self *GenkeyLayout) ListWorstBigrams(l *Layout) []FreqPair {
 				p2 := &posits[j]
 				k1 := &l.Keys[p1.Row][p1.Col]
 				k2 := &l.Keys[p2.Row][p2.Col]
-				sfb := float64(self.userData.Data.Bigrams[*k1+*k2])
-				dsfb := self.userData.Data.Skipgrams[*k1+*k2]
+				id1 := ids[f][i]
+				id2 := ids[f][j]
+				sfb := float64(corpus.Bigram(id1, id2))
+				dsfb := corpus.Skipgram(id1, id2)
 				if i != j {
-					sfb += float64(self.userData.Data.Bigrams[*k2+*k1])
-					dsfb += self.userData.Data.Skipgrams[*k2+*k1]
+					sfb += float64(corpus.Bigram(id2, id1))
+					dsfb += corpus.Skipgram(id2, id1)
 				}
 
-				dist := self.twoKeyDist(*p1, *p2, true) + (2 * weight.FSpeed.KeyTravel)
+				dist := self.twoKeyDist(coords, *p1, *p2, true) + (2 * weight.FSpeed.KeyTravel)
 				cost := 100 * (((sfbweight * sfb) + (dsfbweight * dsfb)) * dist) / weight.FSpeed.KPS[f]
 				bigrams = append(bigrams, FreqPair{*k1 + *k2, cost})
 			}
@@ -537,78 +708,107 @@ type TrigramValues struct {
 	Total             int
 }
 
+type trigramClass int
+
+const (
+	trigramOther trigramClass = iota // contains a same finger bigram
+	trigramLeftInwardRoll
+	trigramLeftOutwardRoll
+	trigramRightInwardRoll
+	trigramRightOutwardRoll
+	trigramAlternate
+	trigramOnehand
+	trigramRedirect
+)
+
+func classifyTrigram(f1, f2, f3 Finger) trigramClass {
+	if f1 == f2 || f2 == f3 {
+		return trigramOther
+	}
+	h1 := f1.Right()
+	h2 := f2.Right()
+	h3 := f3.Right()
+
+	if h1 == h2 && h2 == h3 {
+		dir1 := f1.rollOrder() < f2.rollOrder()
+		dir2 := f2.rollOrder() < f3.rollOrder()
+
+		if dir1 == dir2 {
+			return trigramOnehand
+		}
+		return trigramRedirect
+	} else if h1 != h2 && h2 != h3 {
+		return trigramAlternate
+	}
+
+	rollhand := h2
+	rollfirst := (h1 == rollhand)
+	var first Finger
+	var second Finger
+	if rollfirst {
+		first = f1
+		second = f2
+	} else {
+		first = f2
+		second = f3
+	}
+	if rollhand == false { // left hand
+		if first.rollOrder() < second.rollOrder() { // inward roll
+			return trigramLeftInwardRoll
+		}
+		return trigramLeftOutwardRoll
+	}
+	// right hand
+	if first.rollOrder() > second.rollOrder() { // inward roll
+		return trigramRightInwardRoll
+	}
+	return trigramRightOutwardRoll
+}
+
+// add counts a trigram of the given class. Total is left to the caller,
+// since trigrams with same finger bigrams still count towards it.
+func (tgs *TrigramValues) add(class trigramClass, count int) {
+	switch class {
+	case trigramLeftInwardRoll:
+		tgs.LeftInwardRolls += count
+	case trigramLeftOutwardRoll:
+		tgs.LeftOutwardRolls += count
+	case trigramRightInwardRoll:
+		tgs.RightInwardRolls += count
+	case trigramRightOutwardRoll:
+		tgs.RightOutwardRolls += count
+	case trigramAlternate:
+		tgs.Alternates += count
+	case trigramOnehand:
+		tgs.Onehands += count
+	case trigramRedirect:
+		tgs.Redirects += count
+	}
+}
+
 // FastTrigrams approximates trigram counts with a given precision
 // (precision=0 gives full data). It returns a count of {rolls,
 // alternates, onehands, redirects, total}
 func (self *GenkeyLayout) FastTrigrams(l *Layout, precision int) TrigramValues {
 	var tgs TrigramValues
+	corpus := self.userData.Corpus
 
 	if precision == 0 {
-		precision = len(self.userData.Data.TopTrigrams)
+		precision = len(corpus.Trigrams)
 	}
 
-	for _, tg := range self.userData.Data.TopTrigrams[:min(len(self.userData.Data.TopTrigrams), precision)] {
-		km1, ok1 := l.Keymap.TryGet(string(tg.Ngram[0]))
-		km2, ok2 := l.Keymap.TryGet(string(tg.Ngram[1]))
-		km3, ok3 := l.Keymap.TryGet(string(tg.Ngram[2]))
+	fingers := corpus.KeyFingers(l)
+	for _, tg := range corpus.Trigrams[:min(len(corpus.Trigrams), precision)] {
+		f1 := fingers[tg.Chars[0]]
+		f2 := fingers[tg.Chars[1]]
+		f3 := fingers[tg.Chars[2]]
 
-		if !ok1 || !ok2 || !ok3 {
+		if f1 < 0 || f2 < 0 || f3 < 0 {
 			continue
 		}
 
-		f1 := l.Fingermatrix[km1]
-		f2 := l.Fingermatrix[km2]
-		f3 := l.Fingermatrix[km3]
-
-		tgs.Total += int(tg.Count)
-
-		if f1 != f2 && f2 != f3 {
-			h1 := (f1 >= 4)
-			h2 := (f2 >= 4)
-			h3 := (f3 >= 4)
-
-			if h1 == h2 && h2 == h3 {
-				dir1 := f1 < f2
-				dir2 := f2 < f3
-
-				if dir1 == dir2 {
-					tgs.Onehands += int(tg.Count)
-				} else {
-					tgs.Redirects += int(tg.Count)
-				}
-			} else if h1 != h2 && h2 != h3 {
-				tgs.Alternates += int(tg.Count)
-			} else {
-				rollhand := h2
-				rollfirst := (h1 == rollhand)
-				var first Finger
-				var second Finger
-				if rollfirst {
-					first = f1
-					second = f2
-				} else {
-					first = f2
-					second = f3
-				}
-				if rollhand == false { // left hand
-					if first < second { // inward roll
-						tgs.LeftInwardRolls += int(tg.Count)
-						//println("Left Inward Roll: ", tg.Ngram)
-					} else {
-						tgs.LeftOutwardRolls += int(tg.Count)
-						//println("Left Outward Roll: ", tg.Ngram)
-					}
-				} else if rollhand == true { // right hand
-					if first > second { // inward roll
-						tgs.RightInwardRolls += int(tg.Count)
-						//println("Right Inward Roll: ", tg.Ngram)
-					} else {
-						tgs.RightOutwardRolls += int(tg.Count)
-						//println("Right Outward Roll:", tg.Ngram)
-					}
-				}
-			}
-		}
+		tgs.Total += tg.Count
+		tgs.add(classifyTrigram(f1, f2, f3), tg.Count)
 	}
 
 	return tgs
@@ -618,157 +818,105 @@ func (self *GenkeyLayout) IndexUsage(l *Layout) (float64, float64) {
 	left := 0
 	right := 0
 
+	corpus := self.userData.Corpus
 	for _, pos := range l.Fingermap[3] {
-		key := l.Keys[pos.Row][pos.Col]
-		left += self.userData.Data.Letters[key]
+		left += corpus.Letters[corpus.ID(l.Keys[pos.Row][pos.Col])]
 	}
 	for _, pos := range l.Fingermap[4] {
-		key := l.Keys[pos.Row][pos.Col]
-		right += self.userData.Data.Letters[key]
+		right += corpus.Letters[corpus.ID(l.Keys[pos.Row][pos.Col])]
 	}
 
 	return (100 * float64(left) / l.Total), (100 * float64(right) / l.Total)
 }
 
-func (self *GenkeyLayout) LSBs(l *Layout) int {
-	var count int
-
-	// LI LM
-	for _, p1 := range l.Fingermap[3] {
-		for _, p2 := range l.Fingermap[2] {
-			var dist float64
-			if self.userData.StaggerFlag {
-				dist = math.Abs(self.staggeredX(p1.Col, p1.Row) - self.staggeredX(p2.Col, p2.Row))
-			} else {
-				dist = math.Abs(float64(p1.Col - p2.Col))
-			}
-			if dist >= 2 {
-				k1 := l.Keys[p1.Row][p1.Col]
-				k2 := l.Keys[p2.Row][p2.Col]
-				count += self.userData.Data.Bigrams[k1+k2]
-				count += self.userData.Data.Bigrams[k2+k1]
-			}
-		}
-	}
-
-	// RI RM
-	for _, p1 := range l.Fingermap[4] {
-		for _, p2 := range l.Fingermap[5] {
-			var dist float64
-			if self.userData.StaggerFlag {
-				dist = math.Abs(self.staggeredX(p1.Col, p1.Row) - self.staggeredX(p2.Col, p2.Row))
-			} else {
-				dist = math.Abs(float64(p1.Col - p2.Col))
-			}
-			if dist >= 2 {
-				k1 := l.Keys[p1.Row][p1.Col]
-				k2 := l.Keys[p2.Row][p2.Col]
-				count += self.userData.Data.Bigrams[k1+k2]
-				count += self.userData.Data.Bigrams[k2+k1]
+// lsbFingers are the finger pairs that can form lateral stretch bigrams.
+var lsbFingers = [][2]Finger{{3, 2}, {4, 5}, {0, 1}, {7, 6}}
+
+// LSBPairs lists the position pairs that are lateral stretches, that is
+// neighbouring fingers at least two columns apart.
+func (self *GenkeyLayout) LSBPairs(l *Layout) []Pair {
+	var pairs []Pair
+	coords := self.coords(l)
+	for _, fingers := range lsbFingers {
+		for _, p1 := range l.Fingermap[fingers[0]] {
+			for _, p2 := range l.Fingermap[fingers[1]] {
+				if lateralDist(coords, p1, p2) >= 2 {
+					pairs = append(pairs, Pair{p1, p2})
+				}
 			}
 		}
 	}
+	return pairs
+}
 
-	// LP LR
-	for _, p1 := range l.Fingermap[0] {
-		for _, p2 := range l.Fingermap[1] {
-			var dist float64
-			if self.userData.StaggerFlag {
-				dist = math.Abs(self.staggeredX(p1.Col, p1.Row) - self.staggeredX(p2.Col, p2.Row))
-			} else {
-				dist = math.Abs(float64(p1.Col - p2.Col))
-			}
-			if dist >= 2 {
-				k1 := l.Keys[p1.Row][p1.Col]
-				k2 := l.Keys[p2.Row][p2.Col]
-				count += self.userData.Data.Bigrams[k1+k2]
-				count += self.userData.Data.Bigrams[k2+k1]
-			}
-		}
-	}
+// lsbCount is the bigram count of a lateral stretch pair in both orders.
+// ids are the corpus ids of the keys, as returned by Corpus.KeyIDs.
+func (self *GenkeyLayout) lsbCount(ids [][]int, pair Pair) int {
+	k1 := ids[pair[0].Row][pair[0].Col]
+	k2 := ids[pair[1].Row][pair[1].Col]
+	return self.userData.Corpus.Bigram(k1, k2) + self.userData.Corpus.Bigram(k2, k1)
+}
 
-	// RP RR
-	for _, p1 := range l.Fingermap[7] {
-		for _, p2 := range l.Fingermap[6] {
-			var dist float64
-			if self.userData.StaggerFlag {
-				dist = math.Abs(self.staggeredX(p1.Col, p1.Row) - self.staggeredX(p2.Col, p2.Row))
-			} else {
-				dist = math.Abs(float64(p1.Col - p2.Col))
-			}
-			if dist >= 2 {
-				k1 := l.Keys[p1.Row][p1.Col]
-				k2 := l.Keys[p2.Row][p2.Col]
-				count += self.userData.Data.Bigrams[k1+k2]
-				count += self.userData.Data.Bigrams[k2+k1]
-			}
-		}
+func (self *GenkeyLayout) LSBs(l *Layout) int {
+	var count int
+	ids := self.userData.Corpus.KeyIDs(l)
+	for _, pair := range self.LSBPairs(l) {
+		count += self.lsbCount(ids, pair)
 	}
 	return count
 }
 
 func (self *GenkeyLayout) ListLSBs(l *Layout) []FreqPair {
 	var list []FreqPair
+	corpus := self.userData.Corpus
+	coords := self.coords(l)
 	for _, p1 := range l.Fingermap[3] {
 		for _, p2 := range l.Fingermap[2] {
-			var dist float64
-			if self.userData.StaggerFlag {
-				dist = math.Abs(self.staggeredX(p1.Col, p1.Row) - self.staggeredX(p2.Col, p2.Row))
-			} else {
-				dist = math.Abs(float64(p1.Col - p2.Col))
-			}
-			if dist >= 2 {
+			if lateralDist(coords, p1, p2) >= 2 {
 				k1 := l.Keys[p1.Row][p1.Col]
 				k2 := l.Keys[p2.Row][p2.Col]
-				list = append(list, FreqPair{k1 + k2, float64(self.userData.Data.Bigrams[k1+k2])})
-				list = append(list, FreqPair{k2 + k1, float64(self.userData.Data.Bigrams[k2+k1])})
+				id1 := corpus.ID(k1)
+				id2 := corpus.ID(k2)
+				list = append(list, FreqPair{k1 + k2, float64(corpus.Bigram(id1, id2))})
+				list = append(list, FreqPair{k2 + k1, float64(corpus.Bigram(id2, id1))})
 			}
 		}
 	}
 
 	for _, p1 := range l.Fingermap[4] {
 		for _, p2 := range l.Fingermap[5] {
-			var dist float64
-			if self.userData.StaggerFlag {
-				dist = math.Abs(self.staggeredX(p1.Col, p1.Row) - self.staggeredX(p2.Col, p2.Row))
-			} else {
-				dist = math.Abs(float64(p1.Col - p2.Col))
-			}
-			if dist >= 2 {
+			if lateralDist(coords, p1, p2) >= 2 {
 				k1 := l.Keys[p1.Row][p1.Col]
 				k2 := l.Keys[p2.Row][p2.Col]
-				list = append(list, FreqPair{k1 + k2, float64(self.userData.Data.Bigrams[k1+k2])})
-				list = append(list, FreqPair{k2 + k1, float64(self.userData.Data.Bigrams[k2+k1])})
+				id1 := corpus.ID(k1)
+				id2 := corpus.ID(k2)
+				list = append(list, FreqPair{k1 + k2, float64(corpus.Bigram(id1, id2))})
+				list = append(list, FreqPair{k2 + k1, float64(corpus.Bigram(id2, id1))})
 			}
 		}
 	}
 	return list
 }
 
-func (self *GenkeyLayout) ColRow(pos int) (int, int) {
-	var col int
-	var row int
-	if pos < 10 {
-		col = pos
-		row = 0
-	} else if pos < 20 {
-		col = pos - 10
-		row = 1
-	} else if pos < 30 {
-		col = pos - 20
-		row = 2
+// ColRow returns the column and row of the pos-th key of g, counting by
+// row and then column.
+func (self *GenkeyLayout) ColRow(g *Geometry, pos int) (int, int) {
+	for row, fingers := range g.Fingermatrix {
+		if pos < len(fingers) {
+			return pos, row
+		}
+		pos -= len(fingers)
 	}
-
-	return col, row
+	return 0, 0
 }
 
-func (self *GenkeyLayout) Similarity(a, b []string) int {
+// Similarity scores how many keys two layouts of geometry g share, given
+// by row and then column. Home keys count twice.
+func (self *GenkeyLayout) Similarity(g *Geometry, a, b []string) int {
 	var score int
-	for i := 0; i < 30; i++ {
+	for i, p := range g.Positions() {
 		weight := 1
-		if i >= 10 && i <= 13 {
-			weight = 2
-		} else if i >= 16 && i <= 19 {
+		if g.homeKey(p) {
 			weight = 2
 		}
 		if a[i] == b[i] {
@@ -778,77 +926,118 @@ func (self *GenkeyLayout) Similarity(a, b []string) int {
 	return score
 }
 
+// homeKey reports whether a finger rests on p, that is p is on the home
+// row and is the key of its finger there nearest to the middle finger of
+// the hand.
+func (g *Geometry) homeKey(p Pos) bool {
+	f, ok := g.Finger(p)
+	if !ok || p.Row != g.HomeRow || f >= LT {
+		return false
+	}
+	middle := Finger(2)
+	if f.Right() {
+		middle = 5
+	}
+	home := -1
+	for x, fx := range g.Fingermatrix[p.Row] {
+		if fx == f && (home < 0 || g.middleDist(x, middle) < g.middleDist(home, middle)) {
+			home = x
+		}
+	}
+	return home == p.Col
+}
+
+// middleDist is how many columns of the home row x is from the nearest
+// key of the middle finger.
+func (g *Geometry) middleDist(x int, middle Finger) int {
+	dist := math.MaxInt
+	for _, p := range g.Fingermap[middle] {
+		if p.Row == g.HomeRow {
+			dist = min(dist, max(x-p.Col, p.Col-x))
+		}
+	}
+	return dist
+}
+
+// minExpectedShare is how common a letter of the corpus must be for layouts
+// to be expected to have it, so that stray letters are not reported.
+const minExpectedShare = 0.0001
+
+// ExpectedChars are the characters a layout should have: those the
+// generator places, then every other letter of the corpus by frequency.
+func (self *GenkeyLayout) ExpectedChars() []string {
+	expected := splitChars(normalize(self.userData.Config.Generation.GeneratedLayoutChars))
+	seen := make(map[string]bool)
+	for _, c := range expected {
+		seen[c] = true
+	}
+
+	data := &self.userData.Data
+	var total int
+	for _, n := range data.Letters {
+		total += n
+	}
+	var letters []string
+	for c, n := range data.Letters {
+		r := []rune(c)
+		if !seen[c] && len(r) == 1 && unicode.IsLetter(r[0]) && float64(n) >= minExpectedShare*float64(total) {
+			letters = append(letters, c)
+		}
+	}
+	sort.Slice(letters, func(i, j int) bool {
+		a, b := data.Letters[letters[i]], data.Letters[letters[j]]
+		if a != b {
+			return a > b
+		}
+		return letters[i] < letters[j]
+	})
+	return append(expected, letters...)
+}
+
+// DuplicatesAndMissing lists the keys l has more than once and the
+// ExpectedChars it lacks.
 func (self *GenkeyLayout) DuplicatesAndMissing(l *Layout) ([]string, []string) {
 	counts := make(map[string]int)
-	// collect counts of each key
+	var keys []string
 	for _, row := range l.Keys {
 		for _, c := range row {
+			if counts[c] == 0 {
+				keys = append(keys, c)
+			}
 			counts[c] += 1
 		}
 	}
-	// then check duplicates and missing
+
 	duplicates := make([]string, 0)
+	for _, c := range keys {
+		if counts[c] > 1 && strings.TrimSpace(c) != "" {
+			duplicates = append(duplicates, c)
+		}
+	}
 	missing := make([]string, 0)
-	for _, r := range []rune("abcdefghijklmnopqrstuvwxyz,./;'") {
-		c := string(r)
+	for _, c := range self.ExpectedChars() {
 		if counts[c] == 0 {
 			missing = append(missing, c)
-		} else if counts[c] > 1 {
-			duplicates = append(duplicates, c)
 		}
 	}
 	return duplicates, missing
 }
 
-func (self *GenkeyLayout) staggeredX(c, r int) float64 {
-	var sx float64
-	if r == 0 {
-		sx = float64(c) - 0.25
-	} else if r == 2 {
-		sx = float64(c) + 0.5
-	} else {
-		sx = float64(c)
-	}
-	return sx
+// coords returns where the keys of l are on the session keyboard.
+func (self *GenkeyLayout) coords(l *Layout) [][][2]float64 {
+	return l.Coords(self.userData.Keyboard)
 }
 
-func (self *GenkeyLayout) staggeredY(c, r int) float64 {
-	config := &self.userData.Config
-	var sy float64
-	if c < 10 {
-		sy = float64(r) - config.Weights.ColStaggers[c]
-	} else if c >= 10 {
-		// Unsure if pinky stagger being the same is guaranteed
-		sy = float64(r) - config.Weights.ColStaggers[9]
-	}
-	return sy
+// lateralDist is how far apart a and b are across the keyboard.
+func lateralDist(coords [][][2]float64, a, b Pos) float64 {
+	return math.Abs(coords[a.Row][a.Col][0] - coords[b.Row][b.Col][0])
 }
 
-func (self *GenkeyLayout) twoKeyDist(a, b Pos, weighted bool) float64 {
-	var ax float64
-	var bx float64
-	var ay float64
-	var by float64
-	userData := self.userData
-
-	if self.userData.StaggerFlag {
-		ax = self.staggeredX(a.Col, a.Row)
-		bx = self.staggeredX(b.Col, b.Row)
-	} else {
-		ax = float64(a.Col)
-		bx = float64(b.Col)
-	}
-
-	if userData.ColStaggerFlag {
-		ay = self.staggeredY(a.Col, a.Row)
-		by = self.staggeredY(b.Col, b.Row)
-	} else {
-		ay = float64(a.Row)
-		by = float64(b.Row)
-	}
-
-	x := ax - bx
-	y := ay - by
+// twoKeyDist is the distance between a and b on the session keyboard, or
+// with weighted its square with lateral movement weighted.
+func (self *GenkeyLayout) twoKeyDist(coords [][][2]float64, a, b Pos, weighted bool) float64 {
+	x := coords[a.Row][a.Col][0] - coords[b.Row][b.Col][0]
+	y := coords[a.Row][a.Col][1] - coords[b.Row][b.Col][1]
 
 	var dist float64
 	if weighted {
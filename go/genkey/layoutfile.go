@@ -0,0 +1,274 @@
+package genkey
+
+import (
+	"encoding/json"
+	"fmt"
+	"path/filepath"
+	"strings"
+	"unicode"
+)
+
+// LayoutError is a problem of a layout file at a line and column, both
+// counted from 1, or 0 when it is not at one place.
+type LayoutError struct {
+	File    string `json:"file"`
+	Line    int    `json:"line"`
+	Column  int    `json:"column"`
+	Msg     string `json:"msg"`
+	Warning bool   `json:"warning"` // the layout is usable anyway
+}
+
+func (e *LayoutError) Error() string {
+	var sb strings.Builder
+	sb.WriteString(e.File)
+	if e.Line > 0 {
+		sb.WriteString(fmt.Sprintf(":%d", e.Line))
+		if e.Column > 0 {
+			sb.WriteString(fmt.Sprintf(":%d", e.Column))
+		}
+	}
+	sb.WriteString(": ")
+	if e.Warning {
+		sb.WriteString("warning: ")
+	}
+	sb.WriteString(e.Msg)
+	return sb.String()
+}
+
+// LayoutErrors are the problems of one layout file.
+type LayoutErrors []*LayoutError
+
+func (errs LayoutErrors) Error() string {
+	lines := make([]string, len(errs))
+	for i, e := range errs {
+		lines[i] = e.Error()
+	}
+	return strings.Join(lines, "\n")
+}
+
+// Fatal reports whether any of errs is not a warning.
+func (errs LayoutErrors) Fatal() bool {
+	for _, e := range errs {
+		if !e.Warning {
+			return true
+		}
+	}
+	return false
+}
+
+// layoutField is a field of a layout file and where it starts.
+type layoutField struct {
+	text   string
+	line   int
+	column int
+}
+
+// layoutRows splits the lines after the first of s into fields, leaving
+// out blank lines.
+func layoutRows(s string) [][]layoutField {
+	var rows [][]layoutField
+	for n, line := range strings.Split(s, "\n")[1:] {
+		var row []layoutField
+		start, startColumn, column := -1, 0, 0
+		for i, r := range line + " " {
+			column++
+			if !unicode.IsSpace(r) {
+				if start < 0 {
+					start, startColumn = i, column
+				}
+				continue
+			}
+			if start >= 0 {
+				row = append(row, layoutField{normalize(line[start:i]), n + 2, startColumn})
+				start = -1
+			}
+		}
+		if len(row) > 0 {
+			rows = append(rows, row)
+		}
+	}
+	return rows
+}
+
+// fingerShare is how many fields of row are fingers.
+func fingerShare(row []layoutField) float64 {
+	fingers := 0
+	for _, field := range row {
+		if _, err := ParseFinger(field.text); err == nil {
+			fingers++
+		}
+	}
+	return float64(fingers) / float64(len(row))
+}
+
+// ReadLayout reads a layout like ParseLayout, returning every problem of
+// it. The layout is nil when any problem is fatal. Files starting with _
+// are templates of generate, whose generated keys may repeat and keep
+// their marker as it is written.
+func (self *GenkeyLayout) ReadLayout(f string, s string) (*Layout, LayoutErrors) {
+	if strings.HasPrefix(strings.TrimSpace(s), "{") {
+		return self.ParseCminiLayout(f, []byte(s))
+	}
+	var errs LayoutErrors
+	fail := func(line, column int, format string, a ...any) {
+		errs = append(errs, &LayoutError{f, line, column, fmt.Sprintf(format, a...), false})
+	}
+	warn := func(line, column int, format string, a ...any) {
+		errs = append(errs, &LayoutError{f, line, column, fmt.Sprintf(format, a...), true})
+	}
+
+	name := normalize(strings.TrimSpace(strings.SplitN(s, "\n", 2)[0]))
+	if name == "" {
+		fail(1, 0, "the first line needs the name of the layout")
+	}
+	rows := layoutRows(s)
+	template := strings.HasPrefix(filepath.Base(f), "_")
+
+	// The first row count followed by as many rows of fingers
+	n := 0
+	for i := 1; 2*i <= len(rows) && n == 0; i++ {
+		n = i
+		for _, row := range rows[i : 2*i] {
+			if fingerShare(row) < 1 {
+				n = 0
+				break
+			}
+		}
+	}
+	if n == 0 {
+		// Rows mostly of fingers are rows of fingers with mistakes
+		start := 1
+		for start < len(rows) && fingerShare(rows[start]) < 0.5 {
+			start++
+		}
+		if start >= len(rows) {
+			fail(0, 0, "it needs rows of keys followed by a row of fingers for each")
+			return nil, errs
+		}
+		end, before := start, len(errs)
+		for end < len(rows) && fingerShare(rows[end]) >= 0.5 {
+			for _, field := range rows[end] {
+				if _, err := ParseFinger(field.text); err != nil {
+					fail(field.line, field.column, "%v", err)
+				}
+			}
+			end++
+		}
+		if len(errs) == before {
+			fail(rows[start][0].line, 0, "%d rows of keys need as many rows of fingers, found %d", start, end-start)
+		}
+		return nil, errs
+	}
+
+	keys := make([][]string, n)
+	fingermatrix := make([][]Finger, n)
+	for y, row := range rows[:n] {
+		for _, field := range row {
+			chars := splitChars(field.text)
+			k := strings.ToLower(chars[0])
+			if field.text == spaceKey {
+				k = " "
+			} else if template && generatedKey(field.text) {
+				k = field.text
+			} else if len(chars) > 1 {
+				fail(field.line, field.column, "key [%s] is more than one character", field.text)
+			}
+			keys[y] = append(keys[y], k)
+		}
+		fingers := rows[n+y]
+		for _, field := range fingers {
+			fg, _ := ParseFinger(field.text)
+			fingermatrix[y] = append(fingermatrix[y], fg)
+		}
+		if len(fingers) > len(row) {
+			extra := fingers[len(row)]
+			fail(extra.line, extra.column, "%d fingers for the %d keys of line %d", len(fingers), len(row), row[0].line)
+		} else if len(fingers) < len(row) {
+			// The keys past the end of the fingers stay where they are
+			first := row[len(fingers)]
+			warn(first.line, first.column, "%d keys but %d fingers on line %d, [%s] has no finger", len(row), len(fingers), fingers[0].line, first.text)
+		}
+	}
+
+	errs = append(errs, self.checkKeys(f, keys, rows[:n])...)
+	if errs.Fatal() {
+		return nil, errs
+	}
+	return NewLayout(name, keys, NewGeometry(fingermatrix), self.LayoutTotal(keys)), errs
+}
+
+// checkKeys warns of the keys on the layout twice and the letters of
+// Generation.GeneratedLayoutChars it lacks. fields are where the keys are
+// in the file, or nil.
+func (self *GenkeyLayout) checkKeys(f string, keys [][]string, fields [][]layoutField) LayoutErrors {
+	var errs LayoutErrors
+	warn := func(line, column int, format string, a ...any) {
+		errs = append(errs, &LayoutError{f, line, column, fmt.Sprintf(format, a...), true})
+	}
+	template := strings.HasPrefix(filepath.Base(f), "_")
+	at := func(p Pos) (int, int) {
+		if fields == nil {
+			return 0, 0
+		}
+		return fields[p.Row][p.Col].line, fields[p.Row][p.Col].column
+	}
+
+	seen := make(map[string]Pos)
+	for y, row := range keys {
+		for x, k := range row {
+			first, ok := seen[k]
+			if !ok {
+				seen[k] = Pos{x, y}
+				continue
+			}
+			if k == " " || k == cminiFreeKey || (template && generatedKey(k)) {
+				continue
+			}
+			line, column := at(Pos{x, y})
+			if firstLine, firstColumn := at(first); firstLine > 0 {
+				warn(line, column, "[%s] is on the layout twice, first on line %d column %d", k, firstLine, firstColumn)
+			} else {
+				warn(line, column, "[%s] is on the layout twice", k)
+			}
+		}
+	}
+
+	if template {
+		return errs
+	}
+	var missing []string
+	for _, c := range splitChars(normalize(self.userData.Config.Generation.GeneratedLayoutChars)) {
+		r := []rune(c)
+		if _, ok := seen[c]; !ok && unicode.IsLetter(r[0]) {
+			missing = append(missing, c)
+		}
+	}
+	if len(missing) > 0 {
+		warn(0, 0, "it has no %s", strings.Join(missing, " "))
+	}
+	return errs
+}
+
+// jsonErrorAt is the line and column of the JSON error err in b, or 0 when
+// it is not at one place.
+func jsonErrorAt(b []byte, err error) (int, int) {
+	var offset int64
+	switch e := err.(type) {
+	case *json.SyntaxError:
+		offset = e.Offset
+	case *json.UnmarshalTypeError:
+		offset = e.Offset
+	default:
+		return 0, 0
+	}
+	offset = min(offset, int64(len(b)))
+	line, column := 1, 1
+	for _, r := range string(b[:offset]) {
+		if r == '\n' {
+			line, column = line+1, 1
+		} else {
+			column++
+		}
+	}
+	return line, column
+}
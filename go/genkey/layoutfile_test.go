@@ -0,0 +1,68 @@
+package genkey
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestReadLayout(t *testing.T) {
+	userData := &UserData{Data: testCorpus()}
+	userData.Config.Generation.GeneratedLayoutChars = "abé"
+	g := NewGenkeyLayout(&textCapture{}, userData)
+
+	tests := []struct {
+		f    string
+		s    string
+		keys [][]string // nil when the layout cannot be read
+		errs []string
+	}{
+		{"ok", "ok\na b\n\n é ␣\n0 1\n3  9", [][]string{{"a", "b"}, {"é", " "}}, nil},
+		{"names", "names\na b é\nLP lr 9", [][]string{{"a", "b", "é"}}, nil},
+		// Keys past the end of their fingers are pressed by none
+		{"short", "short\na b é\nx y\n0 1\n2 3", [][]string{{"a", "b", "é"}, {"x", "y"}},
+			[]string{"short:2:5: warning: 3 keys but 2 fingers on line 4, [é] has no finger"}},
+		{"long", "long\na b é\n0 1 2 3", nil,
+			[]string{"long:3:7: 4 fingers for the 3 keys of line 2"}},
+		{"finger", "finger\na b é\nx y z\n0 1 2\n3 11 4", nil,
+			[]string{"finger:5:3: [11] is not a finger, expected 0 to 9 or one of LP LR LM LI RI RM RR RP LT RT"}},
+		{"rows", "rows\na b é\nx y z\n0 1 2", nil,
+			[]string{"rows:4: 2 rows of keys need as many rows of fingers, found 1"}},
+		{"no fingers", "no fingers\na b é", nil,
+			[]string{"no fingers: it needs rows of keys followed by a row of fingers for each"}},
+		{"twice", "twice\na b é\nc  a\n0 1 2\n3 4", [][]string{{"a", "b", "é"}, {"c", "a"}},
+			[]string{"twice:3:4: warning: [a] is on the layout twice, first on line 2 column 1"}},
+		{"missing", "missing\na c\n0 1", [][]string{{"a", "c"}},
+			[]string{"missing: warning: it has no b é"}},
+		// Warnings do not keep a layout with errors from failing
+		{"both", "both\na cd a\n0 1 2", nil, []string{
+			"both:2:3: key [cd] is more than one character",
+			"both:2:6: warning: [a] is on the layout twice, first on line 2 column 1",
+			"both: warning: it has no b é"}},
+		{"", "\na b é\n0 1 2", nil, []string{":1: the first line needs the name of the layout"}},
+		// Generated keys of templates keep their marker and may repeat
+		{"layouts/_generate", "template\nX * x\nX * ␣\n0 1 2\n3 4 9", [][]string{{"X", "*", "x"}, {"X", "*", " "}}, nil},
+		// Elsewhere X is the letter x
+		{"layouts/X", "X\nX * x\n0 1 2", [][]string{{"x", "*", "x"}}, []string{
+			"layouts/X:2:5: warning: [x] is on the layout twice, first on line 2 column 1",
+			"layouts/X: warning: it has no a b é"}},
+	}
+	for _, tt := range tests {
+		l, errs := g.ReadLayout(tt.f, tt.s)
+		got := make([]string, len(errs))
+		for i, e := range errs {
+			got[i] = e.Error()
+		}
+		if tt.errs == nil {
+			tt.errs = []string{}
+		}
+		if !reflect.DeepEqual(got, tt.errs) {
+			t.Errorf("%s: got errors %q, want %q", tt.f, got, tt.errs)
+		}
+		if errs.Fatal() != (tt.keys == nil) {
+			t.Errorf("%s: fatal %v with keys %v", tt.f, errs.Fatal(), tt.keys)
+		}
+		if (l == nil) != (tt.keys == nil) || l != nil && !reflect.DeepEqual(l.Keys, tt.keys) {
+			t.Errorf("%s: got layout %v, want keys %v", tt.f, l, tt.keys)
+		}
+	}
+}
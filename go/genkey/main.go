@@ -15,11 +15,10 @@ Copyright (C) 2024 semi
 package genkey
 
 import (
-	"errors"
+	"encoding/json"
 	"flag"
 	"fmt"
-	"os"
-	"path/filepath"
+	"io"
 	"sort"
 	"strconv"
 	"strings"
@@ -34,7 +33,6 @@ const (
 	NullArg Argument = iota
 	LayoutArg
 	NgramArg
-	PathArg
 )
 
 type Command struct {
@@ -45,10 +43,26 @@ type Command struct {
 }
 
 var Commands = []Command{
+	{
+		Names:       []string{"corpus"},
+		Description: "lists the available corpora, or switches this session to another one or a blend: corpus (name | name:70 name:30)",
+		Arg:         NullArg,
+	},
+	{
+		Names:       []string{"keyboard"},
+		Description: "lists the keyboard profiles distances are measured on, or switches this session to another one: keyboard (name)",
+		Arg:         NullArg,
+	},
+	{
+		Names:       []string{"corpus-stats"},
+		Description: "summarizes the corpus: sizes, entropy, coverage and the most frequent ngrams",
+		Arg:         NullArg,
+		CountArg:    true,
+	},
 	{
 		Names:       []string{"load"},
-		Description: "loads a text file as a corpus",
-		Arg:         PathArg,
+		Description: "uploads text as the corpus of this session: load begin name, load data text..., load end (load clear to undo)",
+		Arg:         NullArg,
 	},
 	{
 		Names:       []string{"rank", "r"},
@@ -70,6 +84,11 @@ var Commands = []Command{
 		Description: "attempts to generate an optimal layout based on weights.hjson",
 		Arg:         NullArg,
 	},
+	{
+		Names:       []string{"cancel"},
+		Description: "aborts the running command, generate and improve report their best layout so far",
+		Arg:         NullArg,
+	},
 	{
 		Names:       []string{"improve"},
 		Description: "attempts to improve a layout according to the restrictions in layouts/_generate",
@@ -104,6 +123,16 @@ var Commands = []Command{
 		Arg:         LayoutArg,
 		CountArg:    true,
 	},
+	{
+		Names:       []string{"cmini"},
+		Description: "outputs a layout in the JSON format of cmini",
+		Arg:         LayoutArg,
+	},
+	{
+		Names:       []string{"export"},
+		Description: "export (qmk|zmk|xkb|klc) layout: outputs a layout as a keymap, last being the latest generated or edited one",
+		Arg:         NullArg,
+	},
 	{
 		Names:       []string{"bigrams"},
 		Description: "lists the worst key pair relationships",
@@ -112,17 +141,51 @@ var Commands = []Command{
 	},
 	{
 		Names:       []string{"ngram"},
-		Description: "lists the frequency of a given ngram",
+		Description: "lists the frequency of a given ngram, or the ngrams matching a pattern like t?e, *h or [aeiou][st]",
 		Arg:         NgramArg,
+		CountArg:    true,
 	},
 }
 
 type GenkeyMain struct {
-	conn     *websocket.Conn
+	conn     Conn
 	userData *UserData
+	result   any
 }
 
-func NewGenkeyMain(conn *websocket.Conn, cachedUserData *UserData) *GenkeyMain {
+type RankEntry struct {
+	Name  string  `json:"name"`
+	Score float64 `json:"score"`
+}
+
+type GenerateResult struct {
+	Layout    Analysis       `json:"layout"`
+	Compared  map[string]int `json:"compared,omitempty"` // percent of optimal
+	Cancelled bool           `json:"cancelled,omitempty"`
+	Manifest  *RunManifest   `json:"manifest"`
+}
+
+type FreqListResult struct {
+	Total  float64     `json:"total,omitempty"`
+	Ngrams []NgramFreq `json:"ngrams"`
+}
+
+type SpeedResult struct {
+	Unweighted []float64 `json:"unweighted"`
+	Weighted   []float64 `json:"weighted"`
+}
+
+type NgramResult struct {
+	Ngram    string   `json:"ngram"`
+	Unigram  *float64 `json:"unigram,omitempty"`
+	Bigram   *float64 `json:"bigram,omitempty"`
+	Skipgram *float64 `json:"skipgram,omitempty"`
+	Trigram  *float64 `json:"trigram,omitempty"`
+
+	Pattern []NgramMatches `json:"pattern,omitempty"` // for patterns and ngrams longer than 3, by length
+}
+
+func NewGenkeyMain(conn Conn, cachedUserData *UserData) *GenkeyMain {
 	var userData *UserData
 	if cachedUserData == nil {
 		userData = &UserData{}
@@ -140,11 +203,25 @@ func (self *GenkeyMain) SendMessage(s string) {
 	self.conn.WriteMessage(websocket.TextMessage, []byte(s))
 }
 
+// getLayout finds a layout by name. last is the latest layout generated,
+// improved or edited interactively, unless a layout is named so.
 func (self *GenkeyMain) getLayout(s string) *Layout {
 	s = strings.ToLower(s)
 	if l, ok := self.userData.Layouts[s]; ok {
 		return l
 	}
+	if s == "last" {
+		if self.userData.LastLayout == nil {
+			self.SendMessage("there is no last layout yet, run generate, improve or interactive first\n")
+			return nil
+		}
+		l := self.userData.LastLayout.Copy()
+		if l.Name == "" {
+			l.Name = "last"
+		}
+		l.Total = NewGenkeyLayout(self.conn, self.userData).LayoutTotal(l.Keys)
+		return l
+	}
 	self.SendMessage(fmt.Sprintf("layout [%s] was not found\n", s))
 	return nil
 }
@@ -159,6 +236,9 @@ func (self *GenkeyMain) runCommand(args []string) {
 		self.usage()
 		return
 	}
+	// Only improve improves, the commands after it generate again
+	self.userData.ImproveFlag = false
+	self.userData.ImproveLayout = nil
 
 	for _, command := range Commands {
 		matches := false
@@ -173,18 +253,20 @@ func (self *GenkeyMain) runCommand(args []string) {
 		}
 		cmd = command.Names[0]
 		if command.Arg == NullArg {
+			if command.CountArg && len(args) == 2 {
+				num, ok := self.parseCount(args[1])
+				if !ok {
+					return
+				}
+				count = num
+			}
 			break
 		}
 		if len(args) == 1 {
 			self.commandUsage(&command)
 			return
 		}
-		if command.Arg == PathArg {
-			if _, err := os.Stat(args[1]); errors.Is(err, os.ErrNotExist) {
-				self.SendMessage(fmt.Sprintf("file [%s] does not exist\n", args[1]))
-				return
-			}
-		} else if command.Arg == NgramArg {
+		if command.Arg == NgramArg {
 			ngram = &args[1]
 		} else if command.Arg == LayoutArg {
 			layout = self.getLayout(args[1])
@@ -193,9 +275,8 @@ func (self *GenkeyMain) runCommand(args []string) {
 			}
 		}
 		if command.CountArg && len(args) == 3 {
-			num, err := strconv.Atoi(args[2])
-			if err != nil {
-				self.SendMessage(fmt.Sprintf("optional count argument must be a number, not [%s]\n", args[2]))
+			num, ok := self.parseCount(args[2])
+			if !ok {
 				return
 			}
 			count = num
@@ -205,17 +286,22 @@ func (self *GenkeyMain) runCommand(args []string) {
 	if cmd == "" {
 		self.usage()
 	}
-	if cmd == "load" {
-		self.SendMessage("Unsupported command in demo mode")
-
-		//genkeyText := GenkeyText{self.conn}
-		//Data = genkeyText.GetTextData(*path)
-		//name := filepath.Base(*path)
-		//name = name[:len(name)-len(filepath.Ext(name))]
-		//name = name + ".json"
-		//outpath := filepath.Join(self.userData.Config.Paths.Corpora, name)
-		//println(outpath)
-		//genkeyText.WriteData(Data, outpath)
+	if cmd == "rank" || cmd == "analyze" || cmd == "generate" || cmd == "improve" || cmd == "corpus-stats" {
+		sendCorpus(self.conn, self.userData.CorpusName())
+	}
+	if cmd == "corpus" {
+		self.corpus(args)
+	} else if cmd == "keyboard" {
+		self.keyboard(args)
+	} else if cmd == "load" {
+		self.load(args)
+	} else if cmd == "corpus-stats" {
+		if count == 0 {
+			count = self.userData.Config.Output.Misc.TopNgrams
+		}
+		stats := self.CorpusStats(count)
+		self.printCorpusStats(&stats)
+		self.result = stats
 	} else if cmd == "rank" {
 		type x struct {
 			name  string
@@ -232,15 +318,25 @@ func (self *GenkeyMain) runCommand(args []string) {
 			return sorted[i].score < sorted[j].score
 		})
 
+		ranking := make([]RankEntry, 0, len(sorted))
 		for _, l := range sorted {
-			spaces := strings.Repeat(self.userData.Config.Output.Rank.Spacer, 1+self.userData.LongestLayoutName-len(l.name))
+			spaces := strings.Repeat(self.userData.Config.Output.Rank.Spacer, 1+self.userData.LongestLayoutName-charWidth(l.name))
 			self.SendMessage(fmt.Sprintf("%s%s%.2f\n", l.name, spaces, l.score))
+			ranking = append(ranking, RankEntry{l.name, l.score})
 		}
+		self.result = ranking
 	} else if cmd == "analyze" {
-		NewGenkeyOutput(self.conn, self.userData).PrintAnalysis(layout)
+		self.result = NewGenkeyOutput(self.conn, self.userData).PrintAnalysis(layout)
 	} else if cmd == "generate" {
+		release, ok := acquireJob(self.conn, self.userData)
+		if !ok {
+			return
+		}
+		defer release()
 		genkeyGenerate := NewGenkeyGenerate(self.conn, self.userData)
-		best := genkeyGenerate.Populate(self.userData.Config.Generation.InitialPopulation)
+		seed := self.userData.runSeed()
+		population := self.userData.Config.Generation.InitialPopulation
+		best := genkeyGenerate.Populate(population, seed)
 		optimal := genkeyGenerate.Score(best)
 
 		type x struct {
@@ -258,29 +354,50 @@ func (self *GenkeyMain) runCommand(args []string) {
 			return sorted[i].score < sorted[j].score
 		})
 
+		compared := make(map[string]int)
 		for _, l := range sorted {
-			spaces := strings.Repeat(self.userData.Config.Output.Rank.Spacer, 1+self.userData.LongestLayoutName-len(l.name))
-			self.SendMessage(
-				fmt.Sprintf("%s%s%d%%\n", l.name, spaces, int(100*optimal/(genkeyGenerate.Score(self.userData.Layouts[l.name])))),
-			)
+			spaces := strings.Repeat(self.userData.Config.Output.Rank.Spacer, 1+self.userData.LongestLayoutName-charWidth(l.name))
+			percent := int(100 * optimal / (genkeyGenerate.Score(self.userData.Layouts[l.name])))
+			self.SendMessage(fmt.Sprintf("%s%s%d%%\n", l.name, spaces, percent))
+			compared[l.name] = percent
 		}
+		self.userData.LastLayout = best
+		manifest := self.runManifest("generate", "", seed, population, optimal)
+		self.sendSeed(manifest)
+		self.result = GenerateResult{NewGenkeyOutput(self.conn, self.userData).Analyze(best), compared, self.userData.Cancelled(), manifest}
+	} else if cmd == "cancel" {
+		// Cancel requests are handled by the connection while a command is
+		// running, so reaching this means there was nothing to cancel.
+		self.SendMessage("nothing to cancel\n")
 	} else if cmd == "interactive" {
-		NewGenkeyInteractive(self.conn, self.userData).InteractiveInitial(layout)
+		genkeyInteractive := NewGenkeyInteractive(self.conn, self.userData)
+		genkeyInteractive.InteractiveInitial(layout)
+		self.userData.LastLayout = self.userData.Interactive.Layout
+		self.result = genkeyInteractive.State()
 
 	} else if cmd == "heatmap" {
 		self.SendMessage("Unsupported command in demo mode")
 		// NewGenkeyOutput(self.conn, self.userData).Heatmap(*layout)
 	} else if cmd == "improve" {
+		release, ok := acquireJob(self.conn, self.userData)
+		if !ok {
+			return
+		}
+		defer release()
 		genkeyGenerate := NewGenkeyGenerate(self.conn, self.userData)
 		self.userData.ImproveFlag = true
 		self.userData.ImproveLayout = layout
-		// best := genkeyGenerate.Populate(1000)
-		best := genkeyGenerate.Populate(500)
+		seed := self.userData.runSeed()
+		// best := genkeyGenerate.Populate(1000, seed)
+		best := genkeyGenerate.Populate(500, seed)
 		optimal := genkeyGenerate.Score(best)
 
-		self.SendMessage(
-			fmt.Sprintf("%s %d%%\n", layout.Name, int(100*optimal/(NewGenkeyGenerate(self.conn, self.userData).Score(self.userData.ImproveLayout)))),
-		)
+		percent := int(100 * optimal / (NewGenkeyGenerate(self.conn, self.userData).Score(self.userData.ImproveLayout)))
+		self.SendMessage(fmt.Sprintf("%s %d%%\n", layout.Name, percent))
+		self.userData.LastLayout = best
+		manifest := self.runManifest("improve", layout.Name, seed, 500, optimal)
+		self.sendSeed(manifest)
+		self.result = GenerateResult{NewGenkeyOutput(self.conn, self.userData).Analyze(best), map[string]int{layout.Name: percent}, self.userData.Cancelled(), manifest}
 	} else if cmd == "sfbs" || cmd == "dsfbs" || cmd == "lsbs" || cmd == "bigrams" {
 		genkeyLayout := NewGenkeyLayout(self.conn, self.userData)
 		var total float64
@@ -306,7 +423,9 @@ func (self *GenkeyMain) runCommand(args []string) {
 		if total != 0.0 {
 			self.SendMessage(fmt.Sprintf("%.2f%%\n", total))
 		}
-		NewGenkeyOutput(self.conn, self.userData).PrintFreqList(list, count, true)
+		genkeyOutput := NewGenkeyOutput(self.conn, self.userData)
+		genkeyOutput.PrintFreqList(list, count, true)
+		self.result = FreqListResult{total, genkeyOutput.FreqListPercent(list, count)}
 	} else if cmd == "speed" {
 		genkeyLayout := NewGenkeyLayout(self.conn, self.userData)
 		unweighted := genkeyLayout.FingerSpeed(layout, false)
@@ -320,31 +439,78 @@ func (self *GenkeyMain) runCommand(args []string) {
 		for i, v := range weighted {
 			self.SendMessage(fmt.Sprintf("\t%s: %.2f\n", FingerNames[i], v))
 		}
+		self.result = SpeedResult{unweighted, weighted}
+	} else if cmd == "cmini" {
+		c, err := NewGenkeyLayout(self.conn, self.userData).ExportCmini(layout)
+		if err != nil {
+			self.SendMessage(err.Error() + "\n")
+			return
+		}
+		b, err := json.MarshalIndent(c, "", "    ")
+		if err != nil {
+			panic(err)
+		}
+		self.SendMessage(string(b) + "\n")
+		self.result = c
+	} else if cmd == "export" {
+		self.export(args)
 	} else if cmd == "ngram" {
+		pattern, err := ParseNgramPattern(*ngram)
+		if err != nil {
+			self.SendMessage(err.Error() + "\n")
+			return
+		}
+		if count == 0 {
+			count = self.userData.Config.Output.Misc.TopNgrams
+		}
+		if !pattern.Exact() || pattern.Len() > 3 {
+			matches := self.QueryNgrams(pattern, count)
+			self.printNgramMatches(matches)
+			self.result = NgramResult{Ngram: *ngram, Pattern: matches}
+			return
+		}
+
 		total := float64(self.userData.Data.Total)
-		ngram := *ngram
-		switch len(ngram) {
+		ngram := pattern.String()
+		result := NgramResult{Ngram: ngram}
+		switch pattern.Len() {
 		case 1:
-			self.SendMessage(fmt.Sprintf("unigram: %.3f%%\n", 100*float64(self.userData.Data.Letters[ngram])/total))
+			unigram := 100 * float64(self.userData.Data.Letters[ngram]) / total
+			result.Unigram = &unigram
+			self.SendMessage(fmt.Sprintf("unigram: %.3f%%\n", unigram))
 		case 2:
-			self.SendMessage(fmt.Sprintf("bigram: %.3f%%\n", 100*float64(self.userData.Data.Bigrams[ngram])/total))
-			self.SendMessage(fmt.Sprintf("skipgram: %.3f%%\n", 100*self.userData.Data.Skipgrams[ngram]/total))
+			bigram := 100 * float64(self.userData.Data.Bigrams[ngram]) / total
+			skipgram := 100 * self.userData.Data.Skipgrams[ngram] / total
+			result.Bigram = &bigram
+			result.Skipgram = &skipgram
+			self.SendMessage(fmt.Sprintf("bigram: %.3f%%\n", bigram))
+			self.SendMessage(fmt.Sprintf("skipgram: %.3f%%\n", skipgram))
 		case 3:
-			self.SendMessage(fmt.Sprintf("trigram: %.3f%%\n", 100*float64(self.userData.Data.Trigrams[ngram])/total))
-		default:
-			self.SendMessage("Unimplemented feature in original app")
+			trigram := 100 * float64(self.userData.Data.Trigrams[ngram]) / total
+			result.Trigram = &trigram
+			self.SendMessage(fmt.Sprintf("trigram: %.3f%%\n", trigram))
 		}
+		self.result = result
 	}
 }
 
+// parseCount parses the optional count argument of a command, which must
+// be at least 1.
+func (self *GenkeyMain) parseCount(arg string) (int, bool) {
+	num, err := strconv.Atoi(arg)
+	if err != nil || num < 1 {
+		self.SendMessage(fmt.Sprintf("optional count argument must be a number above 0, not [%s]\n", arg))
+		return 0, false
+	}
+	return num, true
+}
+
 func (self *GenkeyMain) commandUsage(command *Command) {
 	var argstr string
 	if command.Arg == LayoutArg {
 		argstr = " layout"
 	} else if command.Arg == NgramArg {
 		argstr = " ngram"
-	} else if command.Arg == PathArg {
-		argstr = " filepath"
 	}
 
 	argstr = color.White().Italic().Sprint(argstr)
@@ -361,30 +527,96 @@ func (self *GenkeyMain) Run(input string) {
 	self.userData.mu.Lock()
 	defer self.userData.mu.Unlock()
 
-	fs := flag.NewFlagSet("myProgram", flag.ExitOnError)
-	args := strings.Fields(input)
+	if text, ok := strings.CutPrefix(input, loadDataPrefix); ok {
+		self.loadChunk(text)
+		return
+	}
+
+	args := self.parseFlags(strings.Fields(normalize(input)))
+	// corpus and keyboard load data themselves, so that a session can
+	// still switch away from a corpus or keyboard that does not exist
+	if len(args) == 0 || (args[0] != "corpus" && args[0] != "keyboard") {
+		self.loadData()
+	}
+	self.runCommand(args)
+}
+
+// parseFlags reads config.toml into the user config and applies the
+// command line flags on top of it, returning the remaining arguments.
+func (self *GenkeyMain) parseFlags(args []string) []string {
+	fs := flag.NewFlagSet("myProgram", flag.ContinueOnError)
+	fs.SetOutput(io.Discard)
 	userData := self.userData
 
 	ReadWeights(&userData.Config)
-	fs.BoolVar(&userData.StaggerFlag, "stagger", userData.Config.Weights.Stagger, "if true, calculates distance for ANSI row-stagger form factor")
-	fs.BoolVar(&userData.ColStaggerFlag, "colstagger", userData.Config.Weights.ColStagger, "if true, calculates distance for col-stagger form factor")
+	var stagger, colStagger bool
+	fs.StringVar(&userData.KeyboardFlag, "keyboard", "", "measures distances on a profile of the keyboards directory")
+	fs.BoolVar(&stagger, "stagger", false, "short for -keyboard ansi")
+	fs.BoolVar(&colStagger, "colstagger", false, "short for -keyboard split")
 	fs.BoolVar(&userData.SlideFlag, "slide", false, "if true, ignores slideable sfbs (made for Oats) (might not work)")
 	fs.BoolVar(&userData.DynamicFlag, "dynamic", false, "")
-	fs.Parse(args)
-	args = fs.Args()
+	fs.BoolVar(&userData.DeltaCheckFlag, "deltacheck", false, "if true, checks every incremental score against a full score (slow)")
+	fs.Int64Var(&userData.SeedFlag, "seed", 0, "seeds generate and improve so that runs can be replayed, 0 picks a random seed")
+	if err := fs.Parse(args); err != nil {
+		panic(err)
+	}
+	if userData.KeyboardFlag == "" && colStagger {
+		userData.KeyboardFlag = "split"
+	} else if userData.KeyboardFlag == "" && stagger {
+		userData.KeyboardFlag = "ansi"
+	}
+	return fs.Args()
+}
 
-	self.userData.Data = NewGenkeyText(self.conn, self.userData).LoadData(filepath.Join(self.userData.Config.Paths.Corpora, self.userData.Config.Corpus) + ".json")
+// loadData loads the session corpus, keyboard and every layout for the
+// current config.
+func (self *GenkeyMain) loadData() {
+	self.loadKeyboard()
+	if session := self.userData.SessionCorpus; session != nil {
+		self.userData.Data = session.Data
+		self.userData.Corpus = session.Corpus
+	} else {
+		parts := self.userData.corpusParts()
+		for _, p := range parts {
+			if _, err := GenkeyStat(corpusPath(&self.userData.Config, p.Name)); err != nil {
+				panic(fmt.Sprintf("Corpus [%s] does not exist, pick another one with corpus.\n", p.Name))
+			}
+		}
+		if len(parts) == 1 {
+			path, wordList := corpusSource(&self.userData.Config, parts[0].Name)
+			extra := ""
+			if wordList {
+				extra = wordListKey(&self.userData.Config)
+			}
+			self.userData.Data = self.readCorpus(parts[0].Name)
+			self.userData.Corpus = corpusCache.get(path, extra, func() *Corpus {
+				return CompileCorpus(&self.userData.Data)
+			})
+		} else {
+			self.userData.Data, self.userData.Corpus = self.loadBlend(parts)
+		}
+	}
 
 	self.userData.Layouts = make(map[string]*Layout)
 	NewGenkeyLayout(self.conn, self.userData).LoadLayoutDir()
 
 	for _, l := range self.userData.Layouts {
-		if len(l.Name) > self.userData.LongestLayoutName {
-			self.userData.LongestLayoutName = len(l.Name)
-		}
+		self.userData.LongestLayoutName = max(self.userData.LongestLayoutName, charWidth(l.Name))
 	}
+}
 
-	self.runCommand(args)
+// readCorpus returns the TextData of a corpus from the corpora directory,
+// or built from a word list.
+func (self *GenkeyMain) readCorpus(name string) TextData {
+	path, wordList := corpusSource(&self.userData.Config, name)
+	if wordList {
+		return dataCache.get(path, wordListKey(&self.userData.Config), func() TextData {
+			return self.readWordList(path)
+		})
+	}
+	return dataCache.get(path, "", func() TextData {
+		return NewGenkeyText(self.conn, self.userData).LoadData(path)
+	})
 }
 
 func (self *GenkeyMain) usage() {
@@ -399,3 +631,9 @@ func (self *GenkeyMain) usage() {
 func (self *GenkeyMain) GetUserData() *UserData {
 	return self.userData
 }
+
+// GetResult returns the structured result of the last command, if the
+// command produces one. It is sent as the payload of JSON responses.
+func (self *GenkeyMain) GetResult() any {
+	return self.result
+}
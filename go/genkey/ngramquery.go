@@ -0,0 +1,328 @@
+package genkey
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+)
+
+// NgramPattern is a parsed ngram query. Besides plain characters it
+// understands
+//
+//	?         any one character
+//	*         any characters, only matched against stored ngrams
+//	[aeiou]   one of a set, with ranges like [a-z] and [^...] negating it
+//	\?        a literal ?, *, [ or \
+type NgramPattern struct {
+	tokens []patternToken
+	star   bool
+}
+
+type patternToken struct {
+	kind  tokenKind
+	char  string          // tokenChar
+	set   map[string]bool // tokenSet
+	negat bool            // tokenSet
+}
+
+type tokenKind int
+
+const (
+	tokenChar tokenKind = iota
+	tokenAny
+	tokenStar
+	tokenSet
+)
+
+func ParseNgramPattern(s string) (*NgramPattern, error) {
+	p := &NgramPattern{}
+	chars := splitChars(strings.ToLower(s))
+	for i := 0; i < len(chars); i++ {
+		c := chars[i]
+		switch c {
+		case "\\":
+			if i+1 == len(chars) {
+				return nil, fmt.Errorf("pattern [%s] ends with an escape", s)
+			}
+			i++
+			p.tokens = append(p.tokens, patternToken{kind: tokenChar, char: chars[i]})
+		case "?":
+			p.tokens = append(p.tokens, patternToken{kind: tokenAny})
+		case "*":
+			p.star = true
+			p.tokens = append(p.tokens, patternToken{kind: tokenStar})
+		case "[":
+			end := i + 1
+			for end < len(chars) && chars[end] != "]" {
+				end++
+			}
+			if end == len(chars) {
+				return nil, fmt.Errorf("pattern [%s] has an unclosed [", s)
+			}
+			t := patternToken{kind: tokenSet, set: make(map[string]bool)}
+			set := chars[i+1 : end]
+			if len(set) > 0 && set[0] == "^" {
+				t.negat = true
+				set = set[1:]
+			}
+			for j := 0; j < len(set); j++ {
+				if j+2 < len(set) && set[j+1] == "-" {
+					from, to := []rune(set[j]), []rune(set[j+2])
+					if len(from) != 1 || len(to) != 1 || from[0] > to[0] {
+						return nil, fmt.Errorf("invalid range [%s-%s]", set[j], set[j+2])
+					}
+					for r := from[0]; r <= to[0]; r++ {
+						t.set[string(r)] = true
+					}
+					j += 2
+					continue
+				}
+				t.set[set[j]] = true
+			}
+			if len(t.set) == 0 {
+				return nil, fmt.Errorf("pattern [%s] has an empty set", s)
+			}
+			p.tokens = append(p.tokens, t)
+			i = end
+		default:
+			p.tokens = append(p.tokens, patternToken{kind: tokenChar, char: c})
+		}
+	}
+	if len(p.tokens) == 0 {
+		return nil, fmt.Errorf("empty pattern")
+	}
+	return p, nil
+}
+
+// Exact reports whether the pattern is a plain ngram without wildcards.
+func (self *NgramPattern) Exact() bool {
+	for _, t := range self.tokens {
+		if t.kind != tokenChar {
+			return false
+		}
+	}
+	return true
+}
+
+// String is the ngram an exact pattern matches.
+func (self *NgramPattern) String() string {
+	var sb strings.Builder
+	for _, t := range self.tokens {
+		sb.WriteString(t.char)
+	}
+	return sb.String()
+}
+
+// Len is the number of characters the pattern matches, without *.
+func (self *NgramPattern) Len() int {
+	return len(self.tokens)
+}
+
+func (self *patternToken) matches(c string) bool {
+	switch self.kind {
+	case tokenChar:
+		return self.char == c
+	case tokenSet:
+		return self.set[c] != self.negat
+	}
+	return true
+}
+
+// Match reports whether the characters of an ngram match the pattern.
+func (self *NgramPattern) Match(chars []string) bool {
+	return matchTokens(self.tokens, chars)
+}
+
+func matchTokens(tokens []patternToken, chars []string) bool {
+	if len(tokens) == 0 {
+		return len(chars) == 0
+	}
+	if tokens[0].kind == tokenStar {
+		for i := 0; i <= len(chars); i++ {
+			if matchTokens(tokens[1:], chars[i:]) {
+				return true
+			}
+		}
+		return false
+	}
+	return len(chars) > 0 && tokens[0].matches(chars[0]) && matchTokens(tokens[1:], chars[1:])
+}
+
+// NgramMatches are the matches of a pattern query of one ngram length.
+// Counts are percentages of all characters like the exact ngram lookups.
+type NgramMatches struct {
+	Length    int         `json:"length"`
+	Total     float64     `json:"total"` // of every match, not only the listed ones
+	Skipgrams float64     `json:"skipgrams,omitempty"`
+	Count     int         `json:"count"` // number of matches
+	Matches   []NgramFreq `json:"matches"`
+	Estimated bool        `json:"estimated,omitempty"` // chained from trigrams
+	Pruned    bool        `json:"pruned,omitempty"`    // from the most frequent stored ngrams only
+}
+
+// maxChainBeam caps the partial matches kept per step when estimating
+// ngrams longer than trigrams, keeping the most frequent ones.
+const maxChainBeam = 5000
+
+// QueryNgrams finds the stored ngrams matching p, ranked and totalled
+// separately for each ngram length. Patterns with * are matched against
+// every stored ngram and may match several lengths, the others match one.
+// Longer patterns are looked up in the corpus ngrams of their length when
+// it has them, and otherwise estimated by chaining trigrams: abcd is
+// counted as abc * bcd / bc.
+func (self *GenkeyMain) QueryNgrams(p *NgramPattern, count int) []NgramMatches {
+	data := &self.userData.Data
+	total := float64(data.Total)
+
+	found := make(map[int][]FreqPair)
+	search := func(ngrams map[string]int) {
+		for k, v := range ngrams {
+			chars := splitChars(k)
+			if v > 0 && p.Match(chars) {
+				found[len(chars)] = append(found[len(chars)], FreqPair{k, float64(v)})
+			}
+		}
+	}
+	if !p.star {
+		m := NgramMatches{Length: p.Len()}
+		switch {
+		case p.Len() == 1:
+			search(data.Letters)
+		case p.Len() == 2:
+			search(data.Bigrams)
+			for k, v := range data.Skipgrams {
+				if p.Match(splitChars(k)) {
+					m.Skipgrams += 100 * v / total
+				}
+			}
+		case p.Len() == 3:
+			search(data.Trigrams)
+		case len(data.Ngrams[p.Len()]) > 0:
+			m.Pruned = true
+			search(data.Ngrams[p.Len()])
+		default:
+			m.Estimated = true
+			found[p.Len()] = self.chainNgrams(p)
+		}
+		m.rank(found[p.Len()], count, total)
+		return []NgramMatches{m}
+	}
+
+	search(data.Letters)
+	search(data.Bigrams)
+	search(data.Trigrams)
+	for _, ngrams := range data.Ngrams {
+		search(ngrams)
+	}
+	lengths := make([]int, 0, len(found))
+	for n := range found {
+		lengths = append(lengths, n)
+	}
+	sort.Ints(lengths)
+	matches := make([]NgramMatches, len(lengths))
+	for i, n := range lengths {
+		matches[i] = NgramMatches{Length: n, Pruned: n > 3}
+		matches[i].rank(found[n], count, total)
+	}
+	return matches
+}
+
+// rank sorts found, the counts of the matches, and keeps the count most
+// frequent as percentages of total.
+func (self *NgramMatches) rank(found []FreqPair, count int, total float64) {
+	sort.Slice(found, func(i, j int) bool {
+		if found[i].Count != found[j].Count {
+			return found[i].Count > found[j].Count
+		}
+		return found[i].Ngram < found[j].Ngram
+	})
+	self.Count = len(found)
+	for _, f := range found {
+		self.Total += 100 * f.Count / total
+	}
+	self.Matches = make([]NgramFreq, 0, min(count, len(found)))
+	for _, f := range found[:min(count, len(found))] {
+		self.Matches = append(self.Matches, NgramFreq{f.Ngram, 100 * f.Count / total})
+	}
+}
+
+// chainNgrams estimates the counts of every ngram matching p, which has
+// more than three characters and no *.
+func (self *GenkeyMain) chainNgrams(p *NgramPattern) []FreqPair {
+	data := &self.userData.Data
+	type partial struct {
+		chars []string
+		count float64
+	}
+
+	// Trigrams by their first two characters, to extend partial matches
+	next := make(map[string][]FreqPair)
+	var chains []partial
+	for k, v := range data.Trigrams {
+		chars := splitChars(k)
+		if len(chars) != 3 {
+			continue
+		}
+		prefix := chars[0] + chars[1]
+		next[prefix] = append(next[prefix], FreqPair{chars[2], float64(v)})
+		if matchTokens(p.tokens[:3], chars) {
+			chains = append(chains, partial{chars, float64(v)})
+		}
+	}
+
+	for i := 3; i < p.Len(); i++ {
+		var extended []partial
+		for _, c := range chains {
+			prefix := c.chars[len(c.chars)-2] + c.chars[len(c.chars)-1]
+			bigram := float64(data.Bigrams[prefix])
+			if bigram == 0 {
+				continue
+			}
+			for _, n := range next[prefix] {
+				if p.tokens[i].matches(n.Ngram) {
+					chars := append(append([]string{}, c.chars...), n.Ngram)
+					extended = append(extended, partial{chars, c.count * n.Count / bigram})
+				}
+			}
+		}
+		if len(extended) > maxChainBeam {
+			sort.Slice(extended, func(a, b int) bool {
+				if extended[a].count != extended[b].count {
+					return extended[a].count > extended[b].count
+				}
+				return strings.Join(extended[a].chars, "") < strings.Join(extended[b].chars, "")
+			})
+			extended = extended[:maxChainBeam]
+		}
+		chains = extended
+	}
+
+	found := make([]FreqPair, 0, len(chains))
+	for _, c := range chains {
+		if c.count > 0 {
+			found = append(found, FreqPair{strings.Join(c.chars, ""), c.count})
+		}
+	}
+	return found
+}
+
+func (self *GenkeyMain) printNgramMatches(matches []NgramMatches) {
+	if len(matches) == 0 {
+		self.SendMessage("0 matches\n")
+	}
+	for _, m := range matches {
+		estimated := ""
+		if m.Estimated {
+			estimated = ", estimated from trigrams"
+		} else if m.Pruned {
+			estimated = ", among the stored ngrams"
+		}
+		self.SendMessage(fmt.Sprintf("%d-grams, %d matches: %.3f%%%s\n", m.Length, m.Count, m.Total, estimated))
+		if m.Skipgrams != 0 {
+			self.SendMessage(fmt.Sprintf("skipgrams: %.3f%%\n", m.Skipgrams))
+		}
+		if len(m.Matches) > 0 {
+			NewGenkeyOutput(self.conn, self.userData).printPercentList(m.Matches, true)
+		}
+	}
+}
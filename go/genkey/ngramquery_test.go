@@ -0,0 +1,134 @@
+package genkey
+
+import (
+	"math"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestParseNgramPattern(t *testing.T) {
+	tests := []struct {
+		pattern string
+		exact   bool
+		match   []string
+		nomatch []string
+	}{
+		{"the", true, []string{"the"}, []string{"th", "thee", "tha"}},
+		{"T?E", false, []string{"the", "tie"}, []string{"te", "thee"}},
+		{"[a-c]x", false, []string{"ax", "cx"}, []string{"dx", "x"}},
+		{"[^aeiou]", false, []string{"t", "é"}, []string{"a", "u"}},
+		{"*h", false, []string{"h", "th", "ouch"}, []string{"ha", ""}},
+		{"t*e", false, []string{"te", "the", "three"}, []string{"t", "tea"}},
+		{`\?\*`, true, []string{"?*"}, []string{"ab"}},
+	}
+	for _, tt := range tests {
+		p, err := ParseNgramPattern(tt.pattern)
+		if err != nil {
+			t.Errorf("%s: %v", tt.pattern, err)
+			continue
+		}
+		if p.Exact() != tt.exact {
+			t.Errorf("%s: exact %v, want %v", tt.pattern, p.Exact(), tt.exact)
+		}
+		for _, s := range tt.match {
+			if !p.Match(splitChars(s)) {
+				t.Errorf("%s does not match [%s]", tt.pattern, s)
+			}
+		}
+		for _, s := range tt.nomatch {
+			if p.Match(splitChars(s)) {
+				t.Errorf("%s matches [%s]", tt.pattern, s)
+			}
+		}
+	}
+}
+
+func TestParseBadNgramPattern(t *testing.T) {
+	tests := []struct {
+		pattern string
+		want    string
+	}{
+		{"", "empty pattern"},
+		{"t[ab", "unclosed ["},
+		{"t[]", "empty set"},
+		{"[^]", "empty set"},
+		{"[z-a]", "invalid range"},
+		{`th\`, "ends with an escape"},
+	}
+	for _, tt := range tests {
+		if _, err := ParseNgramPattern(tt.pattern); err == nil || !strings.Contains(err.Error(), tt.want) {
+			t.Errorf("%q: got error %v, want one containing %q", tt.pattern, err, tt.want)
+		}
+	}
+}
+
+func TestQueryNgrams(t *testing.T) {
+	userData := &UserData{Data: testCorpus()}
+	genkeyMain := NewGenkeyMain(&textCapture{}, userData)
+	// Percentages are rounded so that sums in another order compare equal
+	round := func(x float64) float64 { return math.Round(x*1e9) / 1e9 }
+	pc := func(n float64) float64 { return round(100 * n / float64(userData.Data.Total)) }
+
+	type group struct {
+		length    int
+		count     int
+		total     float64
+		skipgrams float64
+		matches   []string
+		estimated bool
+		pruned    bool
+	}
+	tests := []struct {
+		pattern string
+		count   int
+		want    []group
+	}{
+		// Each length is ranked and totalled on its own
+		{"*b*", 10, []group{
+			{1, 1, pc(3), 0, []string{"b"}, false, false},
+			{2, 2, pc(3), 0, []string{"ab", "ba"}, false, false},
+			{3, 2, pc(2), 0, []string{"aba", "bab"}, false, false},
+			{4, 1, pc(1), 0, []string{"abab"}, false, true},
+			{5, 1, pc(1), 0, []string{"ababa"}, false, true},
+		}},
+		{"*a", 1, []group{
+			{1, 1, pc(5), 0, []string{"a"}, false, false},
+			{2, 1, pc(1), 0, []string{"ba"}, false, false},
+			{3, 1, pc(1), 0, []string{"aba"}, false, false},
+			{5, 1, pc(1), 0, []string{"ababa"}, false, true},
+		}},
+		{"a?", 10, []group{
+			{2, 2, pc(3), pc(0.5), []string{"ab", "aé"}, false, false},
+		}},
+		{"ab??", 10, []group{
+			{4, 1, pc(1), 0, []string{"abab"}, false, true},
+		}},
+		// Longer than the stored ngrams, chained from trigrams
+		{"abab??", 10, []group{
+			{6, 1, pc(0.5), 0, []string{"ababab"}, true, false},
+		}},
+		{"x?", 10, []group{
+			{2, 0, 0, 0, []string{}, false, false},
+		}},
+		{"*x", 10, []group{}},
+	}
+	for _, tt := range tests {
+		p, err := ParseNgramPattern(tt.pattern)
+		if err != nil {
+			t.Fatal(err)
+		}
+		matches := genkeyMain.QueryNgrams(p, tt.count)
+		got := make([]group, len(matches))
+		for i, m := range matches {
+			ngrams := make([]string, len(m.Matches))
+			for j, f := range m.Matches {
+				ngrams[j] = f.Ngram
+			}
+			got[i] = group{m.Length, m.Count, round(m.Total), round(m.Skipgrams), ngrams, m.Estimated, m.Pruned}
+		}
+		if !reflect.DeepEqual(got, tt.want) {
+			t.Errorf("%s: got %+v, want %+v", tt.pattern, got, tt.want)
+		}
+	}
+}
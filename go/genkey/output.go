@@ -25,11 +25,11 @@ import (
 )
 
 type GenkeyOutput struct {
-	conn     *websocket.Conn
+	conn     Conn
 	userData *UserData
 }
 
-func NewGenkeyOutput(conn *websocket.Conn, userData *UserData) *GenkeyOutput {
+func NewGenkeyOutput(conn Conn, userData *UserData) *GenkeyOutput {
 	return &GenkeyOutput{conn, userData}
 }
 
@@ -40,7 +40,7 @@ func (self *GenkeyOutput) SendMessage(s string) {
 func (self *GenkeyOutput) PrintLayout(keys [][]string) {
 	for _, row := range keys {
 		for x, key := range row {
-			self.SendMessage(fmt.Sprintf("%s ", key))
+			self.SendMessage(fmt.Sprintf("%s ", keyLabel(key)))
 			if x == 4 {
 				self.SendMessage(" ")
 			}
@@ -49,113 +49,208 @@ func (self *GenkeyOutput) PrintLayout(keys [][]string) {
 	}
 }
 
-func (self *GenkeyOutput) PrintAnalysis(l *Layout) {
-	genkeyLayout := NewGenkeyLayout(self.conn, self.userData)
+type TrigramRatios struct {
+	LeftInwardRolls   float64 `json:"leftInwardRolls"`
+	LeftOutwardRolls  float64 `json:"leftOutwardRolls"`
+	RightInwardRolls  float64 `json:"rightInwardRolls"`
+	RightOutwardRolls float64 `json:"rightOutwardRolls"`
+	Alternates        float64 `json:"alternates"`
+	Onehands          float64 `json:"onehands"`
+	Redirects         float64 `json:"redirects"`
+}
 
-	self.SendMessage(color.White().Bold().Sprint(l.Name + "\n"))
-	self.PrintLayout(l.Keys)
+// ShiftRatios are percentages of the shift presses a layout needs, for
+// corpora processed with RecordShift.
+type ShiftRatios struct {
+	Presses  float64 `json:"presses"`
+	SFBs     float64 `json:"sfbs"`
+	SameHand float64 `json:"sameHand"`
+}
 
-	duplicates, missing := genkeyLayout.DuplicatesAndMissing(l)
-	if len(duplicates) > 0 {
-		self.SendMessage(fmt.Sprintf("%d\n", len(duplicates)))
-		self.SendMessage(fmt.Sprintf("Duplicate characters: %s\n", duplicates))
-	}
-	if len(missing) > 0 {
-		self.SendMessage(fmt.Sprintf("Missing characters: %s\n", missing))
-	}
+type FingerSpeeds struct {
+	Weighted          []float64 `json:"weighted"`
+	Unweighted        []float64 `json:"unweighted"`
+	HighestWeighted   float64   `json:"highestWeighted"`
+	HighestWeightedF  string    `json:"highestWeightedFinger"`
+	HighestUnweighted float64   `json:"highestUnweighted"`
+	HighestUnweightF  string    `json:"highestUnweightedFinger"`
+}
+
+// Analysis holds everything PrintAnalysis outputs. Percentages are
+// already multiplied by 100 and ngram lists are relative to
+// TextData.TotalBigrams, as printed.
+type Analysis struct {
+	Name         string        `json:"name"`
+	Corpus       string        `json:"corpus"`
+	Keys         [][]string    `json:"keys"`
+	Duplicates   []string      `json:"duplicates"`
+	Missing      []string      `json:"missing"`
+	Trigrams     TrigramRatios `json:"trigrams"`
+	FingerSpeed  FingerSpeeds  `json:"fingerSpeed"`
+	IndexUsage   [2]float64    `json:"indexUsage"`
+	Dynamic      bool          `json:"dynamic"`
+	SFBs         float64       `json:"sfbs"`
+	DSFBs        float64       `json:"dsfbs,omitempty"`
+	LSBs         float64       `json:"lsbs,omitempty"`
+	TopSFBs      []NgramFreq   `json:"topSfbs"`
+	Shift        *ShiftRatios  `json:"shift,omitempty"`
+	Escaped      []NgramFreq   `json:"dynamicCompletions,omitempty"`
+	WorstBigrams []NgramFreq   `json:"worstBigrams,omitempty"`
+	Score        float64       `json:"score"`
+}
+
+func (self *GenkeyOutput) Analyze(l *Layout) Analysis {
+	genkeyLayout := NewGenkeyLayout(self.conn, self.userData)
+	var a Analysis
+
+	a.Name = l.Name
+	a.Corpus = self.userData.CorpusName()
+	a.Keys = l.Keys
+	a.Duplicates, a.Missing = genkeyLayout.DuplicatesAndMissing(l)
 
 	ftri := genkeyLayout.FastTrigrams(l, 0)
 	ftotal := float64(ftri.Total)
-	leftrolls := 100*float64(ftri.LeftInwardRolls)/ftotal + 100*float64(ftri.LeftOutwardRolls)/ftotal
-	rightrolls := 100*float64(ftri.RightInwardRolls)/ftotal + 100*float64(ftri.RightOutwardRolls)/ftotal
-	self.SendMessage(fmt.Sprintf("Rolls (l): %.2f%%\n", leftrolls))
-	self.SendMessage(fmt.Sprintf("\tInward: %.2f%%\n", 100*float64(ftri.LeftInwardRolls)/ftotal))
-	self.SendMessage(fmt.Sprintf("\tOutward: %.2f%%\n", 100*float64(ftri.LeftOutwardRolls)/ftotal))
-	self.SendMessage(fmt.Sprintf("Rolls (r): %.2f%%\n", rightrolls))
-	self.SendMessage(fmt.Sprintf("\tInward: %.2f%%\n", 100*float64(ftri.RightInwardRolls)/ftotal))
-	self.SendMessage(fmt.Sprintf("\tOutward: %.2f%%\n", 100*float64(ftri.RightOutwardRolls)/ftotal))
-	self.SendMessage(fmt.Sprintf("Alternates: %.2f%%\n", 100*float64(ftri.Alternates)/ftotal))
-	self.SendMessage(fmt.Sprintf("Onehands: %.2f%%\n", 100*float64(ftri.Onehands)/ftotal))
-	self.SendMessage(fmt.Sprintf("Redirects: %.2f%%\n", 100*float64(ftri.Redirects)/ftotal))
-
-	var weighted []float64
-	var unweighted []float64
+	a.Trigrams = TrigramRatios{
+		LeftInwardRolls:   100 * float64(ftri.LeftInwardRolls) / ftotal,
+		LeftOutwardRolls:  100 * float64(ftri.LeftOutwardRolls) / ftotal,
+		RightInwardRolls:  100 * float64(ftri.RightInwardRolls) / ftotal,
+		RightOutwardRolls: 100 * float64(ftri.RightOutwardRolls) / ftotal,
+		Alternates:        100 * float64(ftri.Alternates) / ftotal,
+		Onehands:          100 * float64(ftri.Onehands) / ftotal,
+		Redirects:         100 * float64(ftri.Redirects) / ftotal,
+	}
+
+	speed := &a.FingerSpeed
 	if self.userData.DynamicFlag {
-		weighted = genkeyLayout.DynamicFingerSpeed(l, true)
-		unweighted = genkeyLayout.DynamicFingerSpeed(l, false)
+		speed.Weighted = genkeyLayout.DynamicFingerSpeed(l, true)
+		speed.Unweighted = genkeyLayout.DynamicFingerSpeed(l, false)
 	} else {
-		weighted = genkeyLayout.FingerSpeed(l, true)
-		unweighted = genkeyLayout.FingerSpeed(l, false)
-	}
-	var highestUnweightedFinger string
-	var highestUnweighted float64
-	var utotal float64
-
-	var highestWeightedFinger string
-	var highestWeighted float64
-	var wtotal float64
-	for i := 0; i < 8; i++ {
-		utotal += unweighted[i]
-		if unweighted[i] > highestUnweighted {
-			highestUnweighted = unweighted[i]
-			highestUnweightedFinger = FingerNames[i]
+		speed.Weighted = genkeyLayout.FingerSpeed(l, true)
+		speed.Unweighted = genkeyLayout.FingerSpeed(l, false)
+	}
+	for i := range speed.Unweighted {
+		if speed.Unweighted[i] > speed.HighestUnweighted {
+			speed.HighestUnweighted = speed.Unweighted[i]
+			speed.HighestUnweightF = FingerNames[i]
+		}
+		if speed.Weighted[i] > speed.HighestWeighted {
+			speed.HighestWeighted = speed.Weighted[i]
+			speed.HighestWeightedF = FingerNames[i]
 		}
+	}
 
-		wtotal += weighted[i]
-		if weighted[i] > highestWeighted {
-			highestWeighted = weighted[i]
-			highestWeightedFinger = FingerNames[i]
+	a.IndexUsage[0], a.IndexUsage[1] = genkeyLayout.IndexUsage(l)
+
+	if self.userData.Corpus.HasShift {
+		shifts := genkeyLayout.Shifts(l)
+		a.Shift = &ShiftRatios{
+			Presses:  100 * float64(shifts.Presses) / l.Total,
+			SFBs:     100 * float64(shifts.SFBs) / l.Total,
+			SameHand: 100 * float64(shifts.SameHand) / l.Total,
 		}
 	}
-	self.SendMessage(fmt.Sprintf("Finger Speed (weighted): %.2f\n", weighted))
-	self.SendMessage(fmt.Sprintf("Finger Speed (unweighted): %.2f\n", unweighted))
-	self.SendMessage(fmt.Sprintf("Highest Speed (weighted): %.2f (%s)\n", highestWeighted, highestWeightedFinger))
-	self.SendMessage(fmt.Sprintf("Highest Speed (unweighted): %.2f (%s)\n", highestUnweighted, highestUnweightedFinger))
-	left, right := genkeyLayout.IndexUsage(l)
-	self.SendMessage(fmt.Sprintf("Index Usage: %.1f%% %.1f%%\n", left, right))
-	var sfb float64
-	var sfbs []FreqPair
 
 	ngcount := self.userData.Config.Output.Analysis.TopNgrams
+	a.Dynamic = self.userData.DynamicFlag
 	if !self.userData.DynamicFlag {
-		sfb = genkeyLayout.SFBs(l, false)
-		sfbs = genkeyLayout.ListSFBs(l, false)
-		self.SendMessage(fmt.Sprintf("SFBs: %.3f%%\n", 100*sfb/l.Total))
-		self.SendMessage(fmt.Sprintf("DSFBs: %.3f%%\n", 100*genkeyLayout.SFBs(l, true)/l.Total))
-		lsb := float64(genkeyLayout.LSBs(l))
-		self.SendMessage(fmt.Sprintf("LSBs: %.2f%%\n", 100*lsb/l.Total))
+		a.SFBs = 100 * genkeyLayout.SFBs(l, false) / l.Total
+		a.DSFBs = 100 * genkeyLayout.SFBs(l, true) / l.Total
+		a.LSBs = 100 * float64(genkeyLayout.LSBs(l)) / l.Total
 
+		sfbs := genkeyLayout.ListSFBs(l, false)
 		genkeyLayout.SortFreqList(sfbs)
+		a.TopSFBs = self.FreqListPercent(sfbs, ngcount)
 
-		self.SendMessage("Top SFBs:\n")
-		self.PrintFreqList(sfbs, ngcount, true)
+		bigrams := genkeyLayout.ListWorstBigrams(l)
+		genkeyLayout.SortFreqList(bigrams)
+		a.WorstBigrams = self.FreqListPercent(bigrams, ngcount)
 	} else {
-		sfb = genkeyLayout.DynamicSFBs(l)
+		a.SFBs = 100 * genkeyLayout.DynamicSFBs(l) / l.Total
 		escaped, real := genkeyLayout.ListDynamic(l)
-		self.SendMessage(fmt.Sprintf("Real SFBs: %.3f%%\n", 100*sfb/l.Total))
-		self.PrintFreqList(real, 8, true)
-		self.SendMessage("Dynamic Completions:\n")
-		self.PrintFreqList(escaped, 30, true)
+		a.TopSFBs = self.FreqListPercent(real, 8)
+		a.Escaped = self.FreqListPercent(escaped, 30)
 	}
 
-	if !self.userData.DynamicFlag {
-		bigrams := genkeyLayout.ListWorstBigrams(l)
-		genkeyLayout.SortFreqList(bigrams)
+	a.Score = NewGenkeyGenerate(self.conn, self.userData).Score(l)
+	return a
+}
+
+func (self *GenkeyOutput) PrintAnalysis(l *Layout) Analysis {
+	a := self.Analyze(l)
+
+	self.SendMessage(color.White().Bold().Sprint(a.Name + "\n"))
+	self.PrintLayout(a.Keys)
+
+	if len(a.Duplicates) > 0 {
+		self.SendMessage(fmt.Sprintf("%d\n", len(a.Duplicates)))
+		self.SendMessage(fmt.Sprintf("Duplicate characters: %s\n", a.Duplicates))
+	}
+	if len(a.Missing) > 0 {
+		self.SendMessage(fmt.Sprintf("Missing characters: %s\n", a.Missing))
+	}
+
+	tri := &a.Trigrams
+	self.SendMessage(fmt.Sprintf("Rolls (l): %.2f%%\n", tri.LeftInwardRolls+tri.LeftOutwardRolls))
+	self.SendMessage(fmt.Sprintf("\tInward: %.2f%%\n", tri.LeftInwardRolls))
+	self.SendMessage(fmt.Sprintf("\tOutward: %.2f%%\n", tri.LeftOutwardRolls))
+	self.SendMessage(fmt.Sprintf("Rolls (r): %.2f%%\n", tri.RightInwardRolls+tri.RightOutwardRolls))
+	self.SendMessage(fmt.Sprintf("\tInward: %.2f%%\n", tri.RightInwardRolls))
+	self.SendMessage(fmt.Sprintf("\tOutward: %.2f%%\n", tri.RightOutwardRolls))
+	self.SendMessage(fmt.Sprintf("Alternates: %.2f%%\n", tri.Alternates))
+	self.SendMessage(fmt.Sprintf("Onehands: %.2f%%\n", tri.Onehands))
+	self.SendMessage(fmt.Sprintf("Redirects: %.2f%%\n", tri.Redirects))
+
+	speed := &a.FingerSpeed
+	self.SendMessage(fmt.Sprintf("Finger Speed (weighted): %.2f\n", speed.Weighted))
+	self.SendMessage(fmt.Sprintf("Finger Speed (unweighted): %.2f\n", speed.Unweighted))
+	self.SendMessage(fmt.Sprintf("Highest Speed (weighted): %.2f (%s)\n", speed.HighestWeighted, speed.HighestWeightedF))
+	self.SendMessage(fmt.Sprintf("Highest Speed (unweighted): %.2f (%s)\n", speed.HighestUnweighted, speed.HighestUnweightF))
+	self.SendMessage(fmt.Sprintf("Index Usage: %.1f%% %.1f%%\n", a.IndexUsage[0], a.IndexUsage[1]))
+	if a.Shift != nil {
+		self.SendMessage(fmt.Sprintf("Shift Presses: %.2f%% (SFBs %.3f%%, same hand %.2f%%)\n", a.Shift.Presses, a.Shift.SFBs, a.Shift.SameHand))
+	}
+
+	if !a.Dynamic {
+		self.SendMessage(fmt.Sprintf("SFBs: %.3f%%\n", a.SFBs))
+		self.SendMessage(fmt.Sprintf("DSFBs: %.3f%%\n", a.DSFBs))
+		self.SendMessage(fmt.Sprintf("LSBs: %.2f%%\n", a.LSBs))
+
+		self.SendMessage("Top SFBs:\n")
+		self.printPercentList(a.TopSFBs, true)
+
 		self.SendMessage("Worst Bigrams:\n")
-		self.PrintFreqList(bigrams, ngcount, false)
+		self.printPercentList(a.WorstBigrams, false)
+	} else {
+		self.SendMessage(fmt.Sprintf("Real SFBs: %.3f%%\n", a.SFBs))
+		self.printPercentList(a.TopSFBs, true)
+		self.SendMessage("Dynamic Completions:\n")
+		self.printPercentList(a.Escaped, true)
 	}
 
-	self.SendMessage(fmt.Sprintf("Score: %.2f\n", NewGenkeyGenerate(self.conn, self.userData).Score(l)))
+	self.SendMessage(fmt.Sprintf("Score: %.2f\n", a.Score))
 	self.SendMessage("\n")
+	return a
 }
 
-func (self *GenkeyOutput) PrintFreqList(list []FreqPair, length int, percent bool) {
+// FreqListPercent returns the first length pairs with their counts
+// expressed as a percentage of all bigrams, which is how PrintFreqList
+// displays them.
+func (self *GenkeyOutput) FreqListPercent(list []FreqPair, length int) []NgramFreq {
+	length = min(length, len(list))
+	out := make([]NgramFreq, length)
+	for i, v := range list[0:length] {
+		out[i] = NgramFreq{v.Ngram, 100 * float64(v.Count) / float64(self.userData.Data.TotalBigrams)}
+	}
+	return out
+}
+
+func (self *GenkeyOutput) printPercentList(list []NgramFreq, percent bool) {
 	pc := ""
 	if percent {
 		pc = "%"
 	}
-	for i, v := range list[0:length] {
-		self.SendMessage(fmt.Sprintf("\t%s %.3f%s", v.Ngram, 100*float64(v.Count)/float64(self.userData.Data.TotalBigrams), pc))
+	for i, v := range list {
+		self.SendMessage(fmt.Sprintf("\t%s %.3f%s", v.Ngram, v.Count, pc))
 		if (i+1)%4 == 0 {
 			self.SendMessage("\n")
 		}
@@ -163,17 +258,22 @@ func (self *GenkeyOutput) PrintFreqList(list []FreqPair, length int, percent boo
 	self.SendMessage("\n")
 }
 
+func (self *GenkeyOutput) PrintFreqList(list []FreqPair, length int, percent bool) {
+	self.printPercentList(self.FreqListPercent(list, length), percent)
+}
+
 func (self *GenkeyOutput) Heatmap(layout *Layout) {
 	l := layout.Keys
-	dc := gg.NewContext(500, 160)
+	width := 10
+	for _, r := range l {
+		width = max(width, len(r))
+	}
+	dc := gg.NewContext(50*width, 50*len(l)+10)
 
-	cols := []float64{0, 0, 0, 0, 0, 0, 0, 0, 0, 0}
+	cols := make([]float64, width)
 
 	for row, r := range l {
 		for col, c := range r {
-			if col > 9 {
-				continue
-			}
 			dc.DrawRectangle(float64(50*col), float64(50*row), 50, 50)
 			freq := float64(self.userData.Data.Letters[c]) / (layout.Total * 1.15)
 			cols[col] += freq
@@ -183,12 +283,12 @@ func (self *GenkeyOutput) Heatmap(layout *Layout) {
 			dc.SetRGB(0.6*(base+log), base*(1-pc), base+log)
 			dc.Fill()
 			dc.SetRGB(0, 0, 0)
-			dc.DrawString(c, 22.5+float64(50*col), 27.5+float64(50*row))
+			dc.DrawString(keyLabel(c), 22.5+float64(50*col), 27.5+float64(50*row))
 		}
 	}
 
 	for i, c := range cols {
-		dc.DrawRectangle(float64(50*i), 150, 50, 10)
+		dc.DrawRectangle(float64(50*i), float64(50*len(l)), 50, 10)
 		pc := c / 0.2
 		log := math.Log(1 + pc)
 		base := 0.3
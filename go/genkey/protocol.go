@@ -0,0 +1,169 @@
+package genkey
+
+import (
+	"encoding/json"
+	"fmt"
+	"strings"
+
+	websocket "github.com/gorilla/websocket"
+)
+
+// Conn is the subset of *websocket.Conn that genkey writes to. It lets the
+// JSON protocol wrap outgoing messages without touching every command.
+type Conn interface {
+	WriteMessage(messageType int, data []byte) error
+}
+
+type Protocol int
+
+const (
+	TextProtocol Protocol = iota
+	JSONProtocol
+)
+
+// ParseProtocolSwitch recognizes the `protocol text|json` negotiation
+// message. It is answered before any command is run.
+func ParseProtocolSwitch(message string) (Protocol, bool) {
+	fields := strings.Fields(message)
+	if len(fields) != 2 || fields[0] != "protocol" {
+		return TextProtocol, false
+	}
+	switch fields[1] {
+	case "text":
+		return TextProtocol, true
+	case "json":
+		return JSONProtocol, true
+	}
+	return TextProtocol, false
+}
+
+const (
+	StatusRunning = "running"
+	StatusDone    = "done"
+	StatusHold    = "hold"
+	StatusError   = "error"
+)
+
+const (
+	EventOutput   = "output"
+	EventProgress = "progress"
+	EventClear    = "clear"
+)
+
+type Request struct {
+	ID      string `json:"id"`
+	Command string `json:"command"`
+}
+
+// NgramFreq is an ngram and its frequency as protocol results send it.
+// FreqPair is stored in corpus files under its own field names.
+type NgramFreq struct {
+	Ngram string  `json:"ngram"`
+	Count float64 `json:"count"`
+}
+
+type Progress struct {
+	Stage     string `json:"stage"`
+	Remaining int64  `json:"remaining,omitempty"`
+	Rate      int    `json:"rate,omitempty"`
+	Total     int    `json:"total,omitempty"`
+	Bytes     int    `json:"bytes,omitempty"`
+}
+
+type Envelope struct {
+	ID       string    `json:"id"`
+	Command  string    `json:"command"`
+	Status   string    `json:"status"`
+	Event    string    `json:"event,omitempty"`
+	Message  string    `json:"message,omitempty"`
+	Progress *Progress `json:"progress,omitempty"`
+	Result   any       `json:"result,omitempty"`
+	Error    string    `json:"error,omitempty"`
+	Corpus   string    `json:"corpus,omitempty"` // corpus the command analyzed against
+}
+
+// JSONConn turns every plain text message into an output event of the
+// request it belongs to.
+type JSONConn struct {
+	conn    Conn
+	request Request
+	corpus  string
+}
+
+func NewJSONConn(conn Conn, request Request) *JSONConn {
+	return &JSONConn{conn: conn, request: request}
+}
+
+func (self *JSONConn) WriteMessage(messageType int, data []byte) error {
+	return self.send(Envelope{Status: StatusRunning, Event: EventOutput, Message: string(data)})
+}
+
+func (self *JSONConn) Event(event string, progress *Progress) {
+	self.send(Envelope{Status: StatusRunning, Event: event, Progress: progress})
+}
+
+func (self *JSONConn) Finish(status string, result any) {
+	self.send(Envelope{Status: status, Result: result})
+}
+
+func (self *JSONConn) Fail(err string) {
+	self.send(Envelope{Status: StatusError, Error: err})
+}
+
+func (self *JSONConn) send(e Envelope) error {
+	e.ID = self.request.ID
+	e.Command = self.request.Command
+	e.Corpus = self.corpus
+	b, err := json.Marshal(e)
+	if err != nil {
+		return err
+	}
+	return self.conn.WriteMessage(websocket.TextMessage, b)
+}
+
+// ParseRequest decodes a JSON protocol request. Bare text is accepted as
+// a command without an id so that the protocol can be tried by hand. Upload
+// chunks are kept as they are, other bare commands are trimmed.
+func ParseRequest(message string) (Request, error) {
+	var req Request
+	if strings.HasPrefix(message, loadDataPrefix) {
+		req.Command = message
+		return req, nil
+	}
+	trimmed := strings.TrimSpace(message)
+	if !strings.HasPrefix(trimmed, "{") {
+		req.Command = trimmed
+		return req, nil
+	}
+	err := json.Unmarshal([]byte(trimmed), &req)
+	return req, err
+}
+
+// sendProgress reports progress of a long running command. Text
+// connections receive the human readable line instead.
+func sendProgress(conn Conn, progress Progress, text string) {
+	if jc, ok := conn.(*JSONConn); ok {
+		jc.Event(EventProgress, &progress)
+		return
+	}
+	conn.WriteMessage(websocket.TextMessage, []byte(text))
+}
+
+// sendCorpus reports the corpus a command runs against. JSON clients get it
+// on every following envelope of the request instead of as output.
+func sendCorpus(conn Conn, name string) {
+	if jc, ok := conn.(*JSONConn); ok {
+		jc.corpus = name
+		return
+	}
+	conn.WriteMessage(websocket.TextMessage, []byte(fmt.Sprintf("corpus: %s\n", name)))
+}
+
+// sendClear asks the client to clear its screen, used by interactive mode.
+func sendClear(conn Conn) {
+	if jc, ok := conn.(*JSONConn); ok {
+		jc.Event(EventClear, nil)
+		return
+	}
+	conn.WriteMessage(websocket.TextMessage, []byte("[CLEAR]"))
+}
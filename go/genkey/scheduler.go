@@ -0,0 +1,187 @@
+package genkey
+
+import (
+	"context"
+	"fmt"
+	"runtime"
+	"sync"
+
+	websocket "github.com/gorilla/websocket"
+)
+
+// SchedulerConfig bounds the heavy commands. A connection runs its
+// commands one at a time, so it runs or queues at most one of them.
+type SchedulerConfig struct {
+	MaxJobs          int // heavy commands running at once, server wide
+	MaxWorkers       int // improving goroutines running at once, server wide
+	MaxWorkersPerJob int // goroutines a single heavy command may start
+}
+
+type jobTicket struct {
+	ready   chan struct{} // closed when the job may start
+	changed chan struct{} // signalled when the queue position moved
+}
+
+// Scheduler admits heavy commands in FIFO order and bounds the number of
+// goroutines improving layouts across all connections.
+type Scheduler struct {
+	mu      sync.Mutex
+	config  SchedulerConfig
+	running int
+	queue   []*jobTicket
+	workers chan struct{}
+}
+
+func NewScheduler(config SchedulerConfig) *Scheduler {
+	return &Scheduler{
+		config:  config,
+		workers: make(chan struct{}, config.MaxWorkers),
+	}
+}
+
+// Jobs is the scheduler shared by every connection.
+var Jobs = NewScheduler(SchedulerConfig{
+	MaxJobs:          2,
+	MaxWorkers:       runtime.NumCPU(),
+	MaxWorkersPerJob: runtime.NumCPU(),
+})
+
+// Acquire waits for a job slot. report is called with the queue position
+// (starting at 1) every time it changes while waiting. The returned
+// release function must be called once the job is done.
+func (self *Scheduler) Acquire(ctx context.Context, report func(position int)) (func(), error) {
+	self.mu.Lock()
+	release := func() {
+		self.mu.Lock()
+		defer self.mu.Unlock()
+		self.running--
+		self.admit()
+	}
+
+	if self.running < self.config.MaxJobs && len(self.queue) == 0 {
+		self.running++
+		self.mu.Unlock()
+		return release, nil
+	}
+
+	ticket := &jobTicket{make(chan struct{}), make(chan struct{}, 1)}
+	self.queue = append(self.queue, ticket)
+	position := len(self.queue)
+	self.mu.Unlock()
+
+	report(position)
+	for {
+		select {
+		case <-ticket.ready:
+			return release, nil
+		case <-ticket.changed:
+			self.mu.Lock()
+			position = self.position(ticket)
+			self.mu.Unlock()
+			if position > 0 {
+				report(position)
+			}
+		case <-ctx.Done():
+			self.mu.Lock()
+			defer self.mu.Unlock()
+			select {
+			case <-ticket.ready:
+				// Admitted at the same time, hand the slot on
+				self.running--
+				self.admit()
+			default:
+				self.remove(ticket)
+			}
+			return nil, ctx.Err()
+		}
+	}
+}
+
+// admit starts queued jobs while there are free slots. Must hold mu.
+func (self *Scheduler) admit() {
+	for self.running < self.config.MaxJobs && len(self.queue) > 0 {
+		ticket := self.queue[0]
+		self.queue = self.queue[1:]
+		self.running++
+		close(ticket.ready)
+	}
+	self.notify()
+}
+
+// remove drops a cancelled ticket from the queue. Must hold mu.
+func (self *Scheduler) remove(ticket *jobTicket) {
+	for i, t := range self.queue {
+		if t == ticket {
+			self.queue = append(self.queue[:i], self.queue[i+1:]...)
+			break
+		}
+	}
+	self.notify()
+}
+
+// notify tells every queued job that its position may have changed.
+func (self *Scheduler) notify() {
+	for _, t := range self.queue {
+		select {
+		case t.changed <- struct{}{}:
+		default:
+		}
+	}
+}
+
+func (self *Scheduler) position(ticket *jobTicket) int {
+	for i, t := range self.queue {
+		if t == ticket {
+			return i + 1
+		}
+	}
+	return 0
+}
+
+// Spawn calls fn for 0..n-1 on at most MaxWorkersPerJob goroutines and
+// returns immediately. Every call holds one of the server wide worker
+// slots while it runs. fn is still called after ctx is cancelled, so it
+// can account for skipped work, but it no longer waits for a slot.
+func (self *Scheduler) Spawn(ctx context.Context, n int, fn func(i int)) {
+	next := make(chan int, n)
+	for i := 0; i < n; i++ {
+		next <- i
+	}
+	close(next)
+
+	for w := 0; w < min(n, self.config.MaxWorkersPerJob); w++ {
+		go func() {
+			for i := range next {
+				self.work(ctx, func() { fn(i) })
+			}
+		}()
+	}
+}
+
+// Go runs fn on a new goroutine once a worker slot is free.
+func (self *Scheduler) Go(ctx context.Context, fn func()) {
+	go self.work(ctx, fn)
+}
+
+func (self *Scheduler) work(ctx context.Context, fn func()) {
+	select {
+	case self.workers <- struct{}{}:
+		defer func() { <-self.workers }()
+	case <-ctx.Done():
+	}
+	fn()
+}
+
+// acquireJob waits for a scheduler slot for a heavy command, reporting the
+// queue position to the client. It returns false if the command must not
+// run.
+func acquireJob(conn Conn, userData *UserData) (func(), bool) {
+	release, err := Jobs.Acquire(userData.Context(), func(position int) {
+		sendProgress(conn, Progress{Stage: "queued", Remaining: int64(position)}, fmt.Sprintf("queued at position %d...\n", position))
+	})
+	if err != nil {
+		conn.WriteMessage(websocket.TextMessage, []byte("cancelled while queued\n"))
+		return nil, false
+	}
+	return release, true
+}
@@ -0,0 +1,275 @@
+package genkey
+
+import (
+	"fmt"
+	"math"
+)
+
+// Scorer keeps the partial sums behind Score for one layout and, when two
+// keys are swapped, only updates the terms that involve the two swapped
+// positions. With -deltacheck every delta score is compared against a
+// full Score of the same layout.
+type Scorer struct {
+	generate *GenkeyGenerate
+	layout   *GenkeyLayout
+	l        *Layout
+
+	// Dynamic finger speed has no delta form, so it is always fully scored
+	full  bool
+	check bool
+
+	ids     [][]int  // corpus ids of the keys of l
+	fingers []Finger // finger of every corpus id, -1 if not on l
+
+	speeds []float64      // unweighted finger speed sums, before scaling
+	coords [][][2]float64 // where the keys of l are on the session keyboard
+
+	lsbPairs []Pair
+	lsbOf    map[Pos][]int // lsbPairs indices by position
+	lsbs     []int
+	lsb      int
+
+	trigrams []Trigram
+	triOf    [][]int // trigram indices by corpus id
+	triClass []trigramClass
+	triSeen  []int // swap number a trigram was last updated in
+	tri      TrigramValues
+	swaps    int
+}
+
+func (self *GenkeyGenerate) NewScorer(l *Layout) *Scorer {
+	s := &Scorer{
+		generate: self,
+		layout:   NewGenkeyLayout(self.conn, self.userData),
+		l:        l,
+		full:     self.userData.DynamicFlag,
+		check:    self.userData.DeltaCheckFlag,
+	}
+	if s.full {
+		return s
+	}
+	weights := &self.userData.Config.Weights.Score
+	corpus := self.userData.Corpus
+	s.ids = corpus.KeyIDs(l)
+	s.fingers = corpus.KeyFingers(l)
+
+	if weights.FSpeed != 0 {
+		s.speeds = make([]float64, len(l.Fingermap))
+		s.coords = s.layout.coords(l)
+		for f, posits := range l.Fingermap {
+			for i := 0; i < len(posits); i++ {
+				for j := i; j < len(posits); j++ {
+					s.speeds[f] += s.pairSpeed(posits[i], posits[j])
+				}
+			}
+		}
+	}
+
+	if weights.LSB != 0 {
+		s.lsbPairs = s.layout.LSBPairs(l)
+		s.lsbOf = make(map[Pos][]int)
+		s.lsbs = make([]int, len(s.lsbPairs))
+		for i, pair := range s.lsbPairs {
+			s.lsbOf[pair[0]] = append(s.lsbOf[pair[0]], i)
+			s.lsbOf[pair[1]] = append(s.lsbOf[pair[1]], i)
+			s.lsbs[i] = s.layout.lsbCount(s.ids, pair)
+			s.lsb += s.lsbs[i]
+		}
+	}
+
+	if weights.Trigrams.Enabled {
+		top := corpus.Trigrams
+		precision := weights.Trigrams.Precision
+		if precision == 0 {
+			precision = len(top)
+		}
+		s.triOf = make([][]int, corpus.Size)
+		for _, tg := range top[:min(len(top), precision)] {
+			class, ok := s.classify(tg)
+			if !ok {
+				continue
+			}
+			i := len(s.trigrams)
+			s.trigrams = append(s.trigrams, tg)
+			for _, k := range tg.Chars {
+				indices := s.triOf[k]
+				if len(indices) == 0 || indices[len(indices)-1] != i {
+					s.triOf[k] = append(indices, i)
+				}
+			}
+			s.triClass = append(s.triClass, class)
+			s.tri.Total += tg.Count
+			s.tri.add(class, tg.Count)
+		}
+		s.triSeen = make([]int, len(s.trigrams))
+	}
+
+	return s
+}
+
+func (self *Scorer) classify(tg Trigram) (trigramClass, bool) {
+	f1 := self.fingers[tg.Chars[0]]
+	f2 := self.fingers[tg.Chars[1]]
+	f3 := self.fingers[tg.Chars[2]]
+	if f1 < 0 || f2 < 0 || f3 < 0 {
+		return trigramOther, false
+	}
+	return classifyTrigram(f1, f2, f3), true
+}
+
+// setFinger records that the key with corpus id k is now at p.
+func (self *Scorer) setFinger(k int, p Pos) {
+	if k == len(self.fingers)-1 {
+		return // not in the corpus
+	}
+	self.fingers[k], _ = self.l.Finger(p)
+}
+
+func (self *Scorer) pairSpeed(p1, p2 Pos) float64 {
+	return self.layout.pairSpeed(self.coords, p1, p2, self.ids[p1.Row][p1.Col], self.ids[p2.Row][p2.Col])
+}
+
+// Score is equivalent to GenkeyGenerate.Score of the current layout.
+func (self *Scorer) Score() float64 {
+	if self.full {
+		return self.generate.Score(self.l)
+	}
+	userData := self.generate.userData
+	l := self.l
+
+	var score float64
+	s := &userData.Config.Weights.Score
+	if s.FSpeed != 0 {
+		kps := &userData.Config.Weights.FSpeed.KPS
+		total := 0.0
+		for f, speed := range self.speeds {
+			total += 800 * (speed / kps[f]) / l.Total
+		}
+		score += s.FSpeed * total
+	}
+	if s.LSB != 0 {
+		score += s.LSB * 100 * float64(self.lsb) / l.Total
+	}
+	if s.Trigrams.Enabled {
+		score = self.generate.addTrigramScore(score, &self.tri)
+	}
+	if s.IndexBalance != 0 {
+		left, right := self.layout.IndexUsage(l)
+		score += s.IndexBalance * math.Abs(right-left)
+	}
+	if userData.Corpus.HasShift {
+		shifts := countShifts(&userData.Config, userData.Corpus, self.fingers)
+		score = self.generate.addShiftScore(score, &shifts, l.Total)
+	}
+
+	userData.Analyzed++
+
+	if self.check {
+		full := self.generate.Score(l)
+		if math.Abs(full-score) > 1e-9*math.Max(1, math.Abs(full)) {
+			userData.DeltaMismatches.Increment()
+			self.generate.SendMessage(fmt.Sprintf("delta score %v differs from full score %v\n", score, full))
+		}
+	}
+
+	return score
+}
+
+// Swap swaps the keys at a and b and updates the partial sums.
+func (self *Scorer) Swap(a, b Pos) {
+	if self.full || a == b {
+		self.generate.Swap(self.l, a, b)
+		return
+	}
+	self.swaps++
+
+	var tris []int
+	if self.triOf != nil {
+		tris = self.touchedTrigrams(a, b)
+	}
+
+	self.update(a, b, tris, -1)
+	self.generate.Swap(self.l, a, b)
+	ka, kb := self.ids[a.Row][a.Col], self.ids[b.Row][b.Col]
+	self.ids[a.Row][a.Col], self.ids[b.Row][b.Col] = kb, ka
+	self.setFinger(ka, b)
+	self.setFinger(kb, a)
+	self.update(a, b, tris, 1)
+}
+
+// touchedTrigrams lists the trigrams containing either swapped key once.
+func (self *Scorer) touchedTrigrams(a, b Pos) []int {
+	var tris []int
+	for _, p := range []Pos{a, b} {
+		for _, i := range self.triOf[self.ids[p.Row][p.Col]] {
+			if self.triSeen[i] != self.swaps {
+				self.triSeen[i] = self.swaps
+				tris = append(tris, i)
+			}
+		}
+	}
+	return tris
+}
+
+// update adds (sign 1) or removes (sign -1) every term involving a or b.
+func (self *Scorer) update(a, b Pos, tris []int, sign int) {
+	l := self.l
+
+	if self.generate.userData.Config.Weights.Score.FSpeed != 0 {
+		fa, oka := l.Finger(a)
+		fb, okb := l.Finger(b)
+		if oka && okb && fa == fb {
+			delta := self.rowSpeed(a, fa) + self.rowSpeed(b, fb) - self.pairSpeed(a, b)
+			self.speeds[fa] += float64(sign) * delta
+		} else {
+			if oka {
+				self.speeds[fa] += float64(sign) * self.rowSpeed(a, fa)
+			}
+			if okb {
+				self.speeds[fb] += float64(sign) * self.rowSpeed(b, fb)
+			}
+		}
+	}
+
+	if self.lsbOf != nil {
+		for _, i := range self.lsbOf[a] {
+			self.updateLSB(i, sign)
+		}
+		for _, i := range self.lsbOf[b] {
+			pair := self.lsbPairs[i]
+			if pair[0] == a || pair[1] == a {
+				continue // already updated through a
+			}
+			self.updateLSB(i, sign)
+		}
+	}
+
+	for _, i := range tris {
+		tg := self.trigrams[i]
+		if sign < 0 {
+			self.tri.add(self.triClass[i], -tg.Count)
+		} else {
+			self.triClass[i], _ = self.classify(tg)
+			self.tri.add(self.triClass[i], tg.Count)
+		}
+	}
+}
+
+// rowSpeed sums the finger speed of p paired with every key of its finger,
+// including itself.
+func (self *Scorer) rowSpeed(p Pos, f Finger) float64 {
+	var speed float64
+	for _, q := range self.l.Fingermap[f] {
+		speed += self.pairSpeed(p, q)
+	}
+	return speed
+}
+
+func (self *Scorer) updateLSB(i int, sign int) {
+	if sign < 0 {
+		self.lsb -= self.lsbs[i]
+		return
+	}
+	self.lsbs[i] = self.layout.lsbCount(self.ids, self.lsbPairs[i])
+	self.lsb += self.lsbs[i]
+}
@@ -0,0 +1,68 @@
+package genkey
+
+import (
+	"math"
+	"math/rand"
+	"testing"
+)
+
+// scorerLayouts are layouts of every geometry the generator works on.
+var scorerLayouts = []struct {
+	name string
+	file string
+}{
+	{"thumbs", `thumbs
+q w f p b j l u y ;
+a r s t g m n e i o
+z x c d v k h , . /
+␣ '
+0 1 2 3 3 4 4 5 6 7
+0 1 2 3 3 4 4 5 6 7
+0 1 2 3 3 4 4 5 6 7
+LT RT`},
+	{"number row", `number row
+1 2 3 4 5 6 7 8 9 0
+q w e r t y u i o p
+a s d f g h j k l ;
+z x c v b n m , . /
+0 1 2 3 3 4 4 5 6 7
+0 1 2 3 3 4 4 5 6 7
+0 1 2 3 3 4 4 5 6 7
+0 1 2 3 3 4 4 5 6 7`},
+}
+
+func TestScorerMatchesScore(t *testing.T) {
+	genkeyMain := loadTestSession(t)
+	userData := genkeyMain.userData
+	g := NewGenkeyGenerate(genkeyMain.conn, userData)
+
+	layouts := []*Layout{userData.Layouts["qwerty"]}
+	for _, f := range scorerLayouts {
+		l, errs := NewGenkeyLayout(genkeyMain.conn, userData).ReadLayout(f.name, f.file)
+		if errs.Fatal() {
+			t.Fatalf("%s: %v", f.name, errs)
+		}
+		layouts = append(layouts, l)
+	}
+
+	rng := rand.New(rand.NewSource(1))
+	for _, l := range layouts {
+		l = l.Copy()
+		var posits []Pos
+		for y, row := range l.Keys {
+			for x := range row {
+				posits = append(posits, Pos{x, y})
+			}
+		}
+
+		s := g.NewScorer(l)
+		for i := 0; i < 300; i++ {
+			a, b := posits[rng.Intn(len(posits))], posits[rng.Intn(len(posits))]
+			s.Swap(a, b)
+			delta, full := s.Score(), g.Score(l)
+			if math.Abs(delta-full) > 1e-9*math.Max(1, math.Abs(full)) {
+				t.Fatalf("%s: after %d swaps, swapping %v and %v, delta score %v, full score %v", l.Name, i+1, a, b, delta, full)
+			}
+		}
+	}
+}
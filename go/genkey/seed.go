@@ -0,0 +1,147 @@
+package genkey
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"math/rand"
+)
+
+// Random streams of a generation run. Every layout is improved with its
+// own stream derived from the run seed, stage and layout index, so a
+// seeded run gives the same result however its goroutines are scheduled.
+const (
+	streamRandom uint64 = iota + 1 // random starting layouts
+	streamGreedy
+	streamFull
+	streamWorsen
+)
+
+func splitmix64(x uint64) uint64 {
+	x += 0x9e3779b97f4a7c15
+	x = (x ^ (x >> 30)) * 0xbf58476d1ce4e5b9
+	x = (x ^ (x >> 27)) * 0x94d049bb133111eb
+	return x ^ (x >> 31)
+}
+
+// NewStream returns the random stream i of a stage of the run with seed.
+func NewStream(seed int64, stage uint64, i int) *rand.Rand {
+	s := splitmix64(uint64(seed) ^ splitmix64(stage<<32|uint64(uint32(i))))
+	return rand.New(rand.NewSource(int64(s)))
+}
+
+// runSeed returns the -seed flag, or a new random seed if it was not set.
+func (self *UserData) runSeed() int64 {
+	if self.SeedFlag != 0 {
+		return self.SeedFlag
+	}
+	for {
+		if seed := rand.Int63(); seed != 0 {
+			return seed
+		}
+	}
+}
+
+// RunManifest records everything a generate or improve run depends on, so
+// that passing the same seed with the same corpus and config replays it.
+type RunManifest struct {
+	Command          string     `json:"command"`
+	Layout           string     `json:"layout,omitempty"`  // the improved layout
+	Keys             [][]string `json:"keys,omitempty"`    // of the improved layout before improving it
+	Fingers          [][]Finger `json:"fingers,omitempty"` // of the improved layout
+	Template         [][]string `json:"template"`          // layouts/_generate, keys other than * and X are pinned
+	TemplateFingers  [][]Finger `json:"templateFingers"`
+	Seed             int64      `json:"seed"`
+	Corpus           string     `json:"corpus"`
+	Keyboard         string     `json:"keyboard"`
+	CorpusHash       string     `json:"corpusHash,omitempty"` // sha256 of the corpus files, not set for uploads
+	Flags            []string   `json:"flags"`
+	Weights          any        `json:"weights"`
+	Generation       any        `json:"generation"`
+	CorpusProcessing any        `json:"corpusProcessing"` // how corpus text and word lists are counted
+	WordLists        any        `json:"wordLists"`
+	Population       int        `json:"population"`
+	Selection        int        `json:"selection"`
+	Score            float64    `json:"score"`
+	Cancelled        bool       `json:"cancelled,omitempty"` // cancelled runs do not replay
+}
+
+func (self *GenkeyMain) runManifest(command string, layout string, seed int64, population int, score float64) *RunManifest {
+	userData := self.userData
+	flags := []string{}
+	for _, f := range []struct {
+		name string
+		set  bool
+	}{
+		{"-slide", userData.SlideFlag},
+		{"-dynamic", userData.DynamicFlag},
+	} {
+		if f.set {
+			flags = append(flags, f.name)
+		}
+	}
+
+	var hash string
+	if userData.SessionCorpus == nil {
+		hash = self.corpusHash(userData.corpusParts())
+	}
+	manifest := &RunManifest{
+		Command:          command,
+		Layout:           layout,
+		Template:         userData.GeneratedKeys,
+		TemplateFingers:  userData.GeneratedGeometry.Fingermatrix,
+		Seed:             seed,
+		Corpus:           userData.CorpusName(),
+		Keyboard:         userData.Keyboard.id,
+		CorpusHash:       hash,
+		Flags:            flags,
+		Weights:          userData.Config.Weights,
+		Generation:       userData.Config.Generation,
+		CorpusProcessing: userData.Config.CorpusProcessing,
+		WordLists:        userData.Config.WordLists,
+		Population:       population,
+		Selection:        userData.Config.Generation.Selection,
+		Score:            score,
+		Cancelled:        userData.Cancelled(),
+	}
+	if userData.ImproveFlag {
+		manifest.Keys = userData.ImproveLayout.Keys
+		manifest.Fingers = userData.ImproveLayout.Fingermatrix
+	}
+	return manifest
+}
+
+// corpusHash is the sha256 of the corpus file, or for blends of the
+// hashes and weights of every corpus in the blend.
+func (self *GenkeyMain) corpusHash(parts []BlendPart) string {
+	var hashes []string
+	for _, p := range parts {
+		path := corpusPath(&self.userData.Config, p.Name)
+		hashes = append(hashes, hashCache.get(path, "", func() string { return hashFile(path) }))
+	}
+	if len(parts) == 1 {
+		return hashes[0]
+	}
+	h := sha256.New()
+	for i, p := range parts {
+		fmt.Fprintf(h, "%s %v %s\n", p.Name, p.Weight, hashes[i])
+	}
+	return hex.EncodeToString(h.Sum(nil))
+}
+
+func hashFile(path string) string {
+	b, err := GenkeyReadFile(path)
+	if err != nil {
+		panic(err)
+	}
+	sum := sha256.Sum256(b)
+	return hex.EncodeToString(sum[:])
+}
+
+func (self *GenkeyMain) sendSeed(manifest *RunManifest) {
+	if manifest.Cancelled {
+		self.SendMessage(fmt.Sprintf("seed %d (cancelled runs cannot be replayed)\n", manifest.Seed))
+		return
+	}
+	self.SendMessage(fmt.Sprintf("seed %d, replay with -seed %d\n", manifest.Seed, manifest.Seed))
+}
@@ -0,0 +1,77 @@
+package genkey
+
+// ShiftStats counts the shift key presses a layout needs for a corpus
+// processed with RecordShift.
+type ShiftStats struct {
+	Presses  int
+	SFBs     int // on the finger of the key before or of the shifted key
+	SameHand int // on the hand of the shifted key
+}
+
+// shiftFinger returns the finger pressing shift for a key typed by f.
+func shiftFinger(config *UserConfig, f Finger) Finger {
+	fingers := config.Weights.Shift.Fingers
+	switch config.Weights.Shift.Side {
+	case "left":
+		return fingers[0]
+	case "right":
+		return fingers[1]
+	}
+	if !f.Right() {
+		return fingers[1]
+	}
+	return fingers[0]
+}
+
+// countShifts counts shift presses given the finger of every corpus id.
+// A held shift is pressed once per run of shifted letters, a one-shot
+// shift before every shifted letter.
+func countShifts(config *UserConfig, corpus *Corpus, fingers []Finger) ShiftStats {
+	var stats ShiftStats
+	if !corpus.HasShift {
+		return stats
+	}
+	oneShot := config.Weights.Shift.OneShot
+	size := corpus.Size
+	for b := 0; b < size; b++ {
+		n := corpus.ShiftLetters[b]
+		fb := fingers[b]
+		if n == 0 || fb < 0 {
+			continue
+		}
+		s := shiftFinger(config, fb)
+
+		presses := n
+		if !oneShot {
+			for a := 0; a < size; a++ {
+				presses -= corpus.ShiftHeld[a*size+b]
+			}
+		}
+		stats.Presses += presses
+		if s.Right() == fb.Right() {
+			stats.SameHand += presses
+		}
+
+		if fb == s {
+			// The shift finger has to type the key itself, shift held or not
+			stats.SFBs += n
+			continue
+		}
+		for a := 0; a < size; a++ {
+			if fingers[a] != s {
+				continue
+			}
+			stats.SFBs += corpus.ShiftBigrams[a*size+b]
+			if oneShot {
+				stats.SFBs += corpus.ShiftHeld[a*size+b]
+			}
+		}
+	}
+	return stats
+}
+
+// Shifts counts the shift presses of l.
+func (self *GenkeyLayout) Shifts(l *Layout) ShiftStats {
+	corpus := self.userData.Corpus
+	return countShifts(&self.userData.Config, corpus, corpus.KeyFingers(l))
+}
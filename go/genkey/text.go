@@ -15,25 +15,28 @@ Copyright (C) 2024 semi
 package genkey
 
 import (
-	"bufio"
+	"bytes"
+	"cmp"
 	"encoding/json"
 	"errors"
 	"fmt"
 	"io"
-	"math"
 	"os"
-	"sort"
-	"unicode"
+	"runtime"
+	"slices"
+	"strings"
+	"sync"
+	"time"
 
 	websocket "github.com/gorilla/websocket"
 )
 
 type GenkeyText struct {
-	conn     *websocket.Conn
+	conn     Conn
 	userData *UserData
 }
 
-func NewGenkeyText(conn *websocket.Conn, userData *UserData) *GenkeyText {
+func NewGenkeyText(conn Conn, userData *UserData) *GenkeyText {
 	return &GenkeyText{conn, userData}
 }
 
@@ -49,125 +52,184 @@ type TextData struct {
 	Skipgrams    map[string]float64 `json:"skipgrams"`
 	TotalBigrams int
 	Total        int
+
+	// Ngrams longer than trigrams by length, only recorded up to
+	// CorpusProcessing.MaxNgramSize and pruned to the NgramLimit most
+	// frequent of each length
+	Ngrams map[int]map[string]int `json:"ngrams,omitempty"`
+
+	// Only recorded with CorpusProcessing.RecordShift, keyed by the
+	// unshifted characters
+	ShiftLetters map[string]int `json:"shiftletters,omitempty"` // letters typed shifted
+	ShiftBigrams map[string]int `json:"shiftbigrams,omitempty"` // bigrams shifting only the second letter
+	ShiftHeld    map[string]int `json:"shiftheld,omitempty"`    // bigrams with both letters shifted
 }
 
 func (self *GenkeyText) GetTextData(f string) TextData {
-	self.SendMessage("Reading...\n")
 	file, err := GenkeyOpen(f)
 	if err != nil {
 		panic(err)
 	}
 	defer file.Close()
 
-	var data TextData
-	data.Letters = make(map[string]int)
-	data.Bigrams = make(map[string]int)
-	data.Trigrams = make(map[string]int)
-	data.Skipgrams = make(map[string]float64)
-
-	validstr := self.userData.Config.CorpusProcessing.ValidChars
-	maxSkipgramSize := int(self.userData.Config.CorpusProcessing.MaxSkipgramSize)
-	onlySpanValidChars := self.userData.Config.CorpusProcessing.SkipgramsMustSpanValidChars
-	substitutionslist := self.userData.Config.CorpusProcessing.CharSubstitutions
+	// Like the line reader it replaced, a last line without a line break
+	// is left out, so that corpora come out the same as before
+	return self.readTextData(file, false)
+}
 
-	validmap := make(map[rune]bool)
-	for _, c := range validstr {
-		validmap[c] = true
-	}
+// textChunkSize is about how much text is counted at a time by each
+// goroutine of ReadTextData, a variable so that tests can use tiny chunks.
+var textChunkSize = 1 << 20
+
+// ReadTextData builds a corpus from raw text according to the
+// CorpusProcessing config. The text is split into chunks at line breaks
+// and counted by several goroutines. No ngram spans a line break, so the
+// sum of the chunks is the corpus of the whole text. Chunks are added up
+// in the order of the text, so that pruning the longer ngrams on the way
+// always gives the same corpus. A last line without a line break is
+// counted too.
+func (self *GenkeyText) ReadTextData(r io.Reader) TextData {
+	return self.readTextData(r, true)
+}
 
-	substitutionmap := make(map[rune]rune)
-	for _, pair := range substitutionslist {
-		substitutionmap[rune(pair[0][0])] = rune(pair[1][0])
-	}
+// readTextData is ReadTextData, leaving out a last line without a line
+// break unless lastLine.
+func (self *GenkeyText) readTextData(r io.Reader, lastLine bool) TextData {
+	self.SendMessage("Reading...\n")
+	start := time.Now()
 
-	powers := []float64{}
+	counter := newTextCounter(&self.userData.Config)
+	workers := runtime.GOMAXPROCS(0)
 
-	for i := 0; i < maxSkipgramSize; i++ {
-		powers = append(powers, 1/math.Pow(2, float64(i)))
+	type textChunk struct {
+		seq  int
+		text []byte
 	}
-
-	var lastchars []rune
-
-	reader := bufio.NewReader(file)
-
-	var line int
-	for {
-		chars, err := reader.ReadString('\n')
-		if errors.Is(err, io.EOF) {
-			break
+	type countedChunk struct {
+		seq     int
+		counter *textCounter
+		lines   int
+		bytes   int
+	}
+	chunks := make(chan textChunk)
+	counted := make(chan countedChunk)
+	// Bounds the chunks read but not yet added up
+	inflight := make(chan struct{}, 2*workers)
+
+	var readErr error
+	go func() {
+		defer close(chunks)
+		seq := 0
+		readErr = readChunks(r, textChunkSize, lastLine, func(chunk []byte) {
+			inflight <- struct{}{}
+			chunks <- textChunk{seq, chunk}
+			seq++
+		})
+	}()
+
+	var wg sync.WaitGroup
+	for i := 0; i < workers; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for chunk := range chunks {
+				c := counter.empty()
+				lines := c.addLines(chunk.text)
+				counted <- countedChunk{chunk.seq, c, lines, len(chunk.text)}
+			}
+		}()
+	}
+	go func() {
+		wg.Wait()
+		close(counted)
+	}()
+
+	var lines, read, next int
+	pending := make(map[int]countedChunk)
+	for chunk := range counted {
+		pending[chunk.seq] = chunk
+		for c, ok := pending[next]; ok; c, ok = pending[next] {
+			delete(pending, next)
+			next++
+			counter.merge(c.counter)
+			<-inflight
+			lines += c.lines
+			read += c.bytes
 		}
+		rate := int(float64(read) / max(time.Since(start).Seconds(), 0.001))
+		sendProgress(self.conn, Progress{Stage: "reading", Total: lines, Bytes: read, Rate: rate},
+			fmt.Sprintf("%d lines read, %s/s...\r", lines, formatBytes(int64(rate))))
+	}
+	if readErr != nil {
+		panic(readErr)
+	}
 
-		lastchars = []rune{}
+	elapsed := time.Since(start).Seconds()
+	self.SendMessage(fmt.Sprintf("\nRead %d lines (%s) in %.2fs, %s/s\n", lines, formatBytes(int64(read)),
+		elapsed, formatBytes(int64(float64(read)/max(elapsed, 0.001)))))
 
-		line++
-		if line%1000 == 0 {
-			self.SendMessage(fmt.Sprintf("%d lines read...\r", line))
-		}
-		for _, char := range chars {
-			data.Total++
-			char = unicode.ToLower(char)
+	return counter.finish()
+}
 
-			if sub, ok := substitutionmap[char]; ok {
-				char = sub
+// readChunks passes r on in chunks of about size bytes that end at a line
+// break, so that no line is split between two chunks. A line longer than
+// size makes a longer chunk. The last line of r only ends a chunk without
+// a line break if lastLine.
+func readChunks(r io.Reader, size int, lastLine bool, chunk func([]byte)) error {
+	var carry []byte
+	for {
+		buf := make([]byte, len(carry), len(carry)+size)
+		copy(buf, carry)
+		n, err := io.ReadFull(r, buf[len(carry):cap(buf)])
+		buf = buf[:len(carry)+n]
+		if errors.Is(err, io.EOF) || errors.Is(err, io.ErrUnexpectedEOF) {
+			if !lastLine {
+				buf = buf[:bytes.LastIndexByte(buf, '\n')+1]
 			}
-
-			if !validmap[char] {
-				if onlySpanValidChars {
-					// reset lastchars in case of invalid character
-					lastchars = []rune{}
-				} else {
-					lastchars = append(lastchars, 'X') // sentinel value for invalid char
-
-					if len(lastchars) > maxSkipgramSize {
-						lastchars = lastchars[1 : maxSkipgramSize+1] // remove first character
-					}
-				}
-				continue
-			} else {
-				data.Letters[string(char)]++
-				length := len(lastchars)
-				last := length - 1 // index of the most recent character
-				for i := last; i >= 0; i-- {
-					c := lastchars[i]
-					if c == 'X' {
-						continue
-					}
-					if i == last {
-						if c != ' ' && char != ' ' {
-							data.TotalBigrams++
-						}
-						data.Bigrams[string(c)+string(char)]++
-					} else {
-						if i == last-1 && lastchars[last] != 'X' {
-							data.Trigrams[string(c)+string(lastchars[last])+string(char)]++
-						}
-						data.Skipgrams[string(c)+string(char)] += powers[length-i-2]
-					}
-				}
-				lastchars = append(lastchars, char)
-
-				if len(lastchars) > maxSkipgramSize {
-					lastchars = lastchars[1 : maxSkipgramSize+1] // remove first character
-				}
+			if len(buf) > 0 {
+				chunk(buf)
 			}
+			return nil
+		} else if err != nil {
+			return err
 		}
-	}
 
-	self.SendMessage("\n")
+		end := bytes.LastIndexByte(buf, '\n') + 1
+		if end > 0 {
+			chunk(buf[:end])
+		}
+		carry = buf[end:]
+	}
+}
 
-	var sorted []FreqPair
+// MaxNgramSize is the longest ngram a corpus can record.
+const MaxNgramSize = 8
 
-	for k, v := range data.Trigrams {
-		sorted = append(sorted, FreqPair{k, float64(v)})
+// pruneNgrams keeps the limit most frequent ngrams, breaking ties by
+// ngram so that the same text always keeps the same ones.
+func pruneNgrams(ngrams map[string]int, limit int) map[string]int {
+	if limit <= 0 || len(ngrams) <= limit {
+		return ngrams
 	}
-
-	sort.Slice(sorted, func(i, j int) bool {
-		return sorted[i].Count > sorted[j].Count
+	type ngramCount struct {
+		ngram string
+		count int
+	}
+	counts := make([]ngramCount, 0, len(ngrams))
+	for k, v := range ngrams {
+		counts = append(counts, ngramCount{k, v})
+	}
+	slices.SortFunc(counts, func(a, b ngramCount) int {
+		if a.count != b.count {
+			return cmp.Compare(b.count, a.count)
+		}
+		return strings.Compare(a.ngram, b.ngram)
 	})
-
-	data.TopTrigrams = sorted
-
-	return data
+	pruned := make(map[string]int, limit)
+	for _, c := range counts[:limit] {
+		pruned[c.ngram] = c.count
+	}
+	return pruned
 }
 
 func (self *GenkeyText) WriteData(data TextData, path string) {
@@ -187,12 +249,30 @@ func (self *GenkeyText) WriteData(data TextData, path string) {
 	f.WriteString(string(js))
 }
 
+// LoadData reads a processed corpus, binary or json. A binary corpus that
+// cannot be decoded falls back to the json corpus next to it.
 func (self *GenkeyText) LoadData(path string) TextData {
 	b, err := GenkeyReadFile(path)
 	if err != nil {
 		panic(err)
 	}
 
+	if isBinaryCorpus(b) {
+		data, _, err := DecodeCorpus(b)
+		if err == nil {
+			return data
+		}
+		source, ok := strings.CutSuffix(path, BinaryCorpusExt)
+		source += ".json"
+		if _, statErr := GenkeyStat(source); !ok || statErr != nil {
+			panic(fmt.Sprintf("Corpus [%s] could not be read: %v\n", path, err))
+		}
+		self.SendMessage(fmt.Sprintf("WARNING: Corpus [%s] could not be read: %v, using %s\n", path, err, source))
+		if b, err = GenkeyReadFile(source); err != nil {
+			panic(err)
+		}
+	}
+
 	var data TextData
 
 	err = json.Unmarshal(b, &data)
@@ -0,0 +1,84 @@
+package genkey
+
+import (
+	"bufio"
+	"reflect"
+	"runtime"
+	"strings"
+	"testing"
+)
+
+// sequentialTextData counts text line by line on one goroutine, like the
+// reader ReadTextData replaced.
+func sequentialTextData(config *UserConfig, text string, lastLine bool) TextData {
+	counter := newTextCounter(config)
+	r := bufio.NewReader(strings.NewReader(text))
+	for {
+		line, err := r.ReadString('\n')
+		if err != nil && (!lastLine || line == "") {
+			break
+		}
+		counter.addLines([]byte(line))
+		if err != nil {
+			break
+		}
+	}
+	return counter.finish()
+}
+
+func TestReadTextDataMatchesSequential(t *testing.T) {
+	var config UserConfig
+	processing := &config.CorpusProcessing
+	processing.ValidChars = "abcdefghijklmnopqrstuvwxyzéèüß ',.;/"
+	processing.CharSubstitutions = [][2]string{{"’", "'"}}
+	processing.MaxSkipgramSize = 4
+	processing.SkipgramsMustSpanValidChars = true
+	processing.MaxNgramSize = 5
+	processing.RecordShift = true
+
+	texts := map[string]string{
+		"empty":           "",
+		"newline":         "\n",
+		"no last newline": "The quick brown fox\njumps over the lazy dog",
+		"blank lines":     "\n\nab\n\n\ncd ef\n",
+		"multi-byte":      strings.Repeat("Ünterführung éèé straße’s ß\n", 40) + "Ééé ü",
+		"long line":       strings.Repeat("über die Brücke ", 200) + "\nkurz\n",
+	}
+
+	defer func(size int) { textChunkSize = size }(textChunkSize)
+	defer runtime.GOMAXPROCS(runtime.GOMAXPROCS(0))
+	for name, text := range texts {
+		for _, lastLine := range []bool{true, false} {
+			want := sequentialTextData(&config, text, lastLine)
+			// Chunks of a few bytes end inside multi-byte characters
+			for _, size := range []int{1, 3, 7, 64, 1 << 20} {
+				for _, workers := range []int{1, 4} {
+					textChunkSize = size
+					runtime.GOMAXPROCS(workers)
+					g := NewGenkeyText(&textCapture{}, &UserData{Config: config})
+					got := g.readTextData(strings.NewReader(text), lastLine)
+					if !reflect.DeepEqual(got, want) {
+						t.Errorf("%s, last line %v, %d byte chunks, %d workers: got %+v, want %+v",
+							name, lastLine, size, workers, got, want)
+					}
+				}
+			}
+		}
+	}
+}
+
+func TestReadTextDataLastLine(t *testing.T) {
+	var config UserConfig
+	config.CorpusProcessing.ValidChars = "abc"
+	config.CorpusProcessing.MaxSkipgramSize = 2
+	g := NewGenkeyText(&textCapture{}, &UserData{Config: config})
+	for _, tt := range []struct {
+		lastLine bool
+		want     int
+	}{{true, 4}, {false, 3}} {
+		data := g.readTextData(strings.NewReader("ab\nc"), tt.lastLine)
+		if data.Total != tt.want {
+			t.Errorf("last line %v: %d characters counted, want %d", tt.lastLine, data.Total, tt.want)
+		}
+	}
+}
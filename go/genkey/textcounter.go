@@ -0,0 +1,341 @@
+package genkey
+
+import (
+	"bytes"
+	"fmt"
+	"math"
+	"sort"
+	"unicode"
+)
+
+// textCounter counts the ngrams of characters fed to it one at a time,
+// according to the CorpusProcessing config. Ngrams are keyed by runes
+// while counting and only turned into strings by finish.
+type textCounter struct {
+	validmap           map[rune]bool
+	substitutionmap    map[rune]rune
+	powers             []float64
+	maxSkipgramSize    int
+	onlySpanValidChars bool
+	recordShift        bool
+	maxNgram           int
+	ngramLimit         int
+
+	// weight is how many times every character added counts
+	weight int
+
+	total        int
+	totalBigrams int
+	letters      map[rune]int
+	bigrams      map[[2]rune]int
+	trigrams     map[[3]rune]int
+	skipgrams    map[[2]rune]float64
+	ngrams       map[int]map[string]int
+	shiftLetters map[rune]int
+	shiftBigrams map[[2]rune]int
+	shiftHeld    map[[2]rune]int
+
+	// run holds the last valid characters with no invalid one between
+	// them, for ngrams longer than trigrams
+	run         []rune
+	lastchars   []rune
+	lastshifted bool // whether the last character of lastchars was shifted
+}
+
+func newTextCounter(config *UserConfig) *textCounter {
+	processing := &config.CorpusProcessing
+	self := &textCounter{
+		validmap:           make(map[rune]bool),
+		substitutionmap:    make(map[rune]rune),
+		maxSkipgramSize:    int(processing.MaxSkipgramSize),
+		onlySpanValidChars: processing.SkipgramsMustSpanValidChars,
+		recordShift:        processing.RecordShift,
+		maxNgram:           processing.MaxNgramSize,
+		ngramLimit:         processing.NgramLimit,
+	}
+
+	for _, c := range normalize(processing.ValidChars) {
+		self.validmap[c] = true
+	}
+
+	for _, pair := range processing.CharSubstitutions {
+		from := []rune(normalize(pair[0]))
+		to := []rune(normalize(pair[1]))
+		if len(from) != 1 || len(to) != 1 {
+			panic(fmt.Sprintf("Invalid config: CharSubstitutions [%q, %q] must both be single characters.", pair[0], pair[1]))
+		}
+		self.substitutionmap[from[0]] = to[0]
+	}
+
+	for i := 0; i < self.maxSkipgramSize; i++ {
+		self.powers = append(self.powers, 1/math.Pow(2, float64(i)))
+	}
+
+	self.clear()
+	return self
+}
+
+// empty returns a counter with the same config and nothing counted yet,
+// to count part of a text and merge it back.
+func (self *textCounter) empty() *textCounter {
+	c := *self
+	c.clear()
+	return &c
+}
+
+func (self *textCounter) clear() {
+	self.weight = 1
+	self.total, self.totalBigrams = 0, 0
+	self.letters = make(map[rune]int)
+	self.bigrams = make(map[[2]rune]int)
+	self.trigrams = make(map[[3]rune]int)
+	self.skipgrams = make(map[[2]rune]float64)
+	self.ngrams = nil
+	if self.maxNgram > 3 {
+		self.ngrams = make(map[int]map[string]int)
+		for n := 4; n <= self.maxNgram; n++ {
+			self.ngrams[n] = make(map[string]int)
+		}
+	}
+	self.shiftLetters, self.shiftBigrams, self.shiftHeld = nil, nil, nil
+	if self.recordShift {
+		self.shiftLetters = make(map[rune]int)
+		self.shiftBigrams = make(map[[2]rune]int)
+		self.shiftHeld = make(map[[2]rune]int)
+	}
+	self.run = make([]rune, 0, max(self.maxNgram, 0))
+	self.lastchars = make([]rune, 0, max(self.maxSkipgramSize, 0))
+	self.lastshifted = false
+}
+
+// mapChar lowercases char and applies CharSubstitutions, reporting whether
+// it was typed shifted and whether it is in ValidChars.
+func (self *textCounter) mapChar(char rune) (mapped rune, shifted bool, valid bool) {
+	lower := unicode.ToLower(char)
+	shifted = lower != char
+	char = lower
+
+	if sub, ok := self.substitutionmap[char]; ok {
+		char = sub
+		shifted = true
+	}
+	return char, shifted, self.validmap[char]
+}
+
+// reset starts a new line, no ngram spans a line break.
+func (self *textCounter) reset() {
+	self.lastchars = self.lastchars[:0]
+	self.run = self.run[:0]
+}
+
+// addLines counts text line by line, returning the number of lines.
+func (self *textCounter) addLines(text []byte) int {
+	var lines int
+	for len(text) > 0 {
+		end := bytes.IndexByte(text, '\n') + 1
+		if end == 0 {
+			end = len(text)
+		}
+		self.reset()
+		for _, char := range normalize(string(text[:end])) {
+			self.add(char)
+		}
+		text = text[end:]
+		lines++
+	}
+	return lines
+}
+
+// prime starts a new line as if char had just been typed, without counting
+// it. Ngrams starting at char are counted from then on.
+func (self *textCounter) prime(char rune) {
+	self.reset()
+	char, _, valid := self.mapChar(char)
+	self.lastshifted = false
+	if !valid {
+		if !self.onlySpanValidChars {
+			self.push('X')
+		}
+		return
+	}
+	self.push(char)
+	if self.maxNgram > 3 {
+		self.run = append(self.run, char)
+	}
+}
+
+// push appends char to lastchars, dropping the oldest character once it
+// holds MaxSkipgramSize.
+func (self *textCounter) push(char rune) {
+	if len(self.lastchars) < self.maxSkipgramSize {
+		self.lastchars = append(self.lastchars, char)
+	} else if len(self.lastchars) > 0 {
+		copy(self.lastchars, self.lastchars[1:])
+		self.lastchars[len(self.lastchars)-1] = char
+	}
+}
+
+func (self *textCounter) add(char rune) {
+	weight := self.weight
+	self.total += weight
+	char, shifted, valid := self.mapChar(char)
+
+	if !valid {
+		self.run = self.run[:0]
+		if self.onlySpanValidChars {
+			// reset lastchars in case of invalid character
+			self.lastchars = self.lastchars[:0]
+		} else {
+			self.push('X') // sentinel value for invalid char
+		}
+		return
+	}
+
+	lastchars := self.lastchars
+	self.letters[char] += weight
+	length := len(lastchars)
+	last := length - 1 // index of the most recent character
+	if self.recordShift && shifted {
+		self.shiftLetters[char] += weight
+		if last >= 0 && lastchars[last] != 'X' {
+			if self.lastshifted {
+				self.shiftHeld[[2]rune{lastchars[last], char}] += weight
+			} else {
+				self.shiftBigrams[[2]rune{lastchars[last], char}] += weight
+			}
+		}
+	}
+	self.lastshifted = shifted
+	if self.maxNgram > 3 {
+		if len(self.run) < self.maxNgram {
+			self.run = append(self.run, char)
+		} else {
+			copy(self.run, self.run[1:])
+			self.run[len(self.run)-1] = char
+		}
+		for n := 4; n <= len(self.run); n++ {
+			self.ngrams[n][string(self.run[len(self.run)-n:])] += weight
+			self.boundNgrams(n)
+		}
+	}
+	for i := last; i >= 0; i-- {
+		c := lastchars[i]
+		if c == 'X' {
+			continue
+		}
+		if i == last {
+			if c != ' ' && char != ' ' {
+				self.totalBigrams += weight
+			}
+			self.bigrams[[2]rune{c, char}] += weight
+		} else {
+			if i == last-1 && lastchars[last] != 'X' {
+				self.trigrams[[3]rune{c, lastchars[last], char}] += weight
+			}
+			self.skipgrams[[2]rune{c, char}] += self.powers[length-i-2] * float64(weight)
+		}
+	}
+	self.push(char)
+}
+
+// merge adds the counts of other. Skipgrams of text add up powers of two,
+// which sum exactly, so merging gives the same counts as counting the
+// whole text with one counter.
+func (self *textCounter) merge(other *textCounter) {
+	self.total += other.total
+	self.totalBigrams += other.totalBigrams
+	mergeCounts(self.letters, other.letters)
+	mergeCounts(self.bigrams, other.bigrams)
+	mergeCounts(self.trigrams, other.trigrams)
+	mergeCounts(self.skipgrams, other.skipgrams)
+	for n, ngrams := range other.ngrams {
+		mergeCounts(self.ngrams[n], ngrams)
+		self.boundNgrams(n)
+	}
+	mergeCounts(self.shiftLetters, other.shiftLetters)
+	mergeCounts(self.shiftBigrams, other.shiftBigrams)
+	mergeCounts(self.shiftHeld, other.shiftHeld)
+}
+
+// ngramSlack is how many times NgramLimit ngrams of one length a counter
+// holds before dropping all but the ngramSlack/2 * NgramLimit most
+// frequent, so that counting takes memory in proportion to NgramLimit.
+// Texts with more distinct ngrams than that get estimated counts for the
+// ngrams near the limit.
+const ngramSlack = 4
+
+// boundNgrams prunes the ngrams of length n once there are too many.
+func (self *textCounter) boundNgrams(n int) {
+	if self.ngramLimit > 0 && len(self.ngrams[n]) > ngramSlack*self.ngramLimit {
+		self.ngrams[n] = pruneNgrams(self.ngrams[n], ngramSlack/2*self.ngramLimit)
+	}
+}
+
+func mergeCounts[K comparable, V int | float64](dst, src map[K]V) {
+	for k, v := range src {
+		dst[k] += v
+	}
+}
+
+// finish stores the counts by string, sorts the trigrams and prunes the
+// longer ngrams.
+func (self *textCounter) finish() TextData {
+	data := TextData{
+		Letters:      make(map[string]int, len(self.letters)),
+		Bigrams:      make(map[string]int, len(self.bigrams)),
+		Trigrams:     make(map[string]int, len(self.trigrams)),
+		Skipgrams:    make(map[string]float64, len(self.skipgrams)),
+		TotalBigrams: self.totalBigrams,
+		Total:        self.total,
+	}
+	for k, v := range self.letters {
+		data.Letters[string(k)] = v
+	}
+	for k, v := range self.bigrams {
+		data.Bigrams[string(k[:])] = v
+	}
+	for k, v := range self.trigrams {
+		data.Trigrams[string(k[:])] = v
+	}
+	for k, v := range self.skipgrams {
+		data.Skipgrams[string(k[:])] = v
+	}
+	if self.recordShift {
+		data.ShiftLetters = make(map[string]int, len(self.shiftLetters))
+		data.ShiftBigrams = make(map[string]int, len(self.shiftBigrams))
+		data.ShiftHeld = make(map[string]int, len(self.shiftHeld))
+		for k, v := range self.shiftLetters {
+			data.ShiftLetters[string(k)] = v
+		}
+		for k, v := range self.shiftBigrams {
+			data.ShiftBigrams[string(k[:])] = v
+		}
+		for k, v := range self.shiftHeld {
+			data.ShiftHeld[string(k[:])] = v
+		}
+	}
+
+	var sorted []FreqPair
+
+	for k, v := range data.Trigrams {
+		sorted = append(sorted, FreqPair{k, float64(v)})
+	}
+
+	// Break ties by ngram so that the same text always has the same order
+	sort.Slice(sorted, func(i, j int) bool {
+		if sorted[i].Count != sorted[j].Count {
+			return sorted[i].Count > sorted[j].Count
+		}
+		return sorted[i].Ngram < sorted[j].Ngram
+	})
+
+	data.TopTrigrams = sorted
+	if self.ngrams != nil {
+		data.Ngrams = make(map[int]map[string]int, len(self.ngrams))
+		for n, ngrams := range self.ngrams {
+			data.Ngrams[n] = pruneNgrams(ngrams, self.ngramLimit)
+		}
+	}
+
+	return data
+}
@@ -0,0 +1,43 @@
+package genkey
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestCounterBoundsNgrams(t *testing.T) {
+	var config UserConfig
+	config.CorpusProcessing.ValidChars = "abcdefghijklmnopqrstuvwxyz"
+	config.CorpusProcessing.MaxSkipgramSize = 2
+	config.CorpusProcessing.MaxNgramSize = 4
+	config.CorpusProcessing.NgramLimit = 10
+
+	// Every 4-gram of a shuffled alphabet is distinct, "abcd" is counted
+	// once per line on top of them
+	var sb strings.Builder
+	for i := 0; i < 200; i++ {
+		for j := 0; j < 26; j++ {
+			sb.WriteByte(byte('a' + (i*7+j*11)%26))
+		}
+		sb.WriteString(" abcd\n")
+	}
+
+	counter := newTextCounter(&config)
+	for _, line := range strings.SplitAfter(sb.String(), "\n") {
+		counter.reset()
+		for _, char := range line {
+			counter.add(char)
+			if n := len(counter.ngrams[4]); n > ngramSlack*config.CorpusProcessing.NgramLimit {
+				t.Fatalf("%d 4-grams held, want at most %d", n, ngramSlack*config.CorpusProcessing.NgramLimit)
+			}
+		}
+	}
+
+	data := counter.finish()
+	if n := len(data.Ngrams[4]); n != config.CorpusProcessing.NgramLimit {
+		t.Errorf("%d 4-grams kept, want %d", n, config.CorpusProcessing.NgramLimit)
+	}
+	if count := data.Ngrams[4]["abcd"]; count < 200 {
+		t.Errorf("abcd counted %d times, want at least 200", count)
+	}
+}
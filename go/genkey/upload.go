@@ -0,0 +1,105 @@
+package genkey
+
+import (
+	"fmt"
+	"strings"
+)
+
+// MaxUploadSize caps the raw text a session may upload as a corpus.
+const MaxUploadSize = 8 << 20
+
+// SessionCorpus is a corpus that only exists for one session, like an
+// uploaded one. It replaces the corpus from the config until cleared.
+type SessionCorpus struct {
+	Name   string
+	Data   TextData
+	Corpus *Corpus
+}
+
+type corpusUpload struct {
+	name string
+	text strings.Builder
+}
+
+type UploadResult struct {
+	Name     string `json:"name"`
+	Received int    `json:"received"` // bytes of text received so far
+	Total    int    `json:"total,omitempty"`
+	Letters  int    `json:"letters,omitempty"` // distinct characters
+	Bigrams  int    `json:"bigrams,omitempty"` // distinct bigrams
+}
+
+// loadDataPrefix is the upload chunk prefix. Everything after it is
+// appended to the upload verbatim, including whitespace and newlines.
+const loadDataPrefix = "load data "
+
+// load handles the load subcommands:
+//
+//	load begin name   starts a new upload
+//	load data text    appends text to it
+//	load end          processes it and makes it the session corpus
+//	load cancel       drops the upload
+//	load clear        goes back to the corpus from the config or corpus
+func (self *GenkeyMain) load(args []string) {
+	userData := self.userData
+	if len(args) < 2 {
+		self.SendMessage("usage: load begin name | load data text | load end | load cancel | load clear\n")
+		return
+	}
+
+	switch args[1] {
+	case "begin":
+		if len(args) < 3 {
+			self.SendMessage("usage: load begin name\n")
+			return
+		}
+		name := strings.Join(args[2:], " ")
+		userData.upload = &corpusUpload{name: name}
+		self.SendMessage(fmt.Sprintf("uploading [%s], send the text with load data\n", name))
+		self.result = UploadResult{Name: name}
+	case "end":
+		upload := userData.upload
+		if upload == nil {
+			self.SendMessage("no upload in progress, start one with load begin\n")
+			return
+		}
+		text := upload.text.String()
+		data := NewGenkeyText(self.conn, userData).ReadTextData(strings.NewReader(text))
+		if data.Total == 0 {
+			self.SendMessage("the upload is empty\n")
+			return
+		}
+		userData.upload = nil
+		userData.SessionCorpus = &SessionCorpus{upload.name, data, CompileCorpus(&data)}
+		self.loadData()
+
+		self.SendMessage(fmt.Sprintf("using [%s] (%d characters) for this session\n", upload.name, data.Total))
+		self.result = UploadResult{upload.name, len(text), data.Total, len(data.Letters), len(data.Bigrams)}
+	case "cancel":
+		userData.upload = nil
+		self.SendMessage("upload cancelled\n")
+	case "clear":
+		userData.upload = nil
+		userData.SessionCorpus = nil
+		self.loadData()
+		self.SendMessage(fmt.Sprintf("using [%s] again\n", userData.CorpusName()))
+	default:
+		self.SendMessage(fmt.Sprintf("unknown load subcommand [%s]\n", args[1]))
+	}
+}
+
+// loadChunk appends one load data message to the running upload.
+func (self *GenkeyMain) loadChunk(text string) {
+	upload := self.userData.upload
+	if upload == nil {
+		self.SendMessage("no upload in progress, start one with load begin\n")
+		return
+	}
+	if upload.text.Len()+len(text) > MaxUploadSize {
+		self.userData.upload = nil
+		self.SendMessage(fmt.Sprintf("upload is larger than %d bytes, cancelled\n", MaxUploadSize))
+		return
+	}
+	upload.text.WriteString(text)
+	self.result = UploadResult{Name: upload.name, Received: upload.text.Len()}
+}
@@ -0,0 +1,235 @@
+package genkey
+
+import (
+	"encoding/json"
+	"fmt"
+	"math"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+)
+
+// ReadWordList parses a word list into word counts. It is either an object
+// of words and their counts, like the words.json of cmini, or a list of
+// words counted once each, on its own or under "texts" or "words" like the
+// lists of a200 and monkeytype.
+func ReadWordList(b []byte) (map[string]int, error) {
+	var v any
+	if err := json.Unmarshal(b, &v); err != nil {
+		return nil, err
+	}
+
+	words := make(map[string]int)
+	addList := func(list []any) error {
+		for _, w := range list {
+			word, ok := w.(string)
+			if !ok {
+				return fmt.Errorf("word %v is not a string", w)
+			}
+			words[normalize(word)]++
+		}
+		return nil
+	}
+
+	switch v := v.(type) {
+	case []any:
+		if err := addList(v); err != nil {
+			return nil, err
+		}
+	case map[string]any:
+		for _, key := range []string{"texts", "words"} {
+			if list, ok := v[key].([]any); ok {
+				if err := addList(list); err != nil {
+					return nil, err
+				}
+				return words, nil
+			}
+		}
+		for word, n := range v {
+			count, ok := n.(float64)
+			if !ok || count < 0 || count != math.Trunc(count) || count > math.MaxInt32 {
+				return nil, fmt.Errorf("count %v of [%s] is not a whole number", n, word)
+			}
+			words[normalize(word)] += int(count)
+		}
+	default:
+		return nil, fmt.Errorf("expected an object of word counts or a list of words")
+	}
+	return words, nil
+}
+
+// ReadWordData builds a corpus from word counts according to the
+// CorpusProcessing and WordLists config, as if every word had been typed
+// as often as it is counted.
+func (self *GenkeyText) ReadWordData(words map[string]int) TextData {
+	config := &self.userData.Config
+	spaces := config.WordLists.Spaces
+
+	// Sorted so that skipgram sums always add up in the same order
+	sorted := make([]string, 0, len(words))
+	for word, n := range words {
+		if n > 0 {
+			sorted = append(sorted, word)
+		}
+	}
+	sort.Strings(sorted)
+
+	counter := newTextCounter(config)
+	for _, word := range sorted {
+		counter.weight = words[word]
+		if spaces {
+			// The space typed after the word before
+			counter.prime(' ')
+		} else {
+			counter.reset()
+		}
+		for _, char := range word {
+			counter.add(char)
+		}
+		if spaces {
+			counter.add(' ')
+		}
+	}
+	if spaces && config.WordLists.SpanWords {
+		counter.spanWords(words, sorted)
+	}
+	return counter.finish()
+}
+
+// spanWords adds the trigrams and skipgrams spanning the space between two
+// words, as if every word were followed by any other in proportion to its
+// count. Only neighbouring words are spanned, and longer ngrams are not.
+func (self *textCounter) spanWords(words map[string]int, sorted []string) {
+	size := self.maxSkipgramSize
+	space, _, spaceValid := self.mapChar(' ')
+	if size < 2 || (!spaceValid && self.onlySpanValidChars) {
+		return
+	}
+
+	// ends[i] counts the characters i before the end of the words, and
+	// starts[i] those i after their start
+	ends := make([]map[rune]float64, size)
+	starts := make([]map[rune]float64, size)
+	for i := range ends {
+		ends[i] = make(map[rune]float64)
+		starts[i] = make(map[rune]float64)
+	}
+	var total float64
+	for _, word := range sorted {
+		n := float64(words[word])
+		total += n
+		chars := []rune(word)
+		for i := 0; i < size && i < len(chars); i++ {
+			c, _, valid := self.mapChar(chars[len(chars)-1-i])
+			if !valid {
+				if self.onlySpanValidChars {
+					break
+				}
+				continue
+			}
+			ends[i][c] += n
+		}
+		for i := 0; i < size && i < len(chars); i++ {
+			c, _, valid := self.mapChar(chars[i])
+			if !valid {
+				if self.onlySpanValidChars {
+					break
+				}
+				continue
+			}
+			starts[i][c] += n
+		}
+	}
+
+	trigrams := make(map[[3]rune]float64)
+	for i := range ends {
+		end := sortedChars(ends[i])
+		for j := range starts {
+			// The skipgram from i before the space to j after it
+			distance := i + j + 2
+			if distance > size {
+				break
+			}
+			start := sortedChars(starts[j])
+			for _, a := range end {
+				for _, b := range start {
+					n := ends[i][a] * starts[j][b] / total
+					if distance == 2 && spaceValid {
+						trigrams[[3]rune{a, space, b}] += n
+					}
+					self.skipgrams[[2]rune{a, b}] += self.powers[distance-2] * n
+				}
+			}
+		}
+	}
+	for k, v := range trigrams {
+		if n := int(math.Round(v)); n != 0 {
+			self.trigrams[k] += n
+		}
+	}
+}
+
+func sortedChars(m map[rune]float64) []rune {
+	chars := make([]rune, 0, len(m))
+	for c := range m {
+		chars = append(chars, c)
+	}
+	sort.Slice(chars, func(i, j int) bool { return chars[i] < chars[j] })
+	return chars
+}
+
+// wordListPath finds the word list called name in the WordLists
+// directories, either name.json or name/words.json.
+func wordListPath(config *UserConfig, name string) (string, bool) {
+	for _, dir := range config.Paths.WordLists {
+		for _, path := range []string{
+			filepath.Join(dir, name) + ".json",
+			filepath.Join(dir, name, "words.json"),
+		} {
+			if stat, err := GenkeyStat(path); err == nil && !stat.IsDir() {
+				return path, true
+			}
+		}
+	}
+	return "", false
+}
+
+// WordListNames lists the word lists in the WordLists directories. A
+// directory that does not exist has none.
+func (self *UserData) WordListNames() []string {
+	var names []string
+	for _, dir := range self.Config.Paths.WordLists {
+		entries, err := os.ReadDir(filepath.Join(importerToGenkey, dir))
+		if err != nil {
+			continue
+		}
+		for _, e := range entries {
+			if name, ok := strings.CutSuffix(e.Name(), ".json"); ok && !e.IsDir() {
+				names = append(names, name)
+			} else if _, err := GenkeyStat(filepath.Join(dir, e.Name(), "words.json")); e.IsDir() && err == nil {
+				names = append(names, e.Name())
+			}
+		}
+	}
+	return names
+}
+
+// wordListKey is the config a corpus built from a word list depends on,
+// so that it is built again when that changes.
+func wordListKey(config *UserConfig) string {
+	return fmt.Sprint(config.CorpusProcessing, config.WordLists)
+}
+
+// readWordList builds the corpus of the word list at path.
+func (self *GenkeyMain) readWordList(path string) TextData {
+	b, err := GenkeyReadFile(path)
+	if err != nil {
+		panic(err)
+	}
+	words, err := ReadWordList(b)
+	if err != nil {
+		panic(fmt.Sprintf("Invalid word list [%s]: %v\n", path, err))
+	}
+	return NewGenkeyText(self.conn, self.userData).ReadWordData(words)
+}
@@ -1,11 +1,13 @@
 package main
 
 import (
+	"context"
 	"fmt"
 	"log"
 	"net/http"
 	"runtime/debug"
 	"strings"
+	"sync"
 
 	genkey "github.com/waterdragen/akl-ws/genkey"
 
@@ -58,6 +60,7 @@ func main() {
 
 	router.GET("/go/:tail/", handleRoute)
 	router.GET("/go/:tail", handleRoute)
+	router.POST("/go/genkey/:command", genkeyApi)
 
 	// Default service
 	router.NoRoute(func(c *gin.Context) {
@@ -70,66 +73,154 @@ func main() {
 	}
 }
 
+// safeConn serializes writes, since the reader goroutine may answer a
+// cancel request while a command is writing its output.
+type safeConn struct {
+	mu   sync.Mutex
+	conn *websocket.Conn
+}
+
+func (sc *safeConn) WriteMessage(messageType int, data []byte) error {
+	sc.mu.Lock()
+	defer sc.mu.Unlock()
+
+	return sc.conn.WriteMessage(messageType, data)
+}
+
+// maxMessageSize bounds a single websocket message, larger corpus uploads
+// must be split into several load data messages.
+const maxMessageSize = 1 << 20
+
 func genkeyWebsocket(conn *websocket.Conn) {
+	conn.SetReadLimit(maxMessageSize)
 	connID := generateConnID()
+	connCtx, disconnect := context.WithCancel(context.Background())
+	sc := &safeConn{conn: conn}
+	userData := &genkey.UserData{}
+	connUsersData.Add(connID, userData)
 
 	defer func() {
+		disconnect()
 		connUsersData.Pop(connID)
 		conn.Close()
 	}()
 
-	for {
-		genkeyProcess(conn, connID)
+	// Keep reading while a command runs so that it can be cancelled, and
+	// cancel it when the connection drops.
+	messages := make(chan string, 16)
+	go func() {
+		defer close(messages)
+		for {
+			_, message, err := conn.ReadMessage()
+			if err != nil {
+				// Disconnected
+				disconnect()
+				return
+			}
+			if genkeyCancel(sc, userData, string(message)) {
+				continue
+			}
+			select {
+			case messages <- string(message):
+			default:
+				sc.WriteMessage(websocket.TextMessage, []byte("too many queued commands, message dropped\n"))
+			}
+		}
+	}()
+
+	for message := range messages {
+		genkeyProcess(connCtx, sc, connID, message)
 	}
 }
 
-func genkeyProcess(conn *websocket.Conn, connID uint32) {
+// genkeyCancel aborts the running command if message is a cancel request.
+// Without a running command the request is processed like any other.
+func genkeyCancel(sc *safeConn, userData *genkey.UserData, message string) bool {
+	request, err := genkey.ParseRequest(message)
+	if err != nil || request.Command != "cancel" {
+		return false
+	}
+	if !userData.CancelJob() {
+		return false
+	}
+	if strings.HasPrefix(strings.TrimSpace(message), "{") {
+		genkey.NewJSONConn(sc, request).Finish(genkey.StatusDone, "cancelling")
+	}
+	return true
+}
+
+func genkeyProcess(connCtx context.Context, conn genkey.Conn, connID uint32, message string) {
+	var jsonConn *genkey.JSONConn
+
 	defer func() {
 		if r := recover(); r != nil {
 			stackTrace := string(debug.Stack())
 			stackTrace = strings.Join(strings.Split(stackTrace, "\n")[0:5], "\n")
 			errMsg := fmt.Sprintf("%s\n%s", r, stackTrace)
-			conn.WriteMessage(websocket.TextMessage, []byte(errMsg))
+			if jsonConn != nil {
+				jsonConn.Fail(fmt.Sprint(r))
+			} else {
+				conn.WriteMessage(websocket.TextMessage, []byte(errMsg))
+			}
 			log.Println(errMsg)
 		}
 	}()
 
-	// Read message from the websock et client
-	_, message, err := conn.ReadMessage()
-	if err != nil {
-		// Disconnected
+	userData, hasUserData := connUsersData.Get(connID)
+	if !hasUserData {
 		return
 	}
 
-	// Check if any cached data exists for this user
-	var userData *genkey.UserData
+	// Negotiate the message protocol for this connection
+	if protocol, ok := genkey.ParseProtocolSwitch(message); ok {
+		userData.Protocol = protocol
+		if protocol == genkey.JSONProtocol {
+			genkey.NewJSONConn(conn, genkey.Request{Command: "protocol"}).Finish(genkey.StatusDone, "json")
+		} else {
+			conn.WriteMessage(websocket.TextMessage, []byte("[DONE]"))
+		}
+		return
+	}
 
-	userDataObj, hasUserData := connUsersData.Get(connID)
-	if !hasUserData {
-		userData = nil
-	} else {
-		userData = userDataObj
+	var writer genkey.Conn = conn
+	if userData.Protocol == genkey.JSONProtocol {
+		request, err := genkey.ParseRequest(message)
+		jsonConn = genkey.NewJSONConn(conn, request)
+		if err != nil {
+			jsonConn.Fail(fmt.Sprintf("malformed request: %v", err))
+			return
+		}
+		message = request.Command
+		writer = jsonConn
 	}
 
+	userData.StartJob(connCtx)
+	defer userData.FinishJob()
+
 	// Run genkey
-	genkeyMain := genkey.NewGenkeyMain(conn, userData)
-	userData = genkeyMain.GetUserData()
+	genkeyMain := genkey.NewGenkeyMain(writer, userData)
+	var result any
 
 	if userData.Interactive.InInteractive {
-		genkeyInteractive := genkey.NewGenkeyInteractive(conn, userData)
-		genkeyInteractive.InteractiveSubsequent(string(message))
+		genkeyInteractive := genkey.NewGenkeyInteractive(writer, userData)
+		genkeyInteractive.InteractiveSubsequent(message)
+		result = genkeyInteractive.State()
 	} else {
-		genkeyMain.Run(string(message))
+		genkeyMain.Run(message)
+		result = genkeyMain.GetResult()
 	}
 
-	if userData.Interactive.InInteractive {
+	if jsonConn != nil {
+		if userData.Interactive.InInteractive {
+			jsonConn.Finish(genkey.StatusHold, result)
+		} else {
+			jsonConn.Finish(genkey.StatusDone, result)
+		}
+	} else if userData.Interactive.InInteractive {
 		genkeyMain.SendMessage("[HOLD]")
 	} else {
 		genkeyMain.SendMessage("[DONE]")
 	}
-
-	// Store UserData to sync map
-	connUsersData.Add(connID, genkeyMain.GetUserData())
 }
 
 func generateConnID() uint32 {